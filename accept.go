@@ -5,6 +5,7 @@ package websocket
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha1"
 	"encoding/base64"
 	"errors"
@@ -16,6 +17,7 @@ import (
 	"net/url"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"nhooyr.io/websocket/internal/errd"
 )
@@ -62,6 +64,55 @@ type AcceptOptions struct {
 	// Defaults to 512 bytes for CompressionNoContextTakeover and 128 bytes
 	// for CompressionContextTakeover.
 	CompressionThreshold int
+
+	// CompressionLevel is the flate level messages are compressed with,
+	// from flate.HuffmanOnly to flate.BestCompression.
+	//
+	// Higher levels trade CPU time for fewer bytes on the wire: flate.BestSpeed
+	// suits CPU constrained servers, flate.BestCompression bandwidth
+	// constrained links and flate.HuffmanOnly is cheapest but only helps with
+	// skewed byte distributions. flate.NoCompression cannot be selected, disable
+	// compression instead.
+	//
+	// Defaults to flate.BestSpeed.
+	CompressionLevel int
+
+	// ConnectionLimiter is a semaphore shared between Accept calls that limits the
+	// number of concurrent connections to its capacity.
+	//
+	// Accept sends on it before upgrading the connection and rejects the handshake
+	// with http.StatusServiceUnavailable if it is full. The slot is released exactly
+	// once when the connection is closed or if the upgrade fails.
+	ConnectionLimiter chan struct{}
+
+	// HandshakeTimeout bounds how long writing the handshake response to the
+	// client may take, protecting against clients that stall the upgrade.
+	// Once Accept returns, the deadline is cleared and only the contexts
+	// passed to the Conn's methods apply.
+	//
+	// The handshake request has already been read when Accept is called.
+	// Use http.Server.ReadHeaderTimeout to bound reading it.
+	//
+	// It requires the http.ResponseWriter to support write deadlines like
+	// the net/http server's does since Go 1.20. Otherwise it is ignored.
+	HandshakeTimeout time.Duration
+
+	// ShutdownContext, if set, closes the connection with StatusGoingAway
+	// when it is done. Pass a context shared by all Accept calls that is
+	// canceled on server shutdown to close every connection without tracking
+	// them.
+	ShutdownContext context.Context
+
+	// Extensions lists the custom extensions that Accept will negotiate with
+	// the client. They are negotiated in the order the client offers them.
+	// See Extension.
+	Extensions []Extension
+
+	// ConnInterceptors are called in order with every accepted connection
+	// before Accept returns it, e.g. to centralize setting read limits or
+	// registering metrics. If one panics, the connection is closed with
+	// StatusInternalError and Accept returns an error.
+	ConnInterceptors []func(*Conn)
 }
 
 func (opts *AcceptOptions) cloneWithDefaults() *AcceptOptions {
@@ -93,6 +144,11 @@ func accept(w http.ResponseWriter, r *http.Request, opts *AcceptOptions) (_ *Con
 	}
 
 	opts = opts.cloneWithDefaults()
+	err = validateCompressionLevel(opts.CompressionLevel)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return nil, err
+	}
 	if !opts.InsecureSkipVerify {
 		err = authenticateOrigin(r, opts.OriginPatterns)
 		if err != nil {
@@ -105,6 +161,21 @@ func accept(w http.ResponseWriter, r *http.Request, opts *AcceptOptions) (_ *Con
 		}
 	}
 
+	if opts.ConnectionLimiter != nil {
+		select {
+		case opts.ConnectionLimiter <- struct{}{}:
+		default:
+			err = errors.New("too many connections")
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return nil, err
+		}
+		defer func() {
+			if err != nil {
+				<-opts.ConnectionLimiter
+			}
+		}()
+	}
+
 	hj, ok := w.(http.Hijacker)
 	if !ok {
 		err = errors.New("http.ResponseWriter does not implement http.Hijacker")
@@ -116,16 +187,32 @@ func accept(w http.ResponseWriter, r *http.Request, opts *AcceptOptions) (_ *Con
 	w.Header().Set("Connection", "Upgrade")
 
 	key := r.Header.Get("Sec-WebSocket-Key")
-	w.Header().Set("Sec-WebSocket-Accept", secWebSocketAccept(key))
+	w.Header().Set("Sec-WebSocket-Accept", SecWebSocketAccept(key))
 
 	subproto := selectSubprotocol(r, opts.Subprotocols)
 	if subproto != "" {
 		w.Header().Set("Sec-WebSocket-Protocol", subproto)
 	}
 
-	copts, ok := selectDeflate(websocketExtensions(r.Header), opts.CompressionMode)
+	offered := websocketExtensions(r.Header)
+	var exts []string
+	copts, ok := selectDeflate(offered, opts.CompressionMode)
 	if ok {
-		w.Header().Set("Sec-WebSocket-Extensions", copts.String())
+		exts = append(exts, copts.String())
+	}
+	extTokens, extCodecs := acceptExtensions(offered, opts.Extensions)
+	exts = append(exts, extTokens...)
+	if len(exts) > 0 {
+		w.Header().Set("Sec-WebSocket-Extensions", strings.Join(exts, ", "))
+	}
+
+	if opts.HandshakeTimeout > 0 {
+		if dw, ok := w.(interface {
+			SetWriteDeadline(time.Time) error
+		}); ok {
+			// Hijack clears the deadline after flushing the response.
+			dw.SetWriteDeadline(time.Now().Add(opts.HandshakeTimeout))
+		}
 	}
 
 	w.WriteHeader(http.StatusSwitchingProtocols)
@@ -145,18 +232,36 @@ func accept(w http.ResponseWriter, r *http.Request, opts *AcceptOptions) (_ *Con
 
 	// https://github.com/golang/go/issues/32314
 	b, _ := brw.Reader.Peek(brw.Reader.Buffered())
-	brw.Reader.Reset(io.MultiReader(bytes.NewReader(b), netConn))
+	prefix := bytes.NewReader(b)
+	brw.Reader.Reset(io.MultiReader(prefix, netConn))
 
-	return newConn(connConfig{
+	c := newConn(connConfig{
 		subprotocol:    w.Header().Get("Sec-WebSocket-Protocol"),
+		extensions:     extensionTokens(w.Header()),
+		requestHeader:  r.Header.Clone(),
 		rwc:            netConn,
 		client:         false,
 		copts:          copts,
 		flateThreshold: opts.CompressionThreshold,
-
-		br: brw.Reader,
-		bw: brw.Writer,
-	}), nil
+		flateLevel:     opts.CompressionLevel,
+		extCodecs:      extCodecs,
+		connLimiter:    opts.ConnectionLimiter,
+		shutdownCtx:    opts.ShutdownContext,
+
+		br:       brw.Reader,
+		bw:       brw.Writer,
+		brPrefix: prefix,
+	})
+	for _, intercept := range opts.ConnInterceptors {
+		err = recoverCallback("conn interceptor", func() {
+			intercept(c)
+		})
+		if err != nil {
+			c.writeError(StatusInternalError, err)
+			return nil, err
+		}
+	}
+	return c, nil
 }
 
 func verifyClientRequest(w http.ResponseWriter, r *http.Request) (errCode int, _ error) {
@@ -328,6 +433,16 @@ func websocketExtensions(h http.Header) []websocketExtension {
 	return exts
 }
 
+func extensionTokens(h http.Header) []string {
+	var tokens []string
+	for _, t := range headerTokens(h, "Sec-WebSocket-Extensions") {
+		if t != "" {
+			tokens = append(tokens, t)
+		}
+	}
+	return tokens
+}
+
 func headerTokens(h http.Header, key string) []string {
 	key = textproto.CanonicalMIMEHeaderKey(key)
 	var tokens []string
@@ -343,7 +458,13 @@ func headerTokens(h http.Header, key string) []string {
 
 var keyGUID = []byte("258EAFA5-E914-47DA-95CA-C5AB0DC85B11")
 
-func secWebSocketAccept(secWebSocketKey string) string {
+// SecWebSocketAccept returns the value of the Sec-WebSocket-Accept header
+// for the Sec-WebSocket-Key of a handshake request, i.e. the base64 encoded
+// SHA-1 of the key concatenated with the GUID of RFC 6455.
+// See https://tools.ietf.org/html/rfc6455#section-4.2.2
+//
+// Accept sets the header itself. Use it only to implement a handshake by hand.
+func SecWebSocketAccept(secWebSocketKey string) string {
 	h := sha1.New()
 	h.Write([]byte(secWebSocketKey))
 	h.Write(keyGUID)
@@ -5,15 +5,19 @@ package websocket
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"errors"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"nhooyr.io/websocket/internal/test/assert"
 	"nhooyr.io/websocket/internal/test/xrand"
+	"nhooyr.io/websocket/internal/xsync"
 )
 
 func TestAccept(t *testing.T) {
@@ -45,6 +49,23 @@ func TestAccept(t *testing.T) {
 	})
 
 	// #247
+	t.Run("badCompressionLevel", func(t *testing.T) {
+		t.Parallel()
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Connection", "Upgrade")
+		r.Header.Set("Upgrade", "websocket")
+		r.Header.Set("Sec-WebSocket-Version", "13")
+		r.Header.Set("Sec-WebSocket-Key", xrand.Base64(16))
+
+		_, err := Accept(w, r, &AcceptOptions{
+			CompressionLevel: 10,
+		})
+		assert.Contains(t, err, "invalid compression level 10")
+		assert.Equal(t, "status code", http.StatusInternalServerError, w.Code)
+	})
+
 	t.Run("unauthorizedOriginErrorMessage", func(t *testing.T) {
 		t.Parallel()
 
@@ -289,6 +310,13 @@ func Test_verifyClientHandshake(t *testing.T) {
 	}
 }
 
+func TestSecWebSocketAccept(t *testing.T) {
+	t.Parallel()
+
+	// The example of https://tools.ietf.org/html/rfc6455#section-1.3
+	assert.Equal(t, "accept", "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", SecWebSocketAccept("dGhlIHNhbXBsZSBub25jZQ=="))
+}
+
 func Test_selectSubprotocol(t *testing.T) {
 	t.Parallel()
 
@@ -344,6 +372,48 @@ func Test_selectSubprotocol(t *testing.T) {
 	}
 }
 
+func Test_parseSubprotocol(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name   string
+		raw    string
+		spName string
+		params map[string]string
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name:   "noParams",
+			raw:    "chat",
+			spName: "chat",
+		},
+		{
+			name:   "params",
+			raw:    `chat.v2; level=3;compact; mode="fast lane"`,
+			spName: "chat.v2",
+			params: map[string]string{
+				"level":   "3",
+				"compact": "",
+				"mode":    "fast lane",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			sp := parseSubprotocol(tc.raw)
+			assert.Equal(t, "raw", tc.raw, sp.Raw)
+			assert.Equal(t, "name", tc.spName, sp.Name)
+			assert.Equal(t, "params", tc.params, sp.Params)
+		})
+	}
+}
+
 func Test_authenticateOrigin(t *testing.T) {
 	t.Parallel()
 
@@ -487,6 +557,118 @@ func Test_selectDeflate(t *testing.T) {
 	}
 }
 
+func TestAcceptConnInterceptorPanic(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	cc, sc := net.Pipe()
+	client := newConn(connConfig{
+		rwc:    cc,
+		client: true,
+		br:     bufio.NewReader(cc),
+		bw:     bufio.NewWriter(cc),
+	})
+	defer client.CloseNow()
+	errs := xsync.Go(func() error {
+		_, _, err := client.Read(ctx)
+		return err
+	})
+
+	w := mockHijacker{
+		ResponseWriter: httptest.NewRecorder(),
+		hijack: func() (net.Conn, *bufio.ReadWriter, error) {
+			return sc, bufio.NewReadWriter(bufio.NewReader(sc), bufio.NewWriter(sc)), nil
+		},
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Upgrade", "websocket")
+	r.Header.Set("Sec-WebSocket-Version", "13")
+	r.Header.Set("Sec-WebSocket-Key", xrand.Base64(16))
+
+	_, err := Accept(w, r, &AcceptOptions{
+		ConnInterceptors: []func(*Conn){
+			func(*Conn) {
+				panic("meow")
+			},
+		},
+	})
+	assert.Contains(t, err, "conn interceptor panicked: meow")
+	assert.Equal(t, "close status", StatusInternalError, CloseStatus(<-errs))
+}
+
+func TestAcceptPipelinedFrame(t *testing.T) {
+	t.Parallel()
+
+	// accept returns a Conn whose client sent a masked text frame "meow" in
+	// the same packet as the handshake.
+	accept := func(t *testing.T) *Conn {
+		frame := []byte{0x81, 0x84, 0, 0, 0, 0, 'm', 'e', 'o', 'w'}
+		br := bufio.NewReader(bytes.NewReader(frame))
+		br.Peek(len(frame))
+
+		_, sc := net.Pipe()
+		w := mockHijacker{
+			ResponseWriter: httptest.NewRecorder(),
+			hijack: func() (net.Conn, *bufio.ReadWriter, error) {
+				return sc, bufio.NewReadWriter(br, bufio.NewWriter(sc)), nil
+			},
+		}
+
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Connection", "Upgrade")
+		r.Header.Set("Upgrade", "websocket")
+		r.Header.Set("Sec-WebSocket-Version", "13")
+		r.Header.Set("Sec-WebSocket-Key", xrand.Base64(16))
+
+		c, err := Accept(w, r, nil)
+		assert.Success(t, err)
+		t.Cleanup(func() {
+			c.CloseNow()
+		})
+		return c
+	}
+
+	t.Run("swapTransport", func(t *testing.T) {
+		t.Parallel()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+		defer cancel()
+
+		c := accept(t)
+		cc, _ := net.Pipe()
+		err := c.SwapTransport(cc)
+		assert.Contains(t, err, "unread buffered data")
+
+		_, b, err := c.Read(ctx)
+		assert.Success(t, err)
+		assert.Equal(t, "msg", "meow", string(b))
+	})
+
+	t.Run("recorder", func(t *testing.T) {
+		t.Parallel()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+		defer cancel()
+
+		c := accept(t)
+		var rec bytes.Buffer
+		assert.Success(t, c.SetRecorder(&rec))
+
+		_, b, err := c.Read(ctx)
+		assert.Success(t, err)
+		assert.Equal(t, "msg", "meow", string(b))
+
+		replay := NewReplayConn(&rec, false, CompressionDisabled)
+		defer replay.CloseNow()
+		_, b, err = replay.Read(ctx)
+		assert.Success(t, err)
+		assert.Equal(t, "msg", "meow", string(b))
+	})
+}
+
 type mockHijacker struct {
 	http.ResponseWriter
 	hijack func() (net.Conn, *bufio.ReadWriter, error)
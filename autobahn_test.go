@@ -25,9 +25,9 @@ import (
 )
 
 var excludedAutobahnCases = []string{
-	// We skip the UTF-8 handling tests as there isn't any reason to reject invalid UTF-8, just
-	// more performance overhead.
-	"6.*", "7.5.1",
+	// We skip the invalid UTF-8 close reason test as received close reasons are not
+	// validated, just more performance overhead.
+	"7.5.1",
 
 	// We skip the tests related to requestMaxWindowBits as that is unimplemented due
 	// to limitations in compress/flate. See https://github.com/golang/go/issues/3155
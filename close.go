@@ -9,7 +9,9 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	"nhooyr.io/websocket/internal/errd"
 )
@@ -40,8 +42,8 @@ const (
 	StatusNoStatusRcvd StatusCode = 1005
 
 	// StatusAbnormalClosure is exported for use only with Wasm.
-	// In non Wasm Go, the returned error will indicate whether the
-	// connection was closed abnormally.
+	// In non Wasm Go, the returned error will wrap ErrAbnormalClosure
+	// if the connection was closed abnormally.
 	StatusAbnormalClosure StatusCode = 1006
 
 	StatusInvalidFramePayloadData StatusCode = 1007
@@ -72,6 +74,29 @@ func (ce CloseError) Error() string {
 	return fmt.Sprintf("status = %v and reason = %q", ce.Code, ce.Reason)
 }
 
+// ErrAbnormalClosure is wrapped by the errors returned when the connection
+// is closed without a close handshake, e.g. because the underlying connection
+// was reset or timed out. It corresponds to StatusAbnormalClosure.
+//
+// Use errors.Is to check for it to decide whether to reconnect.
+var ErrAbnormalClosure = errors.New("WebSocket closed abnormally")
+
+type abnormalClosureError struct {
+	err error
+}
+
+func (e abnormalClosureError) Error() string {
+	return fmt.Sprintf("%v: %v", ErrAbnormalClosure, e.err)
+}
+
+func (e abnormalClosureError) Unwrap() error {
+	return e.err
+}
+
+func (e abnormalClosureError) Is(target error) bool {
+	return target == ErrAbnormalClosure
+}
+
 // CloseStatus is a convenience wrapper around Go 1.13's errors.As to grab
 // the status code from a CloseError.
 //
@@ -103,6 +128,15 @@ func (c *Conn) Close(code StatusCode, reason string) error {
 	return c.closeHandshake(code, reason)
 }
 
+// CloseDefault performs the close handshake with StatusNormalClosure and an empty reason.
+// It is intended for use in defer as in defer c.CloseDefault().
+//
+// Like Close, it is bounded by the close handshake's internal timeouts and is a no-op
+// that returns an error if the connection is already closed.
+func (c *Conn) CloseDefault() error {
+	return c.Close(StatusNormalClosure, "")
+}
+
 // CloseNow closes the WebSocket connection without attempting a close handshake.
 // Use when you do not want the overhead of the close handshake.
 func (c *Conn) CloseNow() (err error) {
@@ -117,6 +151,107 @@ func (c *Conn) CloseNow() (err error) {
 	return c.closeErr
 }
 
+// Abort closes the underlying connection immediately without writing
+// anything to it, not even buffered data, and without waiting for the
+// goroutines of the connection to exit. Use it to shed a misbehaving peer
+// with as little work as possible.
+//
+// The connection is closed with an error wrapping ErrAbnormalClosure.
+// Abort is safe to call concurrently and additional calls are no-ops.
+func (c *Conn) Abort() {
+	c.close(abnormalClosureError{errors.New("connection aborted")})
+}
+
+// Wait blocks until the connection is closed and every goroutine it started,
+// e.g. to release its resources or run OnClose callbacks, has exited.
+// Use it after Abort or a failed read or write to know that teardown is
+// complete, e.g. before checking for goroutine leaks in tests.
+//
+// It may be called multiple times and concurrently.
+func (c *Conn) Wait() {
+	<-c.closed
+	c.wg.Wait()
+}
+
+// CloseAfterDrain is like Close but instead of discarding the data messages
+// the peer sends before its close frame, it passes them to handler.
+//
+// It writes the close frame and then reads until the peer's close frame
+// arrives or ctx expires, after which the connection is closed.
+// It returns nil if the peer's close frame was received.
+// If handler panics, the connection is closed without waiting any further.
+func (c *Conn) CloseAfterDrain(ctx context.Context, code StatusCode, reason string, handler func(MessageType, []byte)) (err error) {
+	defer c.wg.Wait()
+	defer errd.Wrap(&err, "failed to close WebSocket")
+	defer c.close(nil)
+
+	err = c.writeClose(code, reason)
+	if err != nil {
+		return err
+	}
+
+	for {
+		typ, p, err := c.Read(ctx)
+		if err != nil {
+			if CloseStatus(err) != -1 {
+				return nil
+			}
+			return err
+		}
+		err = recoverCallback("drain handler", func() {
+			handler(typ, p)
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// CloseWithError is like Close but uses the message of err as the reason.
+//
+// The message is made valid UTF-8 and truncated at a character boundary to fit
+// in the close frame. A nil err sends an empty reason.
+// If ctx expires before the close handshake completes, the connection is closed
+// without waiting any further.
+func (c *Conn) CloseWithError(ctx context.Context, code StatusCode, err error) error {
+	var reason string
+	if err != nil {
+		reason = truncateCloseReason(err.Error())
+	}
+
+	if ctx.Done() != nil {
+		done := make(chan struct{})
+		defer close(done)
+		c.wgAdd()
+		go func() {
+			defer c.wgDone()
+			// Close waits for this goroutine once the connection is closed.
+			select {
+			case <-ctx.Done():
+				c.close(ctx.Err())
+			case <-c.closed:
+			case <-done:
+			}
+		}()
+	}
+
+	return c.Close(code, reason)
+}
+
+// truncateCloseReason makes reason valid UTF-8 and cuts it to maxCloseReason
+// bytes without splitting a character.
+func truncateCloseReason(reason string) string {
+	reason = strings.ToValidUTF8(reason, "\uFFFD")
+	if len(reason) <= maxCloseReason {
+		return reason
+	}
+	reason = reason[:maxCloseReason]
+	for !utf8.ValidString(reason) {
+		reason = reason[:len(reason)-1]
+	}
+	return reason
+}
+
 func (c *Conn) closeHandshake(code StatusCode, reason string) (err error) {
 	defer errd.Wrap(&err, "failed to close WebSocket")
 
@@ -150,11 +285,18 @@ func (c *Conn) writeClose(code StatusCode, reason string) error {
 
 	var p []byte
 	var marshalErr error
-	if ce.Code != StatusNoStatusRcvd {
+	if c.closeEncoder != nil {
+		p, marshalErr = c.encodeClose(ce)
+	} else if ce.Code != StatusNoStatusRcvd {
 		p, marshalErr = ce.bytes()
 	}
 
 	writeErr := c.writeControl(context.Background(), opClose, p)
+	if writeErr == nil {
+		c.closeMu.Lock()
+		c.closeSent = true
+		c.closeMu.Unlock()
+	}
 	if CloseStatus(writeErr) != -1 {
 		// Not a real error if it's due to a close frame being received.
 		writeErr = nil
@@ -207,6 +349,102 @@ func (c *Conn) waitCloseHandshake() error {
 	}
 }
 
+// SetCloseEncoder sets a function to encode the payload of close frames
+// written to the connection, for interoperability with peers that use a
+// non standard close payload.
+// The encoded payload must be at most 125 bytes. Otherwise a close frame with
+// StatusInternalError is written instead.
+//
+// By default, the payload is the 2 byte status code followed by the reason as
+// specified in RFC 6455. Pass nil to restore the default.
+// It must not be called concurrently with Close or Reader.
+func (c *Conn) SetCloseEncoder(fn func(code StatusCode, reason string) []byte) {
+	c.closeEncoder = fn
+}
+
+// SetCloseDecoder sets a function to decode the payload of close frames read
+// from the connection. It is the counterpart of SetCloseEncoder.
+//
+// If it returns an error, the connection is closed with StatusProtocolError.
+// Pass nil to restore the default.
+// It must not be called concurrently with Reader.
+func (c *Conn) SetCloseDecoder(fn func(p []byte) (CloseError, error)) {
+	c.closeDecoder = fn
+}
+
+// CloseEchoPolicy controls the close frame written in response to the close
+// frame of the peer. See Conn.SetCloseEchoPolicy.
+type CloseEchoPolicy int
+
+const (
+	// CloseEchoMirror responds with the status code and reason of the peer.
+	//
+	// This is the default.
+	CloseEchoMirror CloseEchoPolicy = iota
+
+	// CloseEchoNormal always responds with StatusNormalClosure and an empty
+	// reason.
+	CloseEchoNormal
+)
+
+// SetCloseEchoPolicy sets the close frame written in response to a close
+// frame from the peer. It does not affect close frames sent by Close.
+//
+// By default, the status code and reason of the peer are echoed back.
+// It must not be called concurrently with Reader.
+func (c *Conn) SetCloseEchoPolicy(policy CloseEchoPolicy) {
+	c.closeEchoPolicy = policy
+}
+
+// CloseHandshakeCompleted reports whether the close handshake completed, that
+// is a close frame was both sent to and received from the peer. Use it after
+// the connection is closed to tell whether the peer acknowledged the close,
+// e.g. before committing state that depends on a clean shutdown.
+func (c *Conn) CloseHandshakeCompleted() bool {
+	c.closeMu.Lock()
+	defer c.closeMu.Unlock()
+	return c.closeSent && c.rawCloseFrame != nil
+}
+
+// RawCloseFrame returns the raw payload of the close frame received from the
+// peer before it was decoded, e.g. to diagnose peers that send malformed
+// close frames.
+//
+// It returns nil if no close frame has been received.
+func (c *Conn) RawCloseFrame() []byte {
+	c.closeMu.Lock()
+	defer c.closeMu.Unlock()
+	if c.rawCloseFrame == nil {
+		return nil
+	}
+	return append([]byte{}, c.rawCloseFrame...)
+}
+
+func (c *Conn) encodeClose(ce CloseError) ([]byte, error) {
+	var p []byte
+	err := recoverCallback("close encoder", func() {
+		p = c.closeEncoder(ce.Code, ce.Reason)
+	})
+	if err == nil && len(p) > maxControlPayload {
+		err = fmt.Errorf("failed to marshal close frame: encoded payload max is %v but got length %v", maxControlPayload, len(p))
+	}
+	if err != nil {
+		ce = CloseError{
+			Code: StatusInternalError,
+		}
+		p, _ = ce.bytesErr()
+		return p, err
+	}
+	return p, nil
+}
+
+func (c *Conn) decodeClose(p []byte) (CloseError, error) {
+	if c.closeDecoder != nil {
+		return c.closeDecoder(p)
+	}
+	return parseClosePayload(p)
+}
+
 func parseClosePayload(p []byte) (CloseError, error) {
 	if len(p) == 0 {
 		return CloseError{
@@ -262,7 +500,27 @@ func (ce CloseError) bytes() ([]byte, error) {
 
 const maxCloseReason = maxControlPayload - 2
 
+// ValidateCloseReason reports whether reason can be sent in a close frame.
+//
+// It returns an error if reason is longer than 123 bytes or is not valid UTF-8.
+// Use it to check a dynamically constructed reason before calling Close.
+func (c *Conn) ValidateCloseReason(reason string) error {
+	return validateCloseReason(reason)
+}
+
+func validateCloseReason(reason string) error {
+	if len(reason) > maxCloseReason {
+		return fmt.Errorf("reason string max is %v but got %q with length %v", maxCloseReason, reason, len(reason))
+	}
+	if !utf8.ValidString(reason) {
+		return fmt.Errorf("reason string %q is not valid UTF-8", reason)
+	}
+	return nil
+}
+
 func (ce CloseError) bytesErr() ([]byte, error) {
+	// Only the length is checked so that e.g. the reason of the peer can be
+	// mirrored back as is.
 	if len(ce.Reason) > maxCloseReason {
 		return nil, fmt.Errorf("reason string max is %v but got %q with length %v", maxCloseReason, ce.Reason, len(ce.Reason))
 	}
@@ -289,6 +547,14 @@ func (c *Conn) setCloseErrLocked(err error) {
 	}
 }
 
+// IsClosed reports whether the connection has been closed.
+//
+// The connection may be closed right after IsClosed returns false so it is
+// only useful to skip work, not to guarantee that a subsequent call succeeds.
+func (c *Conn) IsClosed() bool {
+	return c.isClosed()
+}
+
 func (c *Conn) isClosed() bool {
 	select {
 	case <-c.closed:
@@ -4,12 +4,18 @@
 package websocket
 
 import (
+	"bufio"
+	"context"
+	"errors"
 	"io"
 	"math"
+	"net"
 	"strings"
 	"testing"
+	"time"
 
 	"nhooyr.io/websocket/internal/test/assert"
+	"nhooyr.io/websocket/internal/xsync"
 )
 
 func TestCloseError(t *testing.T) {
@@ -70,6 +76,124 @@ func TestCloseError(t *testing.T) {
 	})
 }
 
+func Test_validateCloseReason(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name    string
+		reason  string
+		success bool
+	}{
+		{
+			name:    "empty",
+			success: true,
+		},
+		{
+			name:    "max",
+			reason:  strings.Repeat("x", maxCloseReason),
+			success: true,
+		},
+		{
+			name:    "tooLong",
+			reason:  strings.Repeat("x", maxCloseReason+1),
+			success: false,
+		},
+		{
+			name:    "invalidUTF8",
+			reason:  "meow\xc3",
+			success: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			err := validateCloseReason(tc.reason)
+			if tc.success {
+				assert.Success(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestCloseEchoInvalidUTF8(t *testing.T) {
+	t.Parallel()
+
+	ctx, client, server := newRawConnPair(t)
+
+	errs := xsync.Go(func() error {
+		_, _, err := server.Read(ctx)
+		return err
+	})
+
+	// The reason of the peer is mirrored even though it is not valid UTF-8.
+	ce := CloseError{Code: 4000, Reason: "meow\xc3"}
+	p, err := ce.bytesErr()
+	assert.Success(t, err)
+	_, err = client.writeFrame(ctx, true, false, opClose, p)
+	assert.Success(t, err)
+
+	_, _, err = client.Read(ctx)
+	assert.Equal(t, "close error", ce, assertCloseError(t, err))
+	assert.Equal(t, "close error", ce, assertCloseError(t, <-errs))
+}
+
+func assertCloseError(t *testing.T, err error) CloseError {
+	t.Helper()
+	var ce CloseError
+	if !errors.As(err, &ce) {
+		t.Fatalf("expected CloseError: %v", err)
+	}
+	return ce
+}
+
+func Test_truncateCloseReason(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name   string
+		reason string
+		exp    string
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name:   "short",
+			reason: "meow",
+			exp:    "meow",
+		},
+		{
+			name:   "tooLong",
+			reason: strings.Repeat("x", maxCloseReason+1),
+			exp:    strings.Repeat("x", maxCloseReason),
+		},
+		{
+			name:   "splitsRune",
+			reason: strings.Repeat("x", maxCloseReason-1) + "é",
+			exp:    strings.Repeat("x", maxCloseReason-1),
+		},
+		{
+			name:   "invalidUTF8",
+			reason: "meow\xc3",
+			exp:    "meow\uFFFD",
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			assert.Equal(t, "reason", tc.exp, truncateCloseReason(tc.reason))
+		})
+	}
+}
+
 func Test_parseClosePayload(t *testing.T) {
 	t.Parallel()
 
@@ -206,3 +330,86 @@ func TestCloseStatus(t *testing.T) {
 		})
 	}
 }
+
+func TestCloseAfterDrain(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	client, server := newTCPConnPair(t)
+
+	var err error
+	for _, msg := range []string{"a", "b"} {
+		err = client.Write(ctx, MessageText, []byte(msg))
+		assert.Success(t, err)
+	}
+	errs := xsync.Go(func() error {
+		_, _, err := client.Read(ctx)
+		if CloseStatus(err) != StatusGoingAway {
+			return err
+		}
+		return nil
+	})
+
+	var msgs []string
+	err = server.CloseAfterDrain(ctx, StatusGoingAway, "", func(typ MessageType, p []byte) {
+		msgs = append(msgs, string(p))
+	})
+	assert.Success(t, err)
+	assert.Equal(t, "msgs", []string{"a", "b"}, msgs)
+	assert.Success(t, <-errs)
+	assert.Equal(t, "completed", true, server.CloseHandshakeCompleted())
+
+	err = server.CloseAfterDrain(ctx, StatusGoingAway, "", nil)
+	assert.Error(t, err)
+}
+
+func TestCloseAfterDrainPanic(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	client, server := newTCPConnPair(t)
+
+	err := client.Write(ctx, MessageText, []byte("a"))
+	assert.Success(t, err)
+
+	err = server.CloseAfterDrain(ctx, StatusGoingAway, "", func(typ MessageType, p []byte) {
+		panic("meow")
+	})
+	assert.Contains(t, err, "drain handler panicked: meow")
+	assert.Equal(t, "closed", true, server.isClosed())
+}
+
+// newTCPConnPair returns a client and server connected over TCP, which unlike
+// net.Pipe buffers the messages in flight when the close frame is written.
+func newTCPConnPair(t *testing.T) (client, server *Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Success(t, err)
+	defer l.Close()
+	cc, err := net.Dial("tcp", l.Addr().String())
+	assert.Success(t, err)
+	sc, err := l.Accept()
+	assert.Success(t, err)
+
+	client = newConn(connConfig{
+		rwc:    cc,
+		client: true,
+		br:     bufio.NewReader(cc),
+		bw:     bufio.NewWriter(cc),
+	})
+	t.Cleanup(func() {
+		client.CloseNow()
+	})
+	server = newConn(connConfig{
+		rwc: sc,
+		br:  bufio.NewReader(sc),
+		bw:  bufio.NewWriter(sc),
+	})
+	t.Cleanup(func() {
+		server.CloseNow()
+	})
+	return client, server
+}
@@ -4,9 +4,12 @@
 package websocket
 
 import (
+	"bufio"
 	"bytes"
 	"compress/flate"
 	"io"
+	"runtime"
+	"sort"
 	"strings"
 	"testing"
 
@@ -37,6 +40,105 @@ func Test_slidingWindow(t *testing.T) {
 	}
 }
 
+func TestCompressionMemoryEstimate(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name   string
+		client bool
+		copts  *compressionOptions
+		level  int
+		exp    int
+	}{
+		{
+			name: "disabled",
+			exp:  0,
+		},
+		{
+			name:  "contextTakeover",
+			copts: &compressionOptions{},
+			exp:   flateWriterMemory(flate.BestSpeed) + 32768,
+		},
+		{
+			name:  "noContextTakeover",
+			copts: &compressionOptions{clientNoContextTakeover: true, serverNoContextTakeover: true},
+			exp:   0,
+		},
+		{
+			name:   "clientNoContextTakeover",
+			client: true,
+			copts:  &compressionOptions{clientNoContextTakeover: true},
+			level:  flate.BestCompression,
+			exp:    32768,
+		},
+		{
+			name:  "serverNoContextTakeover",
+			copts: &compressionOptions{serverNoContextTakeover: true},
+			level: flate.BestCompression,
+			exp:   32768,
+		},
+		{
+			name:  "clientNoContextTakeoverServer",
+			copts: &compressionOptions{clientNoContextTakeover: true},
+			level: flate.BestCompression,
+			exp:   flateWriterMemory(flate.BestCompression),
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			rw := nopCloserRW{Reader: strings.NewReader(""), Writer: io.Discard}
+			c := newConn(connConfig{
+				rwc:        rw,
+				client:     tc.client,
+				copts:      tc.copts,
+				flateLevel: tc.level,
+				br:         bufio.NewReader(rw),
+				bw:         bufio.NewWriter(rw),
+			})
+			defer c.CloseNow()
+
+			assert.Equal(t, "estimate", tc.exp, c.CompressionMemoryEstimate())
+		})
+	}
+}
+
+// Test_flateWriterMemory checks flateWriterMemory against the heap a
+// flate.Writer of every level retains once written to. It is not parallel so
+// that other tests do not allocate during the measurements and takes the
+// median of a few to ignore the odd outlier.
+func Test_flateWriterMemory(t *testing.T) {
+	p := xrand.Bytes(1 << 16)
+
+	for level := flate.HuffmanOnly; level <= flate.BestCompression; level++ {
+		est := flateWriterMemory(level)
+
+		var retained [5]int
+		for i := range retained {
+			var before, after runtime.MemStats
+			runtime.GC()
+			runtime.ReadMemStats(&before)
+			w, _ := flate.NewWriter(io.Discard, level)
+			w.Write(p)
+			w.Flush()
+			runtime.GC()
+			runtime.ReadMemStats(&after)
+			runtime.KeepAlive(w)
+
+			retained[i] = int(after.HeapAlloc) - int(before.HeapAlloc)
+		}
+		sort.Ints(retained[:])
+		measured := retained[len(retained)/2]
+
+		if measured < est*4/5 || measured > est*5/4 {
+			t.Errorf("level %v: estimated %v bytes but %v bytes are retained", level, est, measured)
+		}
+	}
+}
+
 func BenchmarkFlateWriter(b *testing.B) {
 	b.ReportAllocs()
 	for i := 0; i < b.N; i++ {
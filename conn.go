@@ -5,15 +5,23 @@ package websocket
 
 import (
 	"bufio"
+	"bytes"
+	"compress/flate"
 	"context"
 	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net"
+	"net/http"
 	"runtime"
+	"runtime/debug"
 	"strconv"
 	"sync"
 	"sync/atomic"
+	"time"
+
+	"nhooyr.io/websocket/internal/xsync"
 )
 
 // MessageType represents the type of a WebSocket message.
@@ -46,15 +54,31 @@ type Conn struct {
 	noCopy noCopy
 
 	subprotocol    string
+	extensions     []string
+	requestHeader  http.Header
 	rwc            io.ReadWriteCloser
 	client         bool
 	copts          *compressionOptions
 	flateThreshold int
-	br             *bufio.Reader
-	bw             *bufio.Writer
+	flateLevel     int
+	extCodecs      []ExtensionCodec
+	// handshakeDuration is how long Dial took to complete the handshake.
+	handshakeDuration time.Duration
+	br                *bufio.Reader
+	bw                *bufio.Writer
+	// brPrefix holds the data read with the handshake that br reads
+	// before reading from rwc.
+	brPrefix *bytes.Reader
+	// userBr and userBw are set if br and bw were passed in DialOptions and
+	// so must not be returned to the pools.
+	userBr bool
+	userBw bool
 
 	readTimeout  chan context.Context
 	writeTimeout chan context.Context
+	// assemblyDeadline receives the deadline of the fragmented message being
+	// read or the zero time once it has been read.
+	assemblyDeadline chan time.Time
 
 	// Read state.
 	readMu            *mu
@@ -62,54 +86,151 @@ type Conn struct {
 	readControlBuf    [maxControlPayload]byte
 	msgReader         *msgReader
 	readCloseFrameErr error
+	// readBytes is the total payload length of frames read.
+	readBytes         int64
+	lifetimeReadLimit xsync.Int64
+	prefetch          *prefetcher
+	readPriority      func(typ MessageType, p []byte) int
+	// lastReadCompressed is whether the last message returned was compressed.
+	lastReadCompressed bool
+	// available is the message being read with ReadAvailable.
+	available          *availableReader
+	dropEmptyMessages  atomic.Bool
+	maxReadMessageRate xsync.Int64
+	// nextReadMessage is when the next message may be delivered under
+	// maxReadMessageRate.
+	nextReadMessage time.Time
+	assemblyTimeout xsync.Int64
 
 	// Write state.
-	msgWriter      *msgWriter
-	writeFrameMu   *mu
-	writeBuf       []byte
-	writeHeaderBuf [8]byte
-	writeHeader    header
+	msgWriter    *msgWriter
+	writeFrameMu *mu
+	writeBuf     []byte
+	// writeScratch is used to mask instead of writeBuf when writeBufNoReuse is set.
+	writeScratch    []byte
+	writeBufNoReuse atomic.Bool
+	writeHeaderBuf  [8]byte
+	writeHeader     header
+	writeQueue      *writeQueue
+	// socketWriteObserver is guarded by writeFrameMu.
+	socketWriteObserver func(n int)
+	// noOutgoingTextValidation is set by SetOutgoingTextValidation.
+	noOutgoingTextValidation atomic.Bool
+	// deferFlush is set while WriteAll buffers its messages to flush them once.
+	deferFlush atomic.Bool
+	// pendingWriteBytes is the number of bytes buffered in bw.
+	pendingWriteBytes atomic.Int64
+	// socketWritten is the number of bytes written to rwc by bw and
+	// writeFramePayloadFrom.
+	socketWritten atomic.Int64
 
 	wg         sync.WaitGroup
+	goroutines atomic.Int64
 	closed     chan struct{}
 	closeMu    sync.Mutex
 	closeErr   error
 	wroteClose bool
+	// closeSent is whether the close frame was written successfully.
+	closeSent bool
+	// rawCloseFrame is the payload of the close frame read.
+	rawCloseFrame []byte
+	onClose       []func(closeErr error)
+
+	closeEncoder func(code StatusCode, reason string) []byte
+	closeDecoder func(p []byte) (CloseError, error)
+
+	// closeEchoPolicy is read with readMu held.
+	closeEchoPolicy CloseEchoPolicy
+
+	// connLimiter is released once on close.
+	connLimiter chan struct{}
 
 	pingCounter   int32
 	activePingsMu sync.Mutex
-	activePings   map[string]chan<- struct{}
+	activePings   map[string]chan<- []byte
+	// anyPongs receive the payload of pongs that do not match an active ping.
+	anyPongs map[chan<- []byte]struct{}
 
 	pingCallback func()
+	pingHandler  func(payload []byte) error
+
+	deadPeerMu sync.Mutex
+	// deadPeerStop stops the dead peer detection goroutine.
+	deadPeerStop chan struct{}
+
+	hardDeadlineMu sync.Mutex
+	// hardDeadlineStop stops the hard deadline goroutine.
+	hardDeadlineStop chan struct{}
+
+	maxPingRate xsync.Int64
+	// pingWindow is the start of the second in which pingCount pings were read.
+	pingWindow time.Time
+	pingCount  int64
+
+	writeStallThreshold time.Duration
+	writeStallCallback  func(pending time.Duration)
+
+	writeTimeoutPolicy atomic.Int32
+	timeoutsDisabled   atomic.Bool
+	// compressionPolicy is indexed by MessageType.
+	compressionPolicy [MessageBinary + 1]atomic.Int32
+
+	defaultWriteCtxMu sync.Mutex
+	defaultWriteCtx   *defaultWriteContext
+	// writeAbortable is set while a frame that may be aborted
+	// under TimeoutAbortWrite is being written.
+	writeAbortable atomic.Bool
 }
 
 type connConfig struct {
-	subprotocol    string
-	rwc            io.ReadWriteCloser
-	client         bool
-	copts          *compressionOptions
-	flateThreshold int
+	subprotocol       string
+	extensions        []string
+	requestHeader     http.Header
+	rwc               io.ReadWriteCloser
+	client            bool
+	copts             *compressionOptions
+	flateThreshold    int
+	flateLevel        int
+	extCodecs         []ExtensionCodec
+	connLimiter       chan struct{}
+	handshakeDuration time.Duration
+	shutdownCtx       context.Context
 
-	br *bufio.Reader
-	bw *bufio.Writer
+	br       *bufio.Reader
+	bw       *bufio.Writer
+	brPrefix *bytes.Reader
+	userBr   bool
+	userBw   bool
 }
 
 func newConn(cfg connConfig) *Conn {
 	c := &Conn{
-		subprotocol:    cfg.subprotocol,
-		rwc:            cfg.rwc,
-		client:         cfg.client,
-		copts:          cfg.copts,
-		flateThreshold: cfg.flateThreshold,
+		subprotocol:       cfg.subprotocol,
+		extensions:        cfg.extensions,
+		requestHeader:     cfg.requestHeader,
+		rwc:               cfg.rwc,
+		client:            cfg.client,
+		copts:             cfg.copts,
+		flateThreshold:    cfg.flateThreshold,
+		flateLevel:        cfg.flateLevel,
+		extCodecs:         cfg.extCodecs,
+		handshakeDuration: cfg.handshakeDuration,
+		connLimiter:       cfg.connLimiter,
 
-		br: cfg.br,
-		bw: cfg.bw,
+		br:       cfg.br,
+		brPrefix: cfg.brPrefix,
+		bw:       cfg.bw,
+		userBr:   cfg.userBr,
+		userBw:   cfg.userBw,
 
 		readTimeout:  make(chan context.Context),
 		writeTimeout: make(chan context.Context),
 
+		assemblyDeadline: make(chan time.Time),
+
 		closed:      make(chan struct{}),
-		activePings: make(map[string]chan<- struct{}),
+		activePings: make(map[string]chan<- []byte),
+		anyPongs:    make(map[chan<- []byte]struct{}),
 	}
 
 	c.readMu = newMu(c)
@@ -118,8 +239,11 @@ func newConn(cfg connConfig) *Conn {
 	c.msgReader = newMsgReader(c)
 
 	c.msgWriter = newMsgWriter(c)
+	c.writeQueue = &writeQueue{c: c}
 	if c.client {
-		c.writeBuf = extractBufioWriterBuf(c.bw, c.rwc)
+		c.writeBuf = extractBufioWriterBuf(c.bw, c.socketWriter())
+	} else if c.bw.Buffered() == 0 {
+		c.bw.Reset(c.socketWriter())
 	}
 
 	if c.flate() && c.flateThreshold == 0 {
@@ -128,17 +252,33 @@ func newConn(cfg connConfig) *Conn {
 			c.flateThreshold = 512
 		}
 	}
+	if c.flateLevel == 0 {
+		c.flateLevel = flate.BestSpeed
+	}
 
 	runtime.SetFinalizer(c, func(c *Conn) {
 		c.close(errors.New("connection garbage collected"))
 	})
 
-	c.wg.Add(1)
+	c.wgAdd()
 	go func() {
-		defer c.wg.Done()
+		defer c.wgDone()
 		c.timeoutLoop()
 	}()
 
+	if cfg.shutdownCtx != nil {
+		c.wgAdd()
+		go func() {
+			defer c.wgDone()
+			select {
+			case <-cfg.shutdownCtx.Done():
+				// Not Close as it waits for this goroutine.
+				c.closeHandshake(StatusGoingAway, "")
+			case <-c.closed:
+			}
+		}()
+	}
+
 	return c
 }
 
@@ -148,6 +288,133 @@ func (c *Conn) Subprotocol() string {
 	return c.subprotocol
 }
 
+// String returns a description of the connection for logging, e.g.
+// websocket.Conn(client=true subprotocol="chat" remote=1.2.3.4:5678 closed=false).
+//
+// The remote address is only included when the underlying connection is
+// known, as is the case for connections returned by Accept.
+// It is safe to call concurrently and after the connection is closed.
+func (c *Conn) String() string {
+	c.closeMu.Lock()
+	rwc := c.rwc
+	closed := c.isClosed()
+	c.closeMu.Unlock()
+
+	remote := ""
+	if ra, ok := rwc.(interface{ RemoteAddr() net.Addr }); ok {
+		remote = fmt.Sprintf(" remote=%v", ra.RemoteAddr())
+	}
+	return fmt.Sprintf("websocket.Conn(client=%v subprotocol=%q%v closed=%v)", c.client, c.subprotocol, remote, closed)
+}
+
+// NegotiatedExtensions returns the Sec-WebSocket-Extensions tokens of the
+// handshake response. Each token is an extension with its parameters,
+// e.g. "permessage-deflate; client_no_context_takeover".
+//
+// It is useful to detect when an intermediary injected or stripped extensions.
+func (c *Conn) NegotiatedExtensions() []string {
+	return append([]string(nil), c.extensions...)
+}
+
+// ExtensionHeader returns the negotiated permessage-deflate extension as it
+// would appear in a Sec-WebSocket-Extensions header, e.g.
+// "permessage-deflate; client_no_context_takeover". It is reconstructed from
+// the options in use rather than copied from the handshake, so window bits
+// parameters, which are accepted but do not change how messages are
+// compressed, are omitted.
+//
+// It returns an empty string if compression was not negotiated.
+func (c *Conn) ExtensionHeader() string {
+	if !c.flate() {
+		return ""
+	}
+	return c.copts.String()
+}
+
+// HandshakeRequestHeader returns a copy of the headers of the handshake
+// request for connections returned by Accept, e.g. to read the Origin or
+// cookies for authorization decisions made after the upgrade.
+//
+// It returns nil for client connections.
+func (c *Conn) HandshakeRequestHeader() http.Header {
+	return c.requestHeader.Clone()
+}
+
+// HandshakeDuration returns how long Dial took from its start, including
+// connecting and TLS, to receiving the server's valid handshake response,
+// e.g. to detect slow servers or proxies.
+//
+// It returns 0 for connections returned by Accept.
+func (c *Conn) HandshakeDuration() time.Duration {
+	return c.handshakeDuration
+}
+
+// SwapTransport replaces the underlying connection with rwc, e.g. to migrate
+// the connection or to inject faults in tests. Data buffered from the old
+// connection is discarded and the old connection is not closed.
+//
+// It returns an error if a message is being read or written, or if any data
+// read from or buffered for the old connection has not been consumed, e.g.
+// frames that arrived along with the handshake, as the new connection would
+// then begin in the middle of a frame.
+//
+// This is an advanced feature. Both peers must agree on where the WebSocket
+// stream continues on the new connection.
+func (c *Conn) SwapTransport(rwc io.ReadWriteCloser) error {
+	return c.swapTransport(rwc, false)
+}
+
+// swapTransport is SwapTransport. If prefixCarried is set, rwc reads the
+// data read with the handshake first so it may still be unread.
+func (c *Conn) swapTransport(rwc io.ReadWriteCloser, prefixCarried bool) error {
+	if !c.readMu.tryLock() {
+		return errors.New("failed to swap transport: message is being read")
+	}
+	defer c.readMu.unlock()
+
+	if !c.msgWriter.mu.tryLock() {
+		return errors.New("failed to swap transport: message is being written")
+	}
+	defer c.msgWriter.mu.unlock()
+
+	if !c.writeFrameMu.tryLock() {
+		return errors.New("failed to swap transport: frame is being written")
+	}
+	defer c.writeFrameMu.unlock()
+
+	if !c.msgReader.fin || c.msgReader.payloadLength > 0 || len(c.msgReader.extBuf) > 0 {
+		return errors.New("failed to swap transport: message partially read")
+	}
+	if c.br.Buffered() > 0 || (!prefixCarried && c.brPrefix != nil && c.brPrefix.Len() > 0) {
+		return errors.New("failed to swap transport: unread buffered data")
+	}
+	if c.bw.Buffered() > 0 {
+		return errors.New("failed to swap transport: unflushed buffered data")
+	}
+
+	c.closeMu.Lock()
+	defer c.closeMu.Unlock()
+	if c.isClosed() {
+		return net.ErrClosed
+	}
+
+	c.rwc = rwc
+	c.brPrefix = nil
+	c.br.Reset(rwc)
+	// Reset retains the buffer so writeBuf remains valid.
+	c.bw.Reset(c.socketWriter())
+	return nil
+}
+
+// underlyingNetConn returns the underlying connection if it is a net.Conn.
+// Unlike c.rwc, it is safe to call concurrently with SwapTransport.
+func (c *Conn) underlyingNetConn() (net.Conn, bool) {
+	c.closeMu.Lock()
+	defer c.closeMu.Unlock()
+	nc, ok := c.rwc.(net.Conn)
+	return nc, ok
+}
+
 func (c *Conn) close(err error) {
 	c.closeMu.Lock()
 	defer c.closeMu.Unlock()
@@ -163,23 +430,103 @@ func (c *Conn) close(err error) {
 	close(c.closed)
 	runtime.SetFinalizer(c, nil)
 
+	if c.connLimiter != nil {
+		<-c.connLimiter
+	}
+
 	// Have to close after c.closed is closed to ensure any goroutine that wakes up
 	// from the connection being closed also sees that c.closed is closed and returns
 	// closeErr.
 	c.rwc.Close()
 
-	c.wg.Add(1)
+	c.wgAdd()
 	go func() {
-		defer c.wg.Done()
+		defer c.wgDone()
 		c.msgWriter.close()
 		c.msgReader.close()
 	}()
+
+	if len(c.onClose) > 0 {
+		onClose, closeErr := c.onClose, c.closeErr
+		c.onClose = nil
+		c.wgAdd()
+		go func() {
+			defer c.wgDone()
+			for _, cb := range onClose {
+				cb := cb
+				recoverCallback("close callback", func() {
+					cb(closeErr)
+				})
+			}
+		}()
+	}
+}
+
+// OnClose registers cb to be called once the connection is closed, regardless
+// of who initiated the close, with the error the connection was closed with.
+//
+// Callbacks are called in registration order from a separate goroutine.
+// Close, CloseNow and Wait wait for them to return so cb must not call any of
+// them or it deadlocks.
+// If the connection is already closed, cb is called on a new goroutine.
+// A panic in cb is logged and does not affect the other callbacks.
+func (c *Conn) OnClose(cb func(closeErr error)) {
+	c.closeMu.Lock()
+	defer c.closeMu.Unlock()
+
+	if c.isClosed() {
+		closeErr := c.closeErr
+		c.wgAdd()
+		go func() {
+			defer c.wgDone()
+			recoverCallback("close callback", func() {
+				cb(closeErr)
+			})
+		}()
+		return
+	}
+	c.onClose = append(c.onClose, cb)
+}
+
+// recoverCallback calls the user supplied callback fn, recovering from a
+// panic in it so that the bug only affects this connection. The panic is
+// logged and returned as an error for the caller to close the connection with.
+func recoverCallback(name string, fn func()) (err error) {
+	defer func() {
+		r := recover()
+		if r != nil {
+			err = fmt.Errorf("%v panicked: %v", name, r)
+			log.Printf("websocket: %v\n%s", err, debug.Stack())
+		}
+	}()
+	fn()
+	return nil
+}
+
+// wgAdd must be called before starting a goroutine that c.wg waits on.
+func (c *Conn) wgAdd() {
+	c.goroutines.Add(1)
+	c.wg.Add(1)
+}
+
+// wgDone must be called when a goroutine started after wgAdd exits.
+func (c *Conn) wgDone() {
+	c.goroutines.Add(-1)
+	c.wg.Done()
 }
 
 func (c *Conn) timeoutLoop() {
 	readCtx := context.Background()
 	writeCtx := context.Background()
 
+	var assemblyTimer *time.Timer
+	var assemblyTimeout <-chan time.Time
+	defer func() {
+		if assemblyTimer != nil {
+			assemblyTimer.Stop()
+		}
+	}()
+
 	for {
 		select {
 		case <-c.closed:
@@ -188,20 +535,71 @@ func (c *Conn) timeoutLoop() {
 		case writeCtx = <-c.writeTimeout:
 		case readCtx = <-c.readTimeout:
 
+		case deadline := <-c.assemblyDeadline:
+			if assemblyTimer != nil {
+				assemblyTimer.Stop()
+			}
+			assemblyTimeout = nil
+			if !deadline.IsZero() {
+				assemblyTimer = time.NewTimer(time.Until(deadline))
+				assemblyTimeout = assemblyTimer.C
+			}
+		case <-assemblyTimeout:
+			assemblyTimeout = nil
+			err := errors.New("message assembly timed out")
+			c.setCloseErr(err)
+			c.wgAdd()
+			go func() {
+				defer c.wgDone()
+				c.writeError(StatusPolicyViolation, err)
+			}()
+
 		case <-readCtx.Done():
+			if c.timeoutsDisabled.Load() {
+				readCtx = context.Background()
+				continue
+			}
 			c.setCloseErr(fmt.Errorf("read timed out: %w", readCtx.Err()))
-			c.wg.Add(1)
+			// Only handle the timeout once.
+			readCtx = context.Background()
+			c.wgAdd()
 			go func() {
-				defer c.wg.Done()
+				defer c.wgDone()
 				c.writeError(StatusPolicyViolation, errors.New("read timed out"))
 			}()
 		case <-writeCtx.Done():
+			if c.timeoutsDisabled.Load() {
+				writeCtx = context.Background()
+				continue
+			}
+			if c.writeAbortable.Load() {
+				if nc, ok := c.underlyingNetConn(); ok {
+					// Interrupts the blocked write without closing the connection.
+					nc.SetWriteDeadline(time.Unix(1, 0))
+					writeCtx = context.Background()
+					continue
+				}
+			}
 			c.close(fmt.Errorf("write timed out: %w", writeCtx.Err()))
 			return
 		}
 	}
 }
 
+// SetTimeoutsEnabled sets whether the contexts passed to the methods of the
+// connection interrupt reads and writes that are blocked on the underlying
+// connection or waiting for its locks. With timeouts disabled, an expired
+// context no longer closes the connection and a blocked read or write waits
+// for the peer indefinitely.
+//
+// It is meant for testing only, e.g. for conformance suites that
+// deliberately delay frames. Do not disable timeouts in production.
+//
+// By default, timeouts are enabled.
+func (c *Conn) SetTimeoutsEnabled(enabled bool) {
+	c.timeoutsDisabled.Store(!enabled)
+}
+
 func (c *Conn) flate() bool {
 	return c.copts != nil
 }
@@ -216,50 +614,356 @@ func (c *Conn) flate() bool {
 func (c *Conn) Ping(ctx context.Context) error {
 	p := atomic.AddInt32(&c.pingCounter, 1)
 
-	err := c.ping(ctx, strconv.Itoa(int(p)))
+	_, err := c.ping(ctx, strconv.Itoa(int(p)), false)
 	if err != nil {
 		return fmt.Errorf("failed to ping: %w", err)
 	}
 	return nil
 }
 
-func (c *Conn) ping(ctx context.Context, p string) error {
-	pong := make(chan struct{}, 1)
+// PingEcho sends a ping with the given payload to the peer and waits for a pong.
+// It returns the payload of the pong so that it can be compared against payload.
+//
+// RFC 6455 requires the pong to echo the ping payload but some peers do not.
+// So any pong received that does not match an active ping is also returned.
+//
+// The payload must be at most 125 bytes and should be unique amongst
+// concurrent pings. Like Ping, it must be called concurrently with Reader.
+func (c *Conn) PingEcho(ctx context.Context, payload []byte) ([]byte, error) {
+	if len(payload) > maxControlPayload {
+		return nil, fmt.Errorf("failed to ping: payload max is %v but got length %v", maxControlPayload, len(payload))
+	}
+
+	pong, err := c.ping(ctx, string(payload), true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to ping: %w", err)
+	}
+	return pong, nil
+}
+
+// Healthy sends a ping to the peer and reports whether a pong arrived within
+// timeout. Unlike Ping, the connection is left open if no pong arrives in time
+// so it can be used as a probe before committing to an expensive operation.
+//
+// The connection is also left open if the ping cannot be written in time,
+// e.g. behind a large write, unless the write of the ping itself has to be
+// interrupted on a connection that is not a net.Conn or while frames of an
+// open Writer are buffered. Like Ping, it must be called concurrently with
+// Reader.
+func (c *Conn) Healthy(ctx context.Context, timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	p := atomic.AddInt32(&c.pingCounter, 1)
+	_, err := c.pingNoClose(ctx, strconv.Itoa(int(p)), false)
+	return err == nil
+}
+
+// ping writes a ping with payload p and waits for the matching pong.
+// If anyPong is set, pongs that do not match an active ping are accepted too.
+// The connection is closed if ctx expires first.
+func (c *Conn) ping(ctx context.Context, p string, anyPong bool) ([]byte, error) {
+	b, err := c.pingNoClose(ctx, p, anyPong)
+	if err != nil && ctx.Err() != nil {
+		c.close(err)
+	}
+	return b, err
+}
+
+// pingNoClose is like ping but leaves the connection open if ctx expires
+// while writing the ping or waiting for the pong.
+func (c *Conn) pingNoClose(ctx context.Context, p string, anyPong bool) ([]byte, error) {
+	pong := make(chan []byte, 1)
 
 	c.activePingsMu.Lock()
 	c.activePings[p] = pong
+	if anyPong {
+		c.anyPongs[pong] = struct{}{}
+	}
 	c.activePingsMu.Unlock()
 
 	defer func() {
 		c.activePingsMu.Lock()
 		delete(c.activePings, p)
+		delete(c.anyPongs, pong)
 		c.activePingsMu.Unlock()
 	}()
 
-	err := c.writeControl(ctx, opPing, []byte(p))
+	// Waiting for the ping to be written, e.g. behind a large frame, must
+	// not close the connection either.
+	err := c.writeControlAbortable(ctx, opPing, []byte(p), true)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	select {
 	case <-c.closed:
-		return net.ErrClosed
+		return nil, net.ErrClosed
 	case <-ctx.Done():
-		err := fmt.Errorf("failed to wait for pong: %w", ctx.Err())
-		c.close(err)
-		return err
-	case <-pong:
-		return nil
+		return nil, fmt.Errorf("failed to wait for pong: %w", ctx.Err())
+	case b := <-pong:
+		if b == nil {
+			return []byte(p), nil
+		}
+		return b, nil
+	}
+}
+
+// SetDeadPeerDetection pings the peer every pingInterval and closes the
+// connection once maxMissed consecutive pings went unanswered for
+// pingTimeout. Unlike a timeout on a single Ping, it tolerates the
+// occasional lost pong while still detecting peers that silently went away.
+// A ping that cannot be written within pingTimeout, e.g. behind a large write,
+// counts as missed too.
+//
+// Like Ping, it requires a concurrent Reader call to read the pongs.
+// Calling it again replaces the previous settings.
+//
+// By default, dead peer detection is disabled. Set pingInterval to 0 to disable.
+func (c *Conn) SetDeadPeerDetection(pingInterval, pingTimeout time.Duration, maxMissed int) {
+	c.deadPeerMu.Lock()
+	defer c.deadPeerMu.Unlock()
+
+	if c.deadPeerStop != nil {
+		close(c.deadPeerStop)
+		c.deadPeerStop = nil
+	}
+	if pingInterval <= 0 || pingTimeout <= 0 || maxMissed <= 0 || c.isClosed() {
+		return
+	}
+
+	stop := make(chan struct{})
+	c.deadPeerStop = stop
+	c.wgAdd()
+	go func() {
+		defer c.wgDone()
+		c.detectDeadPeer(stop, pingInterval, pingTimeout, maxMissed)
+	}()
+}
+
+func (c *Conn) detectDeadPeer(stop <-chan struct{}, pingInterval, pingTimeout time.Duration, maxMissed int) {
+	t := time.NewTicker(pingInterval)
+	defer t.Stop()
+
+	missed := 0
+	for {
+		select {
+		case <-stop:
+			return
+		case <-c.closed:
+			return
+		case <-t.C:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+		p := atomic.AddInt32(&c.pingCounter, 1)
+		_, err := c.pingNoClose(ctx, strconv.Itoa(int(p)), false)
+		cancel()
+		if err == nil {
+			missed = 0
+			continue
+		}
+		if ctx.Err() == nil {
+			// The connection failed.
+			return
+		}
+
+		missed++
+		if missed >= maxMissed {
+			c.close(fmt.Errorf("peer missed %v consecutive pings", missed))
+			return
+		}
+	}
+}
+
+// SetHardDeadline closes the connection with StatusGoingAway at t, whether or
+// not it is active, e.g. to limit the length of sessions or to make clients
+// reconnect to rebalance load.
+//
+// Calling it again replaces the previous deadline. A zero t clears it.
+func (c *Conn) SetHardDeadline(t time.Time) {
+	c.hardDeadlineMu.Lock()
+	defer c.hardDeadlineMu.Unlock()
+
+	if c.hardDeadlineStop != nil {
+		close(c.hardDeadlineStop)
+		c.hardDeadlineStop = nil
+	}
+	if t.IsZero() || c.isClosed() {
+		return
+	}
+
+	stop := make(chan struct{})
+	c.hardDeadlineStop = stop
+	c.wgAdd()
+	go func() {
+		defer c.wgDone()
+
+		timer := time.NewTimer(time.Until(t))
+		defer timer.Stop()
+		select {
+		case <-stop:
+		case <-c.closed:
+		case <-timer.C:
+			c.closeHandshake(StatusGoingAway, "connection deadline exceeded")
+		}
+	}()
+}
+
+// Echo reads every message from the connection and writes it back with
+// the same type until an error occurs or the context expires.
+//
+// It is useful for test servers. The returned error wraps the CloseError
+// if the connection was closed with a close frame.
+func (c *Conn) Echo(ctx context.Context) error {
+	b := make([]byte, 32<<10)
+	for {
+		typ, r, err := c.Reader(ctx)
+		if err != nil {
+			return err
+		}
+
+		w, err := c.Writer(ctx, typ)
+		if err != nil {
+			return err
+		}
+
+		_, err = io.CopyBuffer(w, r, b)
+		if err != nil {
+			return err
+		}
+
+		err = w.Close()
+		if err != nil {
+			return err
+		}
 	}
 }
 
 // SetPingCallback sets a callback that is called when a ping is received.
 // The callback is called synchronously from the Reader goroutine and must
-// not block.
+// not block. If it panics, the panic is logged and the connection is closed
+// with StatusInternalError.
 func (c *Conn) SetPingCallback(cb func()) {
 	c.pingCallback = cb
 }
 
+// SetPingHandler sets a function to approve the payload of every ping
+// received, e.g. to check that it carries a session token. If it returns an
+// error, no pong is sent and the connection is closed with
+// StatusPolicyViolation.
+//
+// It is called synchronously from the Reader goroutine after the ping callback
+// and must not block or retain payload. If it panics, the panic is logged and
+// the connection is closed with StatusInternalError. Pass nil to remove it.
+func (c *Conn) SetPingHandler(fn func(payload []byte) error) {
+	c.pingHandler = fn
+}
+
+// SetPingRateLimit sets the max number of pings per second that are responded
+// to with a pong. It protects against a peer flooding the connection with pings.
+//
+// Pings beyond the limit are not responded to. If more than twice the limit is
+// read in a second, the connection is closed with StatusPolicyViolation.
+//
+// By default, there is no limit. Set to 0 to disable.
+func (c *Conn) SetPingRateLimit(maxPerSecond int) {
+	c.maxPingRate.Store(int64(maxPerSecond))
+}
+
+// allowPing reports whether a ping just read should be responded to.
+// It returns an error if the connection has been closed due to a ping flood.
+func (c *Conn) allowPing() (bool, error) {
+	limit := c.maxPingRate.Load()
+	if limit <= 0 {
+		return true, nil
+	}
+
+	now := time.Now()
+	if now.Sub(c.pingWindow) >= time.Second {
+		c.pingWindow = now
+		c.pingCount = 0
+	}
+	c.pingCount++
+
+	if c.pingCount > limit*2 {
+		err := fmt.Errorf("received more than %v pings per second", limit*2)
+		c.writeError(StatusPolicyViolation, err)
+		return false, err
+	}
+	return c.pingCount <= limit, nil
+}
+
+// SetWriteStallCallback sets a callback that is called when a frame write
+// has been blocked for longer than threshold, either waiting for another
+// write to complete or on the underlying connection.
+// It is useful to detect slow or stalled peers.
+//
+// The callback is called at most once per frame from a separate goroutine
+// with how long the write has been blocked. It must not block. If it panics,
+// the panic is logged and the connection is closed.
+//
+// Pass a nil callback to disable.
+func (c *Conn) SetWriteStallCallback(threshold time.Duration, cb func(pending time.Duration)) {
+	c.writeStallThreshold = threshold
+	c.writeStallCallback = cb
+}
+
+// startWriteStallTimer starts a timer that calls the write stall callback once
+// the write stall threshold elapses. The returned function stops the timer.
+func (c *Conn) startWriteStallTimer() func() {
+	cb := c.writeStallCallback
+	if cb == nil {
+		return func() {}
+	}
+
+	start := time.Now()
+	t := time.AfterFunc(c.writeStallThreshold, func() {
+		err := recoverCallback("write stall callback", func() {
+			cb(time.Since(start))
+		})
+		if err != nil {
+			// The write is stalled so no close frame can be written.
+			c.close(err)
+		}
+	})
+	return func() {
+		t.Stop()
+	}
+}
+
+// TimeoutPolicy controls what happens when the context of a write expires.
+type TimeoutPolicy int
+
+// TimeoutPolicy constants.
+const (
+	// TimeoutClose closes the connection when a write times out.
+	TimeoutClose TimeoutPolicy = iota
+	// TimeoutAbortWrite fails only the timed out write and keeps the
+	// connection open so that reads may continue.
+	TimeoutAbortWrite
+)
+
+// SetWriteTimeoutPolicy sets what happens when the context passed to Write
+// expires.
+//
+// By default, TimeoutClose is used and the connection is closed.
+//
+// With TimeoutAbortWrite, Write returns the context error and the connection
+// remains open. This only applies to Write on connections without compression
+// and whose underlying connection is a net.Conn, as the write to the net.Conn is
+// interrupted with a write deadline. Otherwise the connection is still closed.
+// Timeouts of a Writer always close the connection as part of the message has
+// been sent.
+//
+// The connection is closed too if part of the frame was already written to
+// the connection when the write was interrupted, as the stream would be
+// corrupt. So TimeoutAbortWrite mostly helps writes that time out waiting for
+// other writes or for a peer that stopped reading.
+func (c *Conn) SetWriteTimeoutPolicy(policy TimeoutPolicy) {
+	c.writeTimeoutPolicy.Store(int32(policy))
+}
+
 type mu struct {
 	c  *Conn
 	ch chan struct{}
@@ -286,13 +990,26 @@ func (m *mu) tryLock() bool {
 }
 
 func (m *mu) lock(ctx context.Context) error {
+	err := m.lockNoClose(ctx)
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		m.c.close(err)
+	}
+	return err
+}
+
+// lockNoClose is like lock but does not close the connection
+// if the context expires.
+func (m *mu) lockNoClose(ctx context.Context) error {
+	done := ctx.Done()
+	if m.c.timeoutsDisabled.Load() {
+		done = nil
+	}
+
 	select {
 	case <-m.c.closed:
 		return net.ErrClosed
-	case <-ctx.Done():
-		err := fmt.Errorf("failed to acquire lock: %w", ctx.Err())
-		m.c.close(err)
-		return err
+	case <-done:
+		return fmt.Errorf("failed to acquire lock: %w", ctx.Err())
 	case m.ch <- struct{}{}:
 		// To make sure the connection is certainly alive.
 		// As it's possible the send on m.ch was selected
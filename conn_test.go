@@ -4,14 +4,17 @@ package websocket_test
 
 import (
 	"bytes"
+	"compress/flate"
 	"context"
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"os/exec"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -84,6 +87,43 @@ func TestConn(t *testing.T) {
 		assert.Success(t, err)
 	})
 
+	t.Run("pingDuringWriter", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+
+		p := xrand.Bytes(1 << 20)
+		c2.SetReadLimit(int64(len(p)))
+
+		// c1 reads to receive the pong and then c2's close frame.
+		readErr := xsync.Go(func() error {
+			_, _, err := c1.Read(tt.ctx)
+			return assertCloseStatus(websocket.StatusNormalClosure, err)
+		})
+		msgErr := xsync.Go(func() error {
+			_, b, err := c2.Read(tt.ctx)
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(p, b) {
+				return errors.New("unexpected message")
+			}
+			return nil
+		})
+
+		w, err := c1.Writer(tt.ctx, websocket.MessageBinary)
+		assert.Success(t, err)
+		_, err = w.Write(p[:len(p)/2])
+		assert.Success(t, err)
+		// The ping is interleaved between the frames of the unfinished message.
+		assert.Success(t, c1.Ping(tt.ctx))
+		_, err = w.Write(p[len(p)/2:])
+		assert.Success(t, err)
+		assert.Success(t, w.Close())
+		assert.Success(t, <-msgErr)
+
+		assert.Success(t, c2.Close(websocket.StatusNormalClosure, ""))
+		assert.Success(t, <-readErr)
+	})
+
 	t.Run("badPing", func(t *testing.T) {
 		tt, c1, c2 := newConnTest(t, nil, nil)
 
@@ -96,229 +136,1737 @@ func TestConn(t *testing.T) {
 		assert.Contains(t, err, "failed to wait for pong")
 	})
 
-	t.Run("concurrentWrite", func(t *testing.T) {
+	t.Run("concurrentWrite", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+
+		tt.goDiscardLoop(c2)
+
+		msg := xrand.Bytes(xrand.Int(9999))
+		const count = 100
+		errs := make(chan error, count)
+
+		for i := 0; i < count; i++ {
+			go func() {
+				select {
+				case errs <- c1.Write(tt.ctx, websocket.MessageBinary, msg):
+				case <-tt.ctx.Done():
+					return
+				}
+			}()
+		}
+
+		for i := 0; i < count; i++ {
+			select {
+			case err := <-errs:
+				assert.Success(t, err)
+			case <-tt.ctx.Done():
+				t.Fatal(tt.ctx.Err())
+			}
+		}
+
+		err := c1.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
+	})
+
+	t.Run("concurrentWriteError", func(t *testing.T) {
+		tt, c1, _ := newConnTest(t, nil, nil)
+
+		_, err := c1.Writer(tt.ctx, websocket.MessageText)
+		assert.Success(t, err)
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+		defer cancel()
+
+		err = c1.Write(ctx, websocket.MessageText, []byte("x"))
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("unexpected error: %#v", err)
+		}
+	})
+
+	t.Run("netConn", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+
+		n1 := websocket.NetConn(tt.ctx, c1, websocket.MessageBinary)
+		n2 := websocket.NetConn(tt.ctx, c2, websocket.MessageBinary)
+
+		// Does not give any confidence but at least ensures no crashes.
+		d, _ := tt.ctx.Deadline()
+		n1.SetDeadline(d)
+		n1.SetDeadline(time.Time{})
+
+		assert.Equal(t, "remote addr", n1.RemoteAddr(), n1.LocalAddr())
+		assert.Equal(t, "remote addr string", "pipe", n1.RemoteAddr().String())
+		assert.Equal(t, "remote addr network", "pipe", n1.RemoteAddr().Network())
+
+		errs := xsync.Go(func() error {
+			_, err := n2.Write([]byte("hello"))
+			if err != nil {
+				return err
+			}
+			return n2.Close()
+		})
+
+		b, err := io.ReadAll(n1)
+		assert.Success(t, err)
+
+		_, err = n1.Read(nil)
+		assert.Equal(t, "read error", err, io.EOF)
+
+		select {
+		case err := <-errs:
+			assert.Success(t, err)
+		case <-tt.ctx.Done():
+			t.Fatal(tt.ctx.Err())
+		}
+
+		assert.Equal(t, "read msg", []byte("hello"), b)
+	})
+
+	t.Run("netConn/BadMsg", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+
+		n1 := websocket.NetConn(tt.ctx, c1, websocket.MessageBinary)
+		n2 := websocket.NetConn(tt.ctx, c2, websocket.MessageText)
+
+		c2.CloseRead(tt.ctx)
+		errs := xsync.Go(func() error {
+			_, err := n2.Write([]byte("hello"))
+			return err
+		})
+
+		_, err := io.ReadAll(n1)
+		assert.Contains(t, err, `unexpected frame type read (expected MessageBinary): MessageText`)
+
+		select {
+		case err := <-errs:
+			assert.Success(t, err)
+		case <-tt.ctx.Done():
+			t.Fatal(tt.ctx.Err())
+		}
+	})
+
+	t.Run("netConn/readLimit", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+
+		n1 := websocket.NetConn(tt.ctx, c1, websocket.MessageBinary)
+		n2 := websocket.NetConn(tt.ctx, c2, websocket.MessageBinary)
+
+		s := strings.Repeat("papa", 1<<20)
+		errs := xsync.Go(func() error {
+			_, err := n2.Write([]byte(s))
+			if err != nil {
+				return err
+			}
+			return n2.Close()
+		})
+
+		b, err := io.ReadAll(n1)
+		assert.Success(t, err)
+
+		_, err = n1.Read(nil)
+		assert.Equal(t, "read error", err, io.EOF)
+
+		select {
+		case err := <-errs:
+			assert.Success(t, err)
+		case <-tt.ctx.Done():
+			t.Fatal(tt.ctx.Err())
+		}
+
+		assert.Equal(t, "read msg", s, string(b))
+	})
+
+	t.Run("netConn/pastDeadline", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+
+		n1 := websocket.NetConn(tt.ctx, c1, websocket.MessageBinary)
+		n2 := websocket.NetConn(tt.ctx, c2, websocket.MessageBinary)
+
+		n1.SetDeadline(time.Now().Add(-time.Minute))
+		n2.SetDeadline(time.Now().Add(-time.Minute))
+
+		// No panic we're good.
+	})
+
+	t.Run("wsjson", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+
+		tt.goEchoLoop(c2)
+
+		c1.SetReadLimit(1 << 30)
+
+		exp := xrand.String(xrand.Int(131072))
+
+		werr := xsync.Go(func() error {
+			return wsjson.Write(tt.ctx, c1, exp)
+		})
+
+		var act interface{}
+		err := wsjson.Read(tt.ctx, c1, &act)
+		assert.Success(t, err)
+		assert.Equal(t, "read msg", exp, act)
+
+		select {
+		case err := <-werr:
+			assert.Success(t, err)
+		case <-tt.ctx.Done():
+			t.Fatal(tt.ctx.Err())
+		}
+
+		err = c1.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
+	})
+
+	t.Run("dedup", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+
+		// Odd IDs are written as text messages and even IDs as binary ones.
+		idType := func(id uint64) websocket.MessageType {
+			if id%2 == 0 {
+				return websocket.MessageBinary
+			}
+			return websocket.MessageText
+		}
+		ids := []uint64{1, 2, 2, 5, 3, 1, 5, 6, math.MaxUint64}
+		werr := xsync.Go(func() error {
+			for _, id := range ids {
+				err := c1.WriteWithID(tt.ctx, idType(id), []byte(fmt.Sprint(id)), id)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+
+		var d websocket.Deduplicator
+		for _, exp := range []uint64{1, 2, 5, 3, 6, math.MaxUint64} {
+			typ, p, id, err := d.Read(tt.ctx, c2)
+			assert.Success(t, err)
+			assert.Equal(t, "type", idType(exp), typ)
+			assert.Equal(t, "id", exp, id)
+			assert.Equal(t, "msg", fmt.Sprint(exp), string(p))
+		}
+
+		select {
+		case err := <-werr:
+			assert.Success(t, err)
+		case <-tt.ctx.Done():
+			t.Fatal(tt.ctx.Err())
+		}
+
+		c2.CloseRead(tt.ctx)
+		err := c1.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
+	})
+
+	t.Run("proxy", func(t *testing.T) {
+		tt, c1, p1 := newConnTest(t, &websocket.DialOptions{
+			CompressionMode: websocket.CompressionContextTakeover,
+		}, &websocket.AcceptOptions{
+			CompressionMode: websocket.CompressionContextTakeover,
+		})
+		p2, c2 := wstest.Pipe(nil, nil)
+		defer p2.CloseNow()
+		defer c2.CloseNow()
+
+		proxyErr := xsync.Go(func() error {
+			return websocket.Proxy(tt.ctx, p1, p2)
+		})
+
+		msg := xrand.Bytes(1 << 14)
+		writeErr := xsync.Go(func() error {
+			return c1.Write(tt.ctx, websocket.MessageBinary, msg)
+		})
+		typ, p, err := c2.Read(tt.ctx)
+		assert.Success(t, err)
+		assert.Equal(t, "type", websocket.MessageBinary, typ)
+		assert.Equal(t, "msg", msg, p)
+		assert.Success(t, <-writeErr)
+
+		err = c2.Write(tt.ctx, websocket.MessageText, []byte("hello"))
+		assert.Success(t, err)
+		typ, p, err = c1.Read(tt.ctx)
+		assert.Success(t, err)
+		assert.Equal(t, "type", websocket.MessageText, typ)
+		assert.Equal(t, "msg", "hello", string(p))
+
+		readErr := xsync.Go(func() error {
+			_, _, err := c2.Read(tt.ctx)
+			return assertCloseStatus(4000, err)
+		})
+		err = c1.Close(4000, "bye")
+		assert.Success(t, err)
+		assert.Success(t, <-readErr)
+		assert.Success(t, <-proxyErr)
+	})
+
+	t.Run("proxyCompressed", func(t *testing.T) {
+		dialOpts := func() *websocket.DialOptions {
+			return &websocket.DialOptions{
+				CompressionMode: websocket.CompressionNoContextTakeover,
+			}
+		}
+		acceptOpts := func() *websocket.AcceptOptions {
+			return &websocket.AcceptOptions{
+				CompressionMode: websocket.CompressionNoContextTakeover,
+			}
+		}
+		tt, c1, p1 := newConnTest(t, dialOpts(), acceptOpts())
+		p2, c2 := wstest.Pipe(dialOpts(), acceptOpts())
+		defer p2.CloseNow()
+		defer c2.CloseNow()
+		// The large message is still written in several frames once compressed.
+		p1.SetReadLimit(1 << 20)
+		c2.SetReadLimit(1 << 20)
+
+		proxyErr := xsync.Go(func() error {
+			return websocket.Proxy(tt.ctx, p1, p2)
+		})
+
+		// A message below the compression threshold is only still compressed
+		// once proxied if it is forwarded as is.
+		c1.SetCompressionForType(websocket.MessageText, websocket.CompressionAlways)
+		for _, msg := range []string{"hello", xrand.Base64(1 << 16)} {
+			msg := msg
+			writeErr := xsync.Go(func() error {
+				return c1.Write(tt.ctx, websocket.MessageText, []byte(msg))
+			})
+			typ, p, err := c2.Read(tt.ctx)
+			assert.Success(t, err)
+			assert.Equal(t, "type", websocket.MessageText, typ)
+			assert.Equal(t, "msg", msg, string(p))
+			assert.Equal(t, "compressed", true, c2.LastReadCompressed())
+			assert.Success(t, <-writeErr)
+		}
+
+		readErr := xsync.Go(func() error {
+			_, _, err := c2.Read(tt.ctx)
+			return assertCloseStatus(websocket.StatusNormalClosure, err)
+		})
+		err := c1.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
+		assert.Success(t, <-readErr)
+		assert.Success(t, <-proxyErr)
+	})
+
+	t.Run("delta", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+
+		states := [][]byte{
+			[]byte("hello world"),
+			[]byte("hello there world"),
+			[]byte("hello there world"),
+			[]byte("hi"),
+			[]byte(""),
+			[]byte("goodbye world"),
+		}
+		werr := xsync.Go(func() error {
+			var base []byte
+			for _, state := range states {
+				err := c1.WriteDelta(tt.ctx, base, state)
+				if err != nil {
+					return err
+				}
+				base = state
+			}
+			return nil
+		})
+
+		var base []byte
+		for _, exp := range states {
+			typ, p, err := c2.Read(tt.ctx)
+			assert.Success(t, err)
+			assert.Equal(t, "type", websocket.MessageBinary, typ)
+			base, err = websocket.ApplyDelta(base, p)
+			assert.Success(t, err)
+			assert.Equal(t, "state", string(exp), string(base))
+		}
+		assert.Success(t, <-werr)
+
+		_, err := websocket.ApplyDelta([]byte("meow"), []byte{1, 3, 3})
+		assert.Contains(t, err, "exceed base")
+
+		c2.CloseRead(tt.ctx)
+		err = c1.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
+	})
+
+	t.Run("writeAll", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+
+		msgs := []websocket.Message{
+			{Type: websocket.MessageText, Data: []byte("1")},
+			{Type: websocket.MessageBinary, Data: []byte("2")},
+			{Type: websocket.MessageText, Data: []byte("3")},
+		}
+		allErr := xsync.Go(func() error {
+			return c1.WriteAll(tt.ctx, msgs)
+		})
+		otherErr := xsync.Go(func() error {
+			return c1.Write(tt.ctx, websocket.MessageText, []byte("other"))
+		})
+
+		var got string
+		for i := 0; i < 4; i++ {
+			_, p, err := c2.Read(tt.ctx)
+			assert.Success(t, err)
+			got += string(p)
+		}
+		if got != "123other" && got != "other123" {
+			t.Fatalf("messages interleaved: %q", got)
+		}
+		assert.Success(t, <-allErr)
+		assert.Success(t, <-otherErr)
+
+		readErr := xsync.Go(func() error {
+			_, _, err := c2.Read(tt.ctx)
+			return assertCloseStatus(websocket.StatusNormalClosure, err)
+		})
+		err := c1.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
+		assert.Success(t, <-readErr)
+	})
+
+	t.Run("writePrepared", func(t *testing.T) {
+		t.Parallel()
+
+		modes := []websocket.CompressionMode{
+			websocket.CompressionDisabled,
+			websocket.CompressionContextTakeover,
+			websocket.CompressionNoContextTakeover,
+		}
+		for _, mode := range modes {
+			mode := mode
+			t.Run(fmt.Sprint(mode), func(t *testing.T) {
+				t.Parallel()
+
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+				defer cancel()
+
+				copts := &websocket.DialOptions{
+					CompressionMode: mode,
+				}
+				client, server := wstest.Pipe(copts, &websocket.AcceptOptions{
+					CompressionMode: mode,
+				})
+				defer client.CloseNow()
+				defer server.CloseNow()
+
+				msg := []byte(strings.Repeat("prepared ", 128))
+				for _, compress := range []bool{false, true} {
+					pm, err := websocket.PrepareMessage(websocket.MessageText, msg, compress)
+					assert.Success(t, err)
+
+					err = client.WritePrepared(ctx, pm)
+					assert.Contains(t, err, "cannot be written by client connections")
+
+					for i := 0; i < 3; i++ {
+						werr := xsync.Go(func() error {
+							return server.WritePrepared(ctx, pm)
+						})
+
+						typ, p, err := client.Read(ctx)
+						assert.Success(t, err)
+						assert.Equal(t, "type", websocket.MessageText, typ)
+						assert.Equal(t, "msg", msg, p)
+						assert.Success(t, <-werr)
+						assert.Equal(t, "pending", 0, server.PendingWriteBytes())
+
+						// The compression context must not be disturbed for regular writes.
+						werr = xsync.Go(func() error {
+							return server.Write(ctx, websocket.MessageText, msg)
+						})
+						_, p, err = client.Read(ctx)
+						assert.Success(t, err)
+						assert.Equal(t, "msg", msg, p)
+						assert.Success(t, <-werr)
+					}
+				}
+			})
+		}
+	})
+
+	t.Run("writePreparedInvalid", func(t *testing.T) {
+		t.Parallel()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+		defer cancel()
+
+		client, server := wstest.Pipe(nil, nil)
+		defer client.CloseNow()
+		defer server.CloseNow()
+
+		_, err := websocket.PrepareMessage(websocket.MessageType(9), []byte("meow"), false)
+		assert.Contains(t, err, "unexpected message type")
+
+		err = server.WritePrepared(ctx, &websocket.PreparedMessage{})
+		assert.Contains(t, err, "not prepared with PrepareMessage")
+
+		pm, err := websocket.PrepareMessage(websocket.MessageText, []byte("meow\xff"), false)
+		assert.Success(t, err)
+		err = server.WritePrepared(ctx, pm)
+		assert.Contains(t, err, "not valid UTF-8")
+		assert.Equal(t, "closed", false, server.IsClosed())
+	})
+
+	t.Run("maxFragments", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+
+		c2.SetMaxFragments(3)
+
+		werr := xsync.Go(func() error {
+			w, err := c1.Writer(tt.ctx, websocket.MessageBinary)
+			if err != nil {
+				return err
+			}
+			// Three data frames and then the fin frame.
+			for i := 0; i < 3; i++ {
+				_, err = w.Write([]byte("x"))
+				if err != nil {
+					return err
+				}
+			}
+			err = w.Close()
+			if err != nil {
+				return err
+			}
+			_, _, err = c1.Read(tt.ctx)
+			return assertCloseStatus(websocket.StatusPolicyViolation, err)
+		})
+
+		_, _, err := c2.Read(tt.ctx)
+		assert.Contains(t, err, "message fragmented into more than 3 frames")
+
+		select {
+		case err := <-werr:
+			assert.Success(t, err)
+		case <-tt.ctx.Done():
+			t.Fatal(tt.ctx.Err())
+		}
+	})
+
+	t.Run("lifetimeReadLimit", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+
+		c2.SetLifetimeReadLimit(10)
+
+		werr := xsync.Go(func() error {
+			for i := 0; i < 3; i++ {
+				err := c1.Write(tt.ctx, websocket.MessageBinary, []byte("meow"))
+				if err != nil {
+					return err
+				}
+			}
+			_, _, err := c1.Read(tt.ctx)
+			return assertCloseStatus(websocket.StatusPolicyViolation, err)
+		})
+
+		for i := 0; i < 2; i++ {
+			_, _, err := c2.Read(tt.ctx)
+			assert.Success(t, err)
+		}
+		_, _, err := c2.Read(tt.ctx)
+		assert.Contains(t, err, "read lifetime limited at 10 bytes")
+		assert.Success(t, <-werr)
+	})
+
+	t.Run("writeStallCallback", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+
+		stalled := make(chan time.Duration, 1)
+		c1.SetWriteStallCallback(time.Millisecond*10, func(pending time.Duration) {
+			select {
+			case stalled <- pending:
+			default:
+			}
+		})
+
+		// c2 is not reading so the write blocks.
+		werr := xsync.Go(func() error {
+			return c1.Write(tt.ctx, websocket.MessageText, []byte("hello"))
+		})
+
+		select {
+		case pending := <-stalled:
+			if pending < time.Millisecond*10 {
+				t.Fatalf("unexpected pending duration: %v", pending)
+			}
+		case <-tt.ctx.Done():
+			t.Fatal(tt.ctx.Err())
+		}
+
+		_, _, err := c2.Read(tt.ctx)
+		assert.Success(t, err)
+		assert.Success(t, <-werr)
+	})
+
+	t.Run("writerIdleFlush", func(t *testing.T) {
+		copts := websocket.CompressionMode(xrand.Int(int(websocket.CompressionContextTakeover) + 1))
+		tt, c1, c2 := newConnTest(t, &websocket.DialOptions{
+			CompressionMode:      copts,
+			CompressionThreshold: 1,
+		}, &websocket.AcceptOptions{
+			CompressionMode:      copts,
+			CompressionThreshold: 1,
+		})
+
+		c1.SetWriterIdleFlush(time.Millisecond * 10)
+
+		w, err := c1.Writer(tt.ctx, websocket.MessageText)
+		assert.Success(t, err)
+
+		werr := xsync.Go(func() error {
+			_, err := w.Write([]byte("hello"))
+			return err
+		})
+
+		_, r, err := c2.Reader(tt.ctx)
+		assert.Success(t, err)
+
+		b := make([]byte, 5)
+		_, err = io.ReadFull(r, b)
+		assert.Success(t, err)
+		assert.Equal(t, "partial msg", "hello", string(b))
+		assert.Success(t, <-werr)
+
+		werr = xsync.Go(w.Close)
+		_, err = io.ReadAll(r)
+		assert.Success(t, err)
+		assert.Success(t, <-werr)
+	})
+
+	t.Run("negotiatedExtensions", func(t *testing.T) {
+		_, c1, c2 := newConnTest(t, &websocket.DialOptions{
+			CompressionMode: websocket.CompressionNoContextTakeover,
+		}, &websocket.AcceptOptions{
+			CompressionMode: websocket.CompressionNoContextTakeover,
+		})
+
+		exp := []string{"permessage-deflate; client_no_context_takeover; server_no_context_takeover"}
+		assert.Equal(t, "extensions", exp, c1.NegotiatedExtensions())
+		assert.Equal(t, "extensions", exp, c2.NegotiatedExtensions())
+		assert.Equal(t, "extension header", exp[0], c1.ExtensionHeader())
+		assert.Equal(t, "extension header", exp[0], c2.ExtensionHeader())
+	})
+
+	t.Run("ExtensionHeader", func(t *testing.T) {
+		_, c1, c2 := newConnTest(t, nil, nil)
+
+		assert.Equal(t, "extension header", "", c1.ExtensionHeader())
+		assert.Equal(t, "extension header", "", c2.ExtensionHeader())
+	})
+
+	t.Run("WriteWithStats", func(t *testing.T) {
+		t.Parallel()
+
+		t.Run("compressed", func(t *testing.T) {
+			tt, c1, c2 := newConnTest(t, &websocket.DialOptions{
+				CompressionMode: websocket.CompressionContextTakeover,
+			}, &websocket.AcceptOptions{
+				CompressionMode: websocket.CompressionContextTakeover,
+			})
+
+			p := []byte(strings.Repeat("meow", 256))
+			errs := xsync.Go(func() error {
+				_, b, err := c2.Read(tt.ctx)
+				if err != nil {
+					return err
+				}
+				if !bytes.Equal(p, b) {
+					return errors.New("unexpected message")
+				}
+				return nil
+			})
+
+			res, err := c1.WriteWithStats(tt.ctx, websocket.MessageText, p)
+			assert.Success(t, err)
+			assert.Success(t, <-errs)
+			assert.Equal(t, "size", len(p), res.Size)
+			assert.Equal(t, "compressed", true, res.Compressed)
+			if res.WireSize <= 0 || res.WireSize >= res.Size {
+				t.Fatalf("unexpected wire size: %v", res.WireSize)
+			}
+		})
+
+		t.Run("uncompressed", func(t *testing.T) {
+			tt, c1, c2 := newConnTest(t, nil, nil)
+
+			errs := xsync.Go(func() error {
+				_, _, err := c2.Read(tt.ctx)
+				return err
+			})
+
+			res, err := c1.WriteWithStats(tt.ctx, websocket.MessageBinary, []byte("meow"))
+			assert.Success(t, err)
+			assert.Success(t, <-errs)
+			assert.Equal(t, "result", websocket.WriteResult{Size: 4, WireSize: 4}, res)
+		})
+	})
+
+	t.Run("LastReadCompressed", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, &websocket.DialOptions{
+			CompressionMode:      websocket.CompressionContextTakeover,
+			CompressionThreshold: 64,
+		}, &websocket.AcceptOptions{
+			CompressionMode:      websocket.CompressionContextTakeover,
+			CompressionThreshold: 64,
+		})
+
+		errs := xsync.Go(func() error {
+			err := c1.Write(tt.ctx, websocket.MessageText, []byte(strings.Repeat("meow", 64)))
+			if err != nil {
+				return err
+			}
+			return c1.Write(tt.ctx, websocket.MessageText, []byte("meow"))
+		})
+
+		assert.Equal(t, "compressed", false, c2.LastReadCompressed())
+		_, _, err := c2.Read(tt.ctx)
+		assert.Success(t, err)
+		assert.Equal(t, "compressed", true, c2.LastReadCompressed())
+		_, _, err = c2.Read(tt.ctx)
+		assert.Success(t, err)
+		assert.Equal(t, "compressed", false, c2.LastReadCompressed())
+		assert.Success(t, <-errs)
+	})
+
+	t.Run("compressionLevel", func(t *testing.T) {
+		for _, level := range []int{flate.HuffmanOnly, flate.BestCompression} {
+			level := level
+			t.Run(strconv.Itoa(level), func(t *testing.T) {
+				tt, c1, c2 := newConnTest(t, &websocket.DialOptions{
+					CompressionMode:  websocket.CompressionContextTakeover,
+					CompressionLevel: level,
+				}, &websocket.AcceptOptions{
+					CompressionMode:  websocket.CompressionContextTakeover,
+					CompressionLevel: level,
+				})
+
+				p := strings.Repeat("meow", 1024)
+				errs := xsync.Go(func() error {
+					return c1.Write(tt.ctx, websocket.MessageText, []byte(p))
+				})
+				_, b, err := c2.Read(tt.ctx)
+				assert.Success(t, err)
+				assert.Success(t, <-errs)
+				assert.Equal(t, "msg", p, string(b))
+				assert.Equal(t, "compressed", true, c2.LastReadCompressed())
+			})
+		}
+	})
+
+	t.Run("WriterFlush", func(t *testing.T) {
+		for _, mode := range []websocket.CompressionMode{websocket.CompressionDisabled, websocket.CompressionContextTakeover} {
+			mode := mode
+			t.Run(fmt.Sprint(mode), func(t *testing.T) {
+				tt, c1, c2 := newConnTest(t, &websocket.DialOptions{
+					CompressionMode: mode,
+				}, &websocket.AcceptOptions{
+					CompressionMode: mode,
+				})
+
+				p := strings.Repeat("meow", 256)
+				flushed := make(chan struct{})
+				errs := xsync.Go(func() error {
+					w, err := c1.Writer(tt.ctx, websocket.MessageText)
+					if err != nil {
+						return err
+					}
+					_, err = w.Write([]byte(p))
+					if err != nil {
+						return err
+					}
+					err = w.(interface{ Flush() error }).Flush()
+					if err != nil {
+						return err
+					}
+					<-flushed
+					_, err = w.Write([]byte(p))
+					if err != nil {
+						return err
+					}
+					return w.Close()
+				})
+
+				_, r, err := c2.Reader(tt.ctx)
+				assert.Success(t, err)
+				b := make([]byte, len(p))
+				_, err = io.ReadFull(r, b)
+				assert.Success(t, err)
+				assert.Equal(t, "flushed", p, string(b))
+				close(flushed)
+
+				b, err = io.ReadAll(r)
+				assert.Success(t, err)
+				assert.Equal(t, "rest", p, string(b))
+				assert.Success(t, <-errs)
+			})
+		}
+	})
+
+	t.Run("ConnInterceptors", func(t *testing.T) {
+		var calls []string
+		var intercepted *websocket.Conn
+		_, c1, c2 := newConnTest(t, nil, &websocket.AcceptOptions{
+			ConnInterceptors: []func(*websocket.Conn){
+				func(c *websocket.Conn) {
+					calls = append(calls, "first")
+					intercepted = c
+				},
+				func(c *websocket.Conn) {
+					calls = append(calls, "second")
+				},
+			},
+		})
+
+		server := c1
+		if c2.HandshakeRequestHeader() != nil {
+			server = c2
+		}
+		assert.Equal(t, "calls", []string{"first", "second"}, calls)
+		assert.Equal(t, "conn", true, intercepted == server)
+	})
+
+	t.Run("NDJSONReader", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+
+		errs := xsync.Go(func() error {
+			w, err := c1.Writer(tt.ctx, websocket.MessageBinary)
+			if err != nil {
+				return err
+			}
+			for i := 0; i < 3; i++ {
+				_, err = fmt.Fprintf(w, "{\"n\": %d}\n\n", i)
+				if err != nil {
+					return err
+				}
+			}
+			return w.Close()
+		})
+
+		it, err := wsjson.NDJSONReader(tt.ctx, c2)
+		assert.Success(t, err)
+		for i := 0; i < 3; i++ {
+			var v struct{ N int }
+			assert.Success(t, it.Next(&v))
+			assert.Equal(t, "n", i, v.N)
+		}
+		var v struct{}
+		assert.Equal(t, "err", io.EOF, it.Next(&v))
+		assert.Success(t, <-errs)
+	})
+
+	t.Run("customExtensionHugeFrame", func(t *testing.T) {
+		t.Parallel()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+		defer cancel()
+
+		client, server := wstest.Pipe(&websocket.DialOptions{
+			Extensions: []websocket.Extension{xorExtension{}},
+		}, &websocket.AcceptOptions{
+			Extensions: []websocket.Extension{xorExtension{}},
+		})
+		defer client.CloseNow()
+		defer server.CloseNow()
+		client.SetReadLimit(-1)
+
+		errs := xsync.Go(func() error {
+			// A binary frame with rsv2 set announcing a payload of 2^62 bytes.
+			err := server.UnsafeWriteRaw(ctx, []byte{0xa2, 127, 0x40, 0, 0, 0, 0, 0, 0, 0})
+			if err != nil {
+				return err
+			}
+			_, _, err = server.Read(ctx)
+			return assertCloseStatus(websocket.StatusMessageTooBig, err)
+		})
+
+		_, _, err := client.Read(ctx)
+		assert.Contains(t, err, "exceeds the maximum")
+		assert.Success(t, <-errs)
+	})
+
+	t.Run("customExtension", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, &websocket.DialOptions{
+			CompressionMode: websocket.CompressionContextTakeover,
+			Extensions:      []websocket.Extension{xorExtension{}},
+		}, &websocket.AcceptOptions{
+			CompressionMode: websocket.CompressionContextTakeover,
+			Extensions:      []websocket.Extension{xorExtension{}},
+		})
+		assert.Equal(t, "extensions", []string{"permessage-deflate", "x-xor; key=42"}, c1.NegotiatedExtensions())
+
+		p := strings.Repeat("meow", 1024)
+		errs := xsync.Go(func() error {
+			return c1.Write(tt.ctx, websocket.MessageText, []byte(p))
+		})
+		_, b, err := c2.Read(tt.ctx)
+		assert.Success(t, err)
+		assert.Success(t, <-errs)
+		assert.Equal(t, "msg", p, string(b))
+		assert.Equal(t, "compressed", true, c2.LastReadCompressed())
+
+		// Every Write of an uncompressed Writer is its own frame.
+		errs = xsync.Go(func() error {
+			w, err := c2.Writer(tt.ctx, websocket.MessageBinary)
+			if err != nil {
+				return err
+			}
+			_, err = w.Write([]byte("hi"))
+			if err != nil {
+				return err
+			}
+			_, err = w.Write([]byte(" there"))
+			if err != nil {
+				return err
+			}
+			return w.Close()
+		})
+		_, b, err = c1.Read(tt.ctx)
+		assert.Success(t, err)
+		assert.Success(t, <-errs)
+		assert.Equal(t, "msg", "hi there", string(b))
+	})
+
+	t.Run("SetCompressionForType", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, &websocket.DialOptions{
+			CompressionMode: websocket.CompressionContextTakeover,
+		}, &websocket.AcceptOptions{
+			CompressionMode: websocket.CompressionContextTakeover,
+		})
+		c1.SetCompressionForType(websocket.MessageText, websocket.CompressionAlways)
+		c1.SetCompressionForType(websocket.MessageBinary, websocket.CompressionNever)
+
+		big := strings.Repeat("meow", 1024)
+		msgs := []struct {
+			typ        websocket.MessageType
+			p          string
+			compressed bool
+		}{
+			{websocket.MessageText, "meow", true},
+			{websocket.MessageBinary, big, false},
+			{websocket.MessageText, big, true},
+			{websocket.MessageBinary, big, false},
+		}
+
+		errs := xsync.Go(func() error {
+			for _, m := range msgs {
+				err := c1.Write(tt.ctx, m.typ, []byte(m.p))
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+
+		for _, m := range msgs {
+			typ, b, err := c2.Read(tt.ctx)
+			assert.Success(t, err)
+			assert.Equal(t, "type", m.typ, typ)
+			assert.Equal(t, "msg", m.p, string(b))
+			assert.Equal(t, "compressed", m.compressed, c2.LastReadCompressed())
+		}
+		assert.Success(t, <-errs)
+	})
+
+	t.Run("ExtendReadDeadline", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+
+		// c2 is not reading so ctx bounds the idle connection.
+		ctx, cancel := context.WithTimeout(tt.ctx, time.Millisecond*50)
+		defer cancel()
+		err := c2.ExtendReadDeadline(ctx)
+		assert.Success(t, err)
+
+		_, _, err = c1.Read(tt.ctx)
+		assert.Equal(t, "close status", websocket.StatusPolicyViolation, websocket.CloseStatus(err))
+		assert.Contains(t, err, "read timed out")
+	})
+
+	t.Run("WriteDefault", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+
+		werr := xsync.Go(func() error {
+			return c1.WriteDefault(websocket.MessageText, []byte("meow"))
+		})
+		_, b, err := c2.Read(tt.ctx)
+		assert.Success(t, err)
+		assert.Equal(t, "msg", "meow", string(b))
+		assert.Success(t, <-werr)
+
+		ctx, cancel := context.WithCancel(tt.ctx)
+		cancel()
+		c1.SetDefaultWriteContext(ctx)
+		err = c1.WriteDefault(websocket.MessageText, []byte("meow"))
+		assert.ErrorIs(t, context.Canceled, err)
+	})
+
+	t.Run("WriteDefaultInProgress", func(t *testing.T) {
+		tt, c1, _ := newConnTest(t, nil, nil)
+
+		c1.SetDefaultWriteContext(tt.ctx)
+		goroutines := c1.ActiveGoroutines()
+		// Nothing reads from c2 so the write blocks.
+		werr := xsync.Go(func() error {
+			return c1.WriteDefault(websocket.MessageBinary, xrand.Bytes(1<<16))
+		})
+		time.Sleep(time.Millisecond * 10)
+		// WriteDefault shares the context of the default between writes.
+		assert.Equal(t, "goroutines", goroutines, c1.ActiveGoroutines())
+
+		ctx, cancel := context.WithTimeout(tt.ctx, time.Millisecond*10)
+		defer cancel()
+		c1.SetDefaultWriteContext(ctx)
+		select {
+		case err := <-werr:
+			assert.ErrorIs(t, context.DeadlineExceeded, err)
+		case <-tt.ctx.Done():
+			t.Fatal(tt.ctx.Err())
+		}
+		c1.Wait()
+		assert.Equal(t, "goroutines", int64(0), c1.ActiveGoroutines())
+	})
+
+	t.Run("ReadSeq", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+
+		c2.SetPrefetch(xrand.Bool())
+
+		werr := xsync.Go(func() error {
+			for i := 0; i < 3; i++ {
+				err := c1.Write(tt.ctx, websocket.MessageBinary, []byte{byte(i)})
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+
+		for i := 0; i < 3; i++ {
+			seq, _, p, err := c2.ReadSeq(tt.ctx)
+			assert.Success(t, err)
+			assert.Equal(t, "seq", uint64(i+1), seq)
+			assert.Equal(t, "msg", []byte{byte(i)}, p)
+		}
+		assert.Success(t, <-werr)
+	})
+
+	t.Run("prefetch", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+
+		c2.SetPrefetch(true)
+
+		werr := xsync.Go(func() error {
+			return c1.Write(tt.ctx, websocket.MessageText, []byte("first"))
+		})
+		_, b, err := c2.Read(tt.ctx)
+		assert.Success(t, err)
+		assert.Equal(t, "msg", "first", string(b))
+		assert.Success(t, <-werr)
+
+		// The write completes without a Read as the message is prefetched.
+		err = c1.Write(tt.ctx, websocket.MessageText, []byte("second"))
+		assert.Success(t, err)
+
+		typ, r, err := c2.Reader(tt.ctx)
+		assert.Success(t, err)
+		assert.Equal(t, "type", websocket.MessageText, typ)
+		b, err = io.ReadAll(r)
+		assert.Success(t, err)
+		assert.Equal(t, "msg", "second", string(b))
+
+		werr = xsync.Go(func() error {
+			return c1.Close(websocket.StatusNormalClosure, "")
+		})
+		_, _, err = c2.Read(tt.ctx)
+		assert.Equal(t, "close status", websocket.StatusNormalClosure, websocket.CloseStatus(err))
+		assert.Success(t, <-werr)
+	})
+
+	t.Run("ReadMessage", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+
+		before := time.Now()
+		werr := xsync.Go(func() error {
+			return c1.Write(tt.ctx, websocket.MessageBinary, []byte("meow"))
+		})
+
+		m, err := c2.ReadMessage(tt.ctx)
+		assert.Success(t, err)
+		assert.Success(t, <-werr)
+		assert.Equal(t, "type", websocket.MessageBinary, m.Type)
+		assert.Equal(t, "data", "meow", string(m.Data))
+		if m.ReceivedAt.Before(before) || m.ReceivedAt.After(time.Now()) {
+			t.Fatalf("unexpected ReceivedAt: %v", m.ReceivedAt)
+		}
+	})
+
+	t.Run("String", func(t *testing.T) {
+		_, c1, c2 := newConnTest(t, &websocket.DialOptions{
+			Subprotocols: []string{"chat"},
+		}, &websocket.AcceptOptions{
+			Subprotocols: []string{"chat"},
+		})
+
+		client, server := c1, c2
+		if strings.Contains(server.String(), "client=true") {
+			client, server = server, client
+		}
+		assert.Contains(t, client.String(), `websocket.Conn(client=true subprotocol="chat"`)
+		assert.Contains(t, server.String(), `websocket.Conn(client=false subprotocol="chat" remote=pipe closed=false)`)
+
+		client.CloseNow()
+		assert.Contains(t, client.String(), "closed=true)")
+	})
+
+	t.Run("shutdownContext", func(t *testing.T) {
+		shutdownCtx, shutdown := context.WithCancel(context.Background())
+		defer shutdown()
+		tt, c1, c2 := newConnTest(t, nil, &websocket.AcceptOptions{
+			ShutdownContext: shutdownCtx,
+		})
+
+		client := c1
+		if c1.HandshakeRequestHeader() != nil {
+			client = c2
+		}
+
+		errs := xsync.Go(func() error {
+			_, _, err := client.Read(tt.ctx)
+			return err
+		})
+		shutdown()
+		assert.Equal(t, "close status", websocket.StatusGoingAway, websocket.CloseStatus(<-errs))
+	})
+
+	t.Run("handshakeRequestHeader", func(t *testing.T) {
+		h := http.Header{}
+		h.Set("X-Meow", "woof")
+		_, c1, c2 := newConnTest(t, &websocket.DialOptions{
+			HTTPHeader: h,
+		}, nil)
+
+		server, client := c1.HandshakeRequestHeader(), c2.HandshakeRequestHeader()
+		if server == nil {
+			server, client = client, server
+		}
+		assert.Equal(t, "client header", http.Header(nil), client)
+		assert.Equal(t, "X-Meow", "woof", server.Get("X-Meow"))
+		assert.Equal(t, "Upgrade", "websocket", server.Get("Upgrade"))
+	})
+
+	t.Run("textValidation", func(t *testing.T) {
+		t.Parallel()
+
+		writeFragments := func(ctx context.Context, c *websocket.Conn, typ websocket.MessageType, frags ...string) error {
+			w, err := c.Writer(ctx, typ)
+			if err != nil {
+				return err
+			}
+			for _, f := range frags {
+				_, err = w.Write([]byte(f))
+				if err != nil {
+					return err
+				}
+			}
+			return w.Close()
+		}
+
+		t.Run("splitRune", func(t *testing.T) {
+			tt, c1, c2 := newConnTest(t, nil, nil)
+
+			werr := xsync.Go(func() error {
+				return writeFragments(tt.ctx, c1, websocket.MessageText, "price: \xe2", "\x82", "\xac10")
+			})
+
+			_, b, err := c2.Read(tt.ctx)
+			assert.Success(t, err)
+			assert.Equal(t, "msg", "price: €10", string(b))
+			assert.Success(t, <-werr)
+		})
+
+		t.Run("invalid", func(t *testing.T) {
+			tt, c1, c2 := newConnTest(t, nil, nil)
+			c1.SetOutgoingTextValidation(false)
+
+			werr := xsync.Go(func() error {
+				err := writeFragments(tt.ctx, c1, websocket.MessageText, "meow \xe2\x82", "x")
+				if err != nil {
+					return err
+				}
+				_, _, err = c1.Read(tt.ctx)
+				return assertCloseStatus(websocket.StatusInvalidFramePayloadData, err)
+			})
+
+			_, _, err := c2.Read(tt.ctx)
+			assert.Contains(t, err, "received invalid UTF-8 in text message")
+			assert.Success(t, <-werr)
+		})
+
+		t.Run("truncated", func(t *testing.T) {
+			tt, c1, c2 := newConnTest(t, nil, nil)
+			c1.SetOutgoingTextValidation(false)
+
+			werr := xsync.Go(func() error {
+				err := writeFragments(tt.ctx, c1, websocket.MessageText, "meow \xe2", "\x82")
+				if err != nil {
+					return err
+				}
+				_, _, err = c1.Read(tt.ctx)
+				return assertCloseStatus(websocket.StatusInvalidFramePayloadData, err)
+			})
+
+			_, _, err := c2.Read(tt.ctx)
+			assert.Contains(t, err, "received invalid UTF-8 in text message")
+			assert.Success(t, <-werr)
+		})
+
+		t.Run("disabled", func(t *testing.T) {
+			tt, c1, c2 := newConnTest(t, nil, nil)
+
+			c1.SetOutgoingTextValidation(false)
+			c2.SetTextValidation(false)
+
+			werr := xsync.Go(func() error {
+				return writeFragments(tt.ctx, c1, websocket.MessageText, "meow \xff")
+			})
+
+			_, b, err := c2.Read(tt.ctx)
+			assert.Success(t, err)
+			assert.Equal(t, "msg", "meow \xff", string(b))
+			assert.Success(t, <-werr)
+		})
+
+		t.Run("binary", func(t *testing.T) {
+			tt, c1, c2 := newConnTest(t, nil, nil)
+
+			werr := xsync.Go(func() error {
+				return writeFragments(tt.ctx, c1, websocket.MessageBinary, "\xff")
+			})
+
+			_, b, err := c2.Read(tt.ctx)
+			assert.Success(t, err)
+			assert.Equal(t, "msg", "\xff", string(b))
+			assert.Success(t, <-werr)
+		})
+	})
+
+	t.Run("connectionLimiter", func(t *testing.T) {
+		t.Parallel()
+
+		sem := make(chan struct{}, 2)
+		acceptOpts := &websocket.AcceptOptions{
+			ConnectionLimiter: sem,
+		}
+
+		c1, c2 := wstest.Pipe(nil, acceptOpts)
+		defer c1.CloseNow()
+		c3, c4 := wstest.Pipe(nil, acceptOpts)
+		defer c3.CloseNow()
+		defer c4.CloseNow()
+
+		c5, c6 := wstest.Pipe(nil, acceptOpts)
+		if c5 != nil || c6 != nil {
+			t.Fatal("expected connection to be rejected")
+		}
+
+		err := c2.CloseNow()
+		assert.Success(t, err)
+		err = c2.CloseNow()
+		assert.ErrorIs(t, websocket.ErrClosed, err)
+
+		c5, c6 = wstest.Pipe(nil, acceptOpts)
+		if c5 == nil || c6 == nil {
+			t.Fatal("expected connection to be accepted")
+		}
+		c5.CloseNow()
+		c6.CloseNow()
+		assert.Equal(t, "connections", 1, len(sem))
+	})
+
+	t.Run("handshakeTimeout", func(t *testing.T) {
+		t.Parallel()
+
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			err := echoServer(w, r, &websocket.AcceptOptions{
+				HandshakeTimeout: time.Millisecond * 50,
+			})
+			assert.Success(t, err)
+		}))
+		defer s.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+		defer cancel()
+
+		c, _, err := websocket.Dial(ctx, s.URL, nil)
+		assert.Success(t, err)
+
+		// The handshake deadline must not apply to the connection.
+		time.Sleep(time.Millisecond * 100)
+
+		assertEcho(t, ctx, c)
+		assertClose(t, c)
+	})
+
+	t.Run("HTTPClient.Timeout", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, &websocket.DialOptions{
+			HTTPClient: &http.Client{Timeout: time.Second * 5},
+		}, nil)
+
+		tt.goEchoLoop(c2)
+
+		c1.SetReadLimit(1 << 30)
+
+		exp := xrand.String(xrand.Int(131072))
+
+		werr := xsync.Go(func() error {
+			return wsjson.Write(tt.ctx, c1, exp)
+		})
+
+		var act interface{}
+		err := wsjson.Read(tt.ctx, c1, &act)
+		assert.Success(t, err)
+		assert.Equal(t, "read msg", exp, act)
+
+		select {
+		case err := <-werr:
+			assert.Success(t, err)
+		case <-tt.ctx.Done():
+			t.Fatal(tt.ctx.Err())
+		}
+
+		err = c1.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
+	})
+
+	t.Run("CloseNow", func(t *testing.T) {
+		_, c1, c2 := newConnTest(t, nil, nil)
+
+		err1 := c1.CloseNow()
+		err2 := c2.CloseNow()
+		assert.Success(t, err1)
+		assert.Success(t, err2)
+		err1 = c1.CloseNow()
+		err2 = c2.CloseNow()
+		assert.ErrorIs(t, websocket.ErrClosed, err1)
+		assert.ErrorIs(t, websocket.ErrClosed, err2)
+		assert.Equal(t, "goroutines", int64(0), c1.ActiveGoroutines())
+		assert.Equal(t, "goroutines", int64(0), c2.ActiveGoroutines())
+	})
+
+	t.Run("Multiplexer", func(t *testing.T) {
 		tt, c1, c2 := newConnTest(t, nil, nil)
 
-		tt.goDiscardLoop(c2)
+		m1 := websocket.NewMultiplexer(c1)
+		m2 := websocket.NewMultiplexer(c2)
 
-		msg := xrand.Bytes(xrand.Int(9999))
-		const count = 100
-		errs := make(chan error, count)
+		// Larger than the receive window of a stream.
+		big := xrand.Bytes(1 << 20)
+		errs := xsync.Go(func() error {
+			s, err := m2.AcceptStream(tt.ctx)
+			if err != nil {
+				return err
+			}
+			b := make([]byte, len(big))
+			_, err = io.ReadFull(s, b)
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(big, b) {
+				return errors.New("unexpected stream data")
+			}
+			_, err = s.Write([]byte("done"))
+			if err != nil {
+				return err
+			}
+			_, err = s.Read(b)
+			if !errors.Is(err, io.EOF) {
+				return fmt.Errorf("expected EOF: %w", err)
+			}
+			return s.Close()
+		})
 
-		for i := 0; i < count; i++ {
-			go func() {
-				select {
-				case errs <- c1.Write(tt.ctx, websocket.MessageBinary, msg):
-				case <-tt.ctx.Done():
-					return
-				}
-			}()
+		s1, err := m1.OpenStream(tt.ctx)
+		assert.Success(t, err)
+		s2, err := m1.OpenStream(tt.ctx)
+		assert.Success(t, err)
+		if s1.ID() == s2.ID() {
+			t.Fatalf("duplicate stream ID %v", s1.ID())
 		}
 
-		for i := 0; i < count; i++ {
-			select {
-			case err := <-errs:
-				assert.Success(t, err)
-			case <-tt.ctx.Done():
-				t.Fatal(tt.ctx.Err())
-			}
-		}
+		_, err = s1.Write(big)
+		assert.Success(t, err)
+		b := make([]byte, 4)
+		_, err = io.ReadFull(s1, b)
+		assert.Success(t, err)
+		assert.Equal(t, "msg", "done", string(b))
+		assert.Success(t, s1.Close())
+		assert.Success(t, <-errs)
 
-		err := c1.Close(websocket.StatusNormalClosure, "")
+		// The second stream is unaffected by the first closing.
+		peer, err := m2.AcceptStream(tt.ctx)
+		assert.Success(t, err)
+		assert.Equal(t, "stream ID", s2.ID(), peer.ID())
+		_, err = s2.Write([]byte("meow"))
 		assert.Success(t, err)
+		_, err = io.ReadFull(peer, b)
+		assert.Success(t, err)
+		assert.Equal(t, "msg", "meow", string(b))
+
+		assert.Success(t, m1.Close())
+		_, err = peer.Read(b)
+		assert.Error(t, err)
+		_, err = m2.AcceptStream(tt.ctx)
+		assert.Error(t, err)
+
+		// The read loop of the multiplexer is done once Close returns.
+		assert.Equal(t, "goroutines", int64(0), c1.ActiveGoroutines())
 	})
 
-	t.Run("concurrentWriteError", func(t *testing.T) {
-		tt, c1, _ := newConnTest(t, nil, nil)
+	t.Run("IsClosed", func(t *testing.T) {
+		_, c1, _ := newConnTest(t, nil, nil)
 
-		_, err := c1.Writer(tt.ctx, websocket.MessageText)
-		assert.Success(t, err)
+		assert.Equal(t, "closed", false, c1.IsClosed())
+		c1.CloseNow()
+		assert.Equal(t, "closed", true, c1.IsClosed())
+	})
 
-		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
-		defer cancel()
+	t.Run("SetDeadPeerDetection", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
 
-		err = c1.Write(ctx, websocket.MessageText, []byte("x"))
-		if !errors.Is(err, context.DeadlineExceeded) {
-			t.Fatalf("unexpected error: %#v", err)
+		c2.CloseRead(tt.ctx)
+		c1.CloseRead(tt.ctx)
+		c1.SetDeadPeerDetection(time.Millisecond*10, time.Second, 2)
+
+		time.Sleep(time.Millisecond * 100)
+		assert.Equal(t, "closed", false, c1.IsClosed())
+		c1.SetDeadPeerDetection(0, 0, 0)
+	})
+
+	t.Run("SetDeadPeerDetectionDeadPeer", func(t *testing.T) {
+		tt, c1, _ := newConnTest(t, nil, nil)
+
+		// The peer never reads and so never responds to the pings.
+		ctx := c1.CloseRead(tt.ctx)
+		c1.SetDeadPeerDetection(time.Millisecond*10, time.Millisecond*10, 3)
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second * 5):
+			t.Fatal("dead peer not detected")
 		}
+		assert.Equal(t, "closed", true, c1.IsClosed())
 	})
 
-	t.Run("netConn", func(t *testing.T) {
+	t.Run("Abort", func(t *testing.T) {
 		tt, c1, c2 := newConnTest(t, nil, nil)
 
-		n1 := websocket.NetConn(tt.ctx, c1, websocket.MessageBinary)
-		n2 := websocket.NetConn(tt.ctx, c2, websocket.MessageBinary)
+		closeErr := make(chan error, 1)
+		c1.OnClose(func(err error) {
+			closeErr <- err
+		})
+		c1.Abort()
+		c1.Abort()
 
-		// Does not give any confidence but at least ensures no crashes.
-		d, _ := tt.ctx.Deadline()
-		n1.SetDeadline(d)
-		n1.SetDeadline(time.Time{})
+		assert.ErrorIs(t, websocket.ErrAbnormalClosure, <-closeErr)
+		assert.Equal(t, "closed", true, c1.IsClosed())
 
-		assert.Equal(t, "remote addr", n1.RemoteAddr(), n1.LocalAddr())
-		assert.Equal(t, "remote addr string", "pipe", n1.RemoteAddr().String())
-		assert.Equal(t, "remote addr network", "pipe", n1.RemoteAddr().Network())
+		_, _, err := c2.Read(tt.ctx)
+		assert.Equal(t, "close status", websocket.StatusCode(-1), websocket.CloseStatus(err))
+	})
 
-		errs := xsync.Go(func() error {
-			_, err := n2.Write([]byte("hello"))
-			if err != nil {
-				return err
+	t.Run("CloseWithError", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+
+		reasonErr := xsync.Go(func() error {
+			_, _, err := c2.Read(tt.ctx)
+			var ce websocket.CloseError
+			if !errors.As(err, &ce) {
+				return fmt.Errorf("expected websocket.CloseError: %T %v", err, err)
 			}
-			return n2.Close()
+			if ce.Code != websocket.StatusInternalError || len(ce.Reason) != 123 {
+				return fmt.Errorf("unexpected close error: %v", ce)
+			}
+			return nil
 		})
 
-		b, err := io.ReadAll(n1)
+		err := c1.CloseWithError(tt.ctx, websocket.StatusInternalError, errors.New(strings.Repeat("x", 200)))
 		assert.Success(t, err)
+		assert.Success(t, <-reasonErr)
+		assert.Equal(t, "goroutines", int64(0), c1.ActiveGoroutines())
+	})
 
-		_, err = n1.Read(nil)
-		assert.Equal(t, "read error", err, io.EOF)
-
-		select {
-		case err := <-errs:
-			assert.Success(t, err)
-		case <-tt.ctx.Done():
-			t.Fatal(tt.ctx.Err())
-		}
+	t.Run("Wait", func(t *testing.T) {
+		_, c1, _ := newConnTest(t, nil, nil)
 
-		assert.Equal(t, "read msg", []byte("hello"), b)
+		c1.OnClose(func(err error) {
+			time.Sleep(time.Millisecond * 10)
+		})
+		c1.Abort()
+		c1.Wait()
+		assert.Equal(t, "goroutines", int64(0), c1.ActiveGoroutines())
+		c1.Wait()
 	})
 
-	t.Run("netConn/BadMsg", func(t *testing.T) {
+	t.Run("hardDeadline", func(t *testing.T) {
 		tt, c1, c2 := newConnTest(t, nil, nil)
 
-		n1 := websocket.NetConn(tt.ctx, c1, websocket.MessageBinary)
-		n2 := websocket.NetConn(tt.ctx, c2, websocket.MessageText)
-
-		c2.CloseRead(tt.ctx)
-		errs := xsync.Go(func() error {
-			_, err := n2.Write([]byte("hello"))
-			return err
-		})
-
-		_, err := io.ReadAll(n1)
-		assert.Contains(t, err, `unexpected frame type read (expected MessageBinary): MessageText`)
+		c1.SetHardDeadline(time.Now().Add(time.Hour))
+		c1.SetHardDeadline(time.Now().Add(time.Millisecond * 50))
 
-		select {
-		case err := <-errs:
-			assert.Success(t, err)
-		case <-tt.ctx.Done():
-			t.Fatal(tt.ctx.Err())
+		_, _, err := c2.Read(tt.ctx)
+		var ce websocket.CloseError
+		if !errors.As(err, &ce) {
+			t.Fatalf("expected CloseError: %v", err)
 		}
+		assert.Equal(t, "close error", websocket.CloseError{
+			Code:   websocket.StatusGoingAway,
+			Reason: "connection deadline exceeded",
+		}, ce)
+		c1.Wait()
+		assert.Equal(t, "goroutines", int64(0), c1.ActiveGoroutines())
 	})
 
-	t.Run("netConn/readLimit", func(t *testing.T) {
-		tt, c1, c2 := newConnTest(t, nil, nil)
+	t.Run("maxDecompressionRatio", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, &websocket.DialOptions{
+			CompressionMode: websocket.CompressionNoContextTakeover,
+		}, &websocket.AcceptOptions{
+			CompressionMode: websocket.CompressionNoContextTakeover,
+		})
 
-		n1 := websocket.NetConn(tt.ctx, c1, websocket.MessageBinary)
-		n2 := websocket.NetConn(tt.ctx, c2, websocket.MessageBinary)
+		c2.SetReadLimit(1 << 24)
+		c2.SetMaxDecompressionRatio(100)
 
-		s := strings.Repeat("papa", 1<<20)
-		errs := xsync.Go(func() error {
-			_, err := n2.Write([]byte(s))
+		// c1 reads concurrently to receive the close frame while the rest
+		// of the message is still being written.
+		readErr := xsync.Go(func() error {
+			_, _, err := c1.Read(tt.ctx)
+			return assertCloseStatus(websocket.StatusMessageTooBig, err)
+		})
+		werr := xsync.Go(func() error {
+			err := c1.Write(tt.ctx, websocket.MessageBinary, xrand.Bytes(1<<17))
 			if err != nil {
 				return err
 			}
-			return n2.Close()
+			c1.Write(tt.ctx, websocket.MessageBinary, make([]byte, 1<<23))
+			return nil
 		})
 
-		b, err := io.ReadAll(n1)
+		_, p, err := c2.Read(tt.ctx)
 		assert.Success(t, err)
+		assert.Equal(t, "len", 1<<17, len(p))
 
-		_, err = n1.Read(nil)
-		assert.Equal(t, "read error", err, io.EOF)
+		_, _, err = c2.Read(tt.ctx)
+		assert.Contains(t, err, "times its compressed size")
+		assert.Success(t, <-readErr)
+		assert.Success(t, <-werr)
+	})
 
-		select {
-		case err := <-errs:
-			assert.Success(t, err)
-		case <-tt.ctx.Done():
-			t.Fatal(tt.ctx.Err())
+	t.Run("HandshakeDuration", func(t *testing.T) {
+		_, c1, c2 := newConnTest(t, nil, nil)
+
+		client, server := c1, c2
+		if client.HandshakeRequestHeader() != nil {
+			client, server = c2, c1
 		}
+		assert.Equal(t, "client", true, client.HandshakeDuration() > 0)
+		assert.Equal(t, "server", time.Duration(0), server.HandshakeDuration())
+	})
 
-		assert.Equal(t, "read msg", s, string(b))
+	t.Run("pingCallbackPanic", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+
+		c2.SetPingCallback(func() {
+			panic("meow")
+		})
+
+		errs1 := xsync.Go(func() error {
+			_, _, err := c1.Read(tt.ctx)
+			return assertCloseStatus(websocket.StatusInternalError, err)
+		})
+		errs2 := xsync.Go(func() error {
+			_, _, err := c2.Read(tt.ctx)
+			return err
+		})
+		err := c1.Ping(tt.ctx)
+		assert.Error(t, err)
+
+		assert.Contains(t, <-errs2, "ping callback panicked: meow")
+		assert.Success(t, <-errs1)
+		assert.Equal(t, "closed", true, c2.IsClosed())
+
+		// The panic only affects the connection it happened on.
+		c3, c4 := wstest.Pipe(nil, nil)
+		defer c3.CloseNow()
+		defer c4.CloseNow()
+		c4.SetPingCallback(func() {})
+
+		errs4 := xsync.Go(func() error {
+			_, _, err := c4.Read(tt.ctx)
+			return assertCloseStatus(websocket.StatusNormalClosure, err)
+		})
+		c3.CloseRead(tt.ctx)
+		assert.Success(t, c3.Ping(tt.ctx))
+		assert.Success(t, c3.Close(websocket.StatusNormalClosure, ""))
+		assert.Success(t, <-errs4)
 	})
 
-	t.Run("netConn/pastDeadline", func(t *testing.T) {
+	t.Run("closeCodecPanic", func(t *testing.T) {
 		tt, c1, c2 := newConnTest(t, nil, nil)
 
-		n1 := websocket.NetConn(tt.ctx, c1, websocket.MessageBinary)
-		n2 := websocket.NetConn(tt.ctx, c2, websocket.MessageBinary)
+		c1.SetCloseEncoder(func(code websocket.StatusCode, reason string) []byte {
+			panic("meow")
+		})
+		errs := xsync.Go(func() error {
+			_, _, err := c2.Read(tt.ctx)
+			return assertCloseStatus(websocket.StatusInternalError, err)
+		})
+		err := c1.Close(websocket.StatusNormalClosure, "")
+		assert.Contains(t, err, "close encoder panicked: meow")
+		assert.Success(t, <-errs)
 
-		n1.SetDeadline(time.Now().Add(-time.Minute))
-		n2.SetDeadline(time.Now().Add(-time.Minute))
+		c3, c4 := wstest.Pipe(nil, nil)
+		defer c3.CloseNow()
+		defer c4.CloseNow()
 
-		// No panic we're good.
+		c4.SetCloseDecoder(func(p []byte) (websocket.CloseError, error) {
+			panic("meow")
+		})
+		errs = xsync.Go(func() error {
+			_, _, err := c3.Read(tt.ctx)
+			return assertCloseStatus(websocket.StatusInternalError, err)
+		})
+		errs4 := xsync.Go(func() error {
+			_, _, err := c4.Read(tt.ctx)
+			return err
+		})
+		c3.Close(websocket.StatusNormalClosure, "")
+		assert.Contains(t, <-errs4, "close decoder panicked: meow")
+		assert.Success(t, <-errs)
 	})
 
-	t.Run("wsjson", func(t *testing.T) {
+	t.Run("CloseHandshakeCompleted", func(t *testing.T) {
 		tt, c1, c2 := newConnTest(t, nil, nil)
 
-		tt.goEchoLoop(c2)
+		ctx := c2.CloseRead(tt.ctx)
 
-		c1.SetReadLimit(1 << 30)
+		assert.Equal(t, "completed", false, c1.CloseHandshakeCompleted())
+		err := c1.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
+		assert.Equal(t, "completed", true, c1.CloseHandshakeCompleted())
 
-		exp := xrand.String(xrand.Int(131072))
+		<-ctx.Done()
+		assert.Equal(t, "completed", true, c2.CloseHandshakeCompleted())
+	})
 
-		werr := xsync.Go(func() error {
-			return wsjson.Write(tt.ctx, c1, exp)
-		})
+	t.Run("CloseNowHandshake", func(t *testing.T) {
+		_, c1, _ := newConnTest(t, nil, nil)
 
-		var act interface{}
-		err := wsjson.Read(tt.ctx, c1, &act)
+		err := c1.CloseNow()
 		assert.Success(t, err)
-		assert.Equal(t, "read msg", exp, act)
+		assert.Equal(t, "completed", false, c1.CloseHandshakeCompleted())
+	})
 
-		select {
-		case err := <-werr:
-			assert.Success(t, err)
-		case <-tt.ctx.Done():
-			t.Fatal(tt.ctx.Err())
-		}
+	t.Run("CloseDefault", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
 
-		err = c1.Close(websocket.StatusNormalClosure, "")
+		c2.CloseRead(tt.ctx)
+
+		err := c1.CloseDefault()
 		assert.Success(t, err)
+		assert.Equal(t, "goroutines", int64(0), c1.ActiveGoroutines())
+		err = c1.CloseDefault()
+		assert.ErrorIs(t, websocket.ErrClosed, err)
 	})
 
-	t.Run("HTTPClient.Timeout", func(t *testing.T) {
-		tt, c1, c2 := newConnTest(t, &websocket.DialOptions{
-			HTTPClient: &http.Client{Timeout: time.Second * 5},
-		}, nil)
+	t.Run("OnClose", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
 
-		tt.goEchoLoop(c2)
+		c2.CloseRead(tt.ctx)
 
-		c1.SetReadLimit(1 << 30)
+		var calls []int
+		var errs []error
+		for i := 0; i < 2; i++ {
+			i := i
+			c1.OnClose(func(closeErr error) {
+				calls = append(calls, i)
+				errs = append(errs, closeErr)
+			})
+		}
 
-		exp := xrand.String(xrand.Int(131072))
+		err := c1.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
+		assert.Equal(t, "calls", []int{0, 1}, calls)
+		assert.Equal(t, "close status", websocket.StatusNormalClosure, websocket.CloseStatus(errs[0]))
+		assert.Equal(t, "close errors", errs[0], errs[1])
+
+		// Wait also waits for callbacks registered after the close.
+		var late error
+		c1.OnClose(func(closeErr error) {
+			time.Sleep(time.Millisecond * 10)
+			late = closeErr
+		})
+		c1.Wait()
+		assert.Equal(t, "close error", errs[0], late)
+		assert.Equal(t, "goroutines", int64(0), c1.ActiveGoroutines())
+	})
 
-		werr := xsync.Go(func() error {
-			return wsjson.Write(tt.ctx, c1, exp)
+	t.Run("closeEncoder", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+
+		c1.SetCloseEncoder(func(code websocket.StatusCode, reason string) []byte {
+			return append([]byte{'!', byte(code >> 8), byte(code)}, reason...)
+		})
+		c2.SetCloseDecoder(func(p []byte) (websocket.CloseError, error) {
+			if len(p) < 3 || p[0] != '!' {
+				return websocket.CloseError{}, fmt.Errorf("unexpected close payload %q", p)
+			}
+			return websocket.CloseError{
+				Code:   websocket.StatusCode(p[1])<<8 | websocket.StatusCode(p[2]),
+				Reason: string(p[3:]),
+			}, nil
 		})
 
-		var act interface{}
-		err := wsjson.Read(tt.ctx, c1, &act)
+		errs := xsync.Go(func() error {
+			_, _, err := c2.Read(tt.ctx)
+			return err
+		})
+
+		err := c1.Close(4000, "meow")
 		assert.Success(t, err)
-		assert.Equal(t, "read msg", exp, act)
 
-		select {
-		case err := <-werr:
-			assert.Success(t, err)
-		case <-tt.ctx.Done():
-			t.Fatal(tt.ctx.Err())
+		var ce websocket.CloseError
+		if !errors.As(<-errs, &ce) {
+			t.Fatal("expected CloseError")
 		}
-
-		err = c1.Close(websocket.StatusNormalClosure, "")
-		assert.Success(t, err)
+		assert.Equal(t, "close error", websocket.CloseError{Code: 4000, Reason: "meow"}, ce)
 	})
 
-	t.Run("CloseNow", func(t *testing.T) {
-		_, c1, c2 := newConnTest(t, nil, nil)
+	t.Run("closeEchoPolicy", func(t *testing.T) {
+		for _, tc := range []struct {
+			name   string
+			policy websocket.CloseEchoPolicy
+			echo   []byte
+		}{
+			{name: "mirror", policy: websocket.CloseEchoMirror, echo: []byte("\x0f\xa0meow")},
+			{name: "normal", policy: websocket.CloseEchoNormal, echo: []byte{0x03, 0xe8}},
+		} {
+			tc := tc
+			t.Run(tc.name, func(t *testing.T) {
+				tt, c1, c2 := newConnTest(t, nil, nil)
+
+				c2.SetCloseEchoPolicy(tc.policy)
+				errs := xsync.Go(func() error {
+					_, _, err := c2.Read(tt.ctx)
+					return assertCloseStatus(4000, err)
+				})
 
-		err1 := c1.CloseNow()
-		err2 := c2.CloseNow()
-		assert.Success(t, err1)
-		assert.Success(t, err2)
-		err1 = c1.CloseNow()
-		err2 = c2.CloseNow()
-		assert.ErrorIs(t, websocket.ErrClosed, err1)
-		assert.ErrorIs(t, websocket.ErrClosed, err2)
+				err := c1.Close(4000, "meow")
+				assert.Success(t, err)
+				assert.Success(t, <-errs)
+				assert.Equal(t, "echoed close frame", tc.echo, c1.RawCloseFrame())
+			})
+		}
 	})
 
 	t.Run("MidReadClose", func(t *testing.T) {
@@ -585,6 +2133,47 @@ func assertClose(tb testing.TB, c *websocket.Conn) {
 	assert.Success(tb, err)
 }
 
+// xorExtension is a test extension that XORs every payload with its key
+// and marks the frames with rsv2.
+type xorExtension struct{}
+
+func (xorExtension) Name() string    { return "x-xor" }
+func (xorExtension) Offer() []string { return []string{"key=42"} }
+
+func (xorExtension) Negotiated(params []string) (websocket.ExtensionCodec, error) {
+	if len(params) != 1 || params[0] != "key=42" {
+		return nil, fmt.Errorf("unexpected params %q", params)
+	}
+	return xorCodec(42), nil
+}
+
+func (xorExtension) Accept(params []string) ([]string, websocket.ExtensionCodec, bool) {
+	return params, xorCodec(42), len(params) == 1 && params[0] == "key=42"
+}
+
+type xorCodec byte
+
+func (k xorCodec) WriteFrame(f *websocket.ExtensionFrame) error {
+	p := make([]byte, len(f.Payload))
+	for i, b := range f.Payload {
+		p[i] = b ^ byte(k)
+	}
+	f.Payload = p
+	f.Rsv2 = true
+	return nil
+}
+
+func (k xorCodec) ReadFrame(f *websocket.ExtensionFrame) error {
+	if !f.Rsv2 {
+		return errors.New("expected rsv2")
+	}
+	for i := range f.Payload {
+		f.Payload[i] ^= byte(k)
+	}
+	f.Rsv2 = false
+	return nil
+}
+
 func TestConcurrentClosePing(t *testing.T) {
 	t.Parallel()
 	for i := 0; i < 64; i++ {
@@ -0,0 +1,154 @@
+//go:build !js
+// +build !js
+
+package websocket
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+
+	"nhooyr.io/websocket/internal/bpool"
+	"nhooyr.io/websocket/internal/errd"
+)
+
+// dedupWindow is the number of IDs below the highest delivered ID
+// that are tracked to allow for out of order delivery.
+const dedupWindow = 64
+
+// WriteWithID writes a message prefixed with id as an 8 byte big endian integer.
+// Text messages are prefixed with id as 16 lowercase hex digits instead so
+// that they remain valid UTF-8.
+//
+// Use it with a Deduplicator on the peer to get at most once delivery when
+// messages are replayed after a reconnect. IDs must be unique and should be
+// increasing.
+func (c *Conn) WriteWithID(ctx context.Context, typ MessageType, p []byte, id uint64) error {
+	b := bpool.Get()
+	defer bpool.Put(b)
+
+	var idBuf [8]byte
+	binary.BigEndian.PutUint64(idBuf[:], id)
+	if typ == MessageText {
+		var hexBuf [16]byte
+		hex.Encode(hexBuf[:], idBuf[:])
+		b.Write(hexBuf[:])
+	} else {
+		b.Write(idBuf[:])
+	}
+	b.Write(p)
+
+	err := c.Write(ctx, typ, b.Bytes())
+	if err != nil {
+		return fmt.Errorf("failed to write msg with id %v: %w", id, err)
+	}
+	return nil
+}
+
+// Deduplicator drops messages written with WriteWithID that have already
+// been delivered.
+//
+// It tracks the highest delivered ID and a window of the 64 IDs below it.
+// Messages with an ID that was already delivered or that falls below the
+// window are dropped.
+//
+// A Deduplicator is not tied to a single Conn. Reuse it across reconnects
+// so replayed messages are not delivered twice.
+//
+// The zero value is ready to use.
+type Deduplicator struct {
+	mu      sync.Mutex
+	started bool
+	highest uint64
+	// seen is a bitmap of delivered IDs below highest.
+	// Bit i is set if highest-i-1 was delivered.
+	seen uint64
+}
+
+// Read reads messages from c until one with an ID that has not
+// been delivered yet is read. It returns the message with the ID
+// prefix removed along with the ID.
+//
+// If a message that does not start with an ID is read, the connection is
+// closed with StatusInvalidFramePayloadData.
+func (d *Deduplicator) Read(ctx context.Context, c *Conn) (_ MessageType, _ []byte, _ uint64, err error) {
+	defer errd.Wrap(&err, "failed to read deduplicated msg")
+
+	for {
+		typ, p, err := c.Read(ctx)
+		if err != nil {
+			return 0, nil, 0, err
+		}
+
+		id, n, err := parseMessageID(typ, p)
+		if err != nil {
+			c.Close(StatusInvalidFramePayloadData, err.Error())
+			return 0, nil, 0, err
+		}
+		if d.deliver(id) {
+			return typ, p[n:], id, nil
+		}
+	}
+}
+
+// parseMessageID returns the ID prefixed by WriteWithID to p and its length.
+func parseMessageID(typ MessageType, p []byte) (uint64, int, error) {
+	if typ != MessageText {
+		if len(p) < 8 {
+			return 0, 0, errors.New("message too short to contain an id")
+		}
+		return binary.BigEndian.Uint64(p), 8, nil
+	}
+
+	if len(p) < 16 {
+		return 0, 0, errors.New("message too short to contain an id")
+	}
+	var idBuf [8]byte
+	_, err := hex.Decode(idBuf[:], p[:16])
+	if err != nil {
+		return 0, 0, fmt.Errorf("message does not start with a hex id: %w", err)
+	}
+	return binary.BigEndian.Uint64(idBuf[:]), 16, nil
+}
+
+// deliver records id as delivered and reports whether it had not been
+// delivered before.
+func (d *Deduplicator) deliver(id uint64) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if !d.started {
+		d.started = true
+		d.highest = id
+		return true
+	}
+
+	if id > d.highest {
+		shift := id - d.highest
+		if shift > dedupWindow {
+			d.seen = 0
+		} else {
+			// The previous highest becomes bit shift-1.
+			d.seen = d.seen<<shift | 1<<(shift-1)
+		}
+		d.highest = id
+		return true
+	}
+
+	if id == d.highest {
+		return false
+	}
+
+	i := d.highest - id - 1
+	if i >= dedupWindow {
+		return false
+	}
+	if d.seen&(1<<i) != 0 {
+		return false
+	}
+	d.seen |= 1 << i
+	return true
+}
@@ -0,0 +1,109 @@
+//go:build !js
+// +build !js
+
+package websocket
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"nhooyr.io/websocket/internal/bpool"
+)
+
+// Kinds of the messages written by WriteDelta.
+const (
+	deltaFull  byte = 0
+	deltaPatch byte = 1
+)
+
+// WriteDelta writes current as a binary message encoded against base, the
+// state previously sent to the peer. The peer reverses it with ApplyDelta.
+//
+// The message starts with a kind byte. A kind of 0 is followed by current in
+// full. A kind of 1 is a patch: the length of the prefix current shares with
+// base and the length of the suffix it shares with base, both as unsigned
+// varints, followed by the bytes of current in between. The full state is
+// sent whenever the patch would not be smaller.
+//
+// Pass a nil base to send the full state, e.g. to resynchronize the peer.
+// With CompressionContextTakeover, the sliding window also lets the patch
+// compress well against recently sent states.
+func (c *Conn) WriteDelta(ctx context.Context, base, current []byte) error {
+	b := bpool.Get()
+	defer bpool.Put(b)
+
+	prefix, suffix := commonAffixes(base, current)
+	mid := current[prefix : len(current)-suffix]
+	if base != nil {
+		var lenBuf [binary.MaxVarintLen64]byte
+		b.WriteByte(deltaPatch)
+		b.Write(lenBuf[:binary.PutUvarint(lenBuf[:], uint64(prefix))])
+		b.Write(lenBuf[:binary.PutUvarint(lenBuf[:], uint64(suffix))])
+		b.Write(mid)
+	}
+	if base == nil || b.Len() >= 1+len(current) {
+		b.Reset()
+		b.WriteByte(deltaFull)
+		b.Write(current)
+	}
+
+	err := c.Write(ctx, MessageBinary, b.Bytes())
+	if err != nil {
+		return fmt.Errorf("failed to write delta: %w", err)
+	}
+	return nil
+}
+
+// ApplyDelta returns the state encoded in a message written by WriteDelta
+// against base. base is not modified.
+func ApplyDelta(base, delta []byte) ([]byte, error) {
+	if len(delta) == 0 {
+		return nil, errors.New("failed to apply delta: empty message")
+	}
+
+	switch delta[0] {
+	case deltaFull:
+		return append([]byte(nil), delta[1:]...), nil
+	case deltaPatch:
+		p := delta[1:]
+		prefix, n := binary.Uvarint(p)
+		if n <= 0 {
+			return nil, errors.New("failed to apply delta: invalid prefix length")
+		}
+		p = p[n:]
+		suffix, n := binary.Uvarint(p)
+		if n <= 0 {
+			return nil, errors.New("failed to apply delta: invalid suffix length")
+		}
+		p = p[n:]
+		if prefix > uint64(len(base)) || suffix > uint64(len(base))-prefix {
+			return nil, fmt.Errorf("failed to apply delta: prefix %v and suffix %v exceed base of length %v", prefix, suffix, len(base))
+		}
+
+		b := make([]byte, 0, int(prefix)+len(p)+int(suffix))
+		b = append(b, base[:prefix]...)
+		b = append(b, p...)
+		b = append(b, base[len(base)-int(suffix):]...)
+		return b, nil
+	default:
+		return nil, fmt.Errorf("failed to apply delta: unknown kind %v", delta[0])
+	}
+}
+
+// commonAffixes returns the lengths of the longest common prefix and suffix
+// of a and b that do not overlap in either.
+func commonAffixes(a, b []byte) (prefix, suffix int) {
+	n := len(a)
+	if len(b) < n {
+		n = len(b)
+	}
+	for prefix < n && a[prefix] == b[prefix] {
+		prefix++
+	}
+	for suffix < n-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	return prefix, suffix
+}
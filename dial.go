@@ -9,8 +9,10 @@ import (
 	"context"
 	"crypto/rand"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"strings"
@@ -27,6 +29,15 @@ type DialOptions struct {
 	// http.Transport does beginning with Go 1.12.
 	HTTPClient *http.Client
 
+	// DialContext optionally specifies the dial function used to establish
+	// the connection the handshake is performed on, e.g. to connect to a
+	// unix socket or to use a custom resolver. TLS is performed on top of
+	// the returned connection for wss URLs.
+	//
+	// It is set as the DialContext of a clone of HTTPClient's Transport
+	// and so requires the Transport to be nil or a *http.Transport.
+	DialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+
 	// HTTPHeader specifies the HTTP headers included in the handshake request.
 	HTTPHeader http.Header
 
@@ -48,6 +59,49 @@ type DialOptions struct {
 	// Defaults to 512 bytes for CompressionNoContextTakeover and 128 bytes
 	// for CompressionContextTakeover.
 	CompressionThreshold int
+
+	// CompressionLevel is the flate level messages are compressed with,
+	// from flate.HuffmanOnly to flate.BestCompression.
+	//
+	// Higher levels trade CPU time for fewer bytes on the wire: flate.BestSpeed
+	// suits CPU constrained servers, flate.BestCompression bandwidth
+	// constrained links and flate.HuffmanOnly is cheapest but only helps with
+	// skewed byte distributions. flate.NoCompression cannot be selected, disable
+	// compression instead.
+	//
+	// Defaults to flate.BestSpeed.
+	CompressionLevel int
+
+	// RequireCompression fails the handshake if CompressionMode is not
+	// CompressionDisabled but the server's response does not negotiate the
+	// permessage-deflate extension, e.g. because a proxy stripped it from the
+	// request or response.
+	RequireCompression bool
+
+	// Extensions lists the custom extensions to offer to the server, in order
+	// of preference. See Extension.
+	Extensions []Extension
+
+	// RandReader is the source of the 16 random bytes of the Sec-WebSocket-Key
+	// handshake header, e.g. to make handshakes deterministic in tests.
+	//
+	// RFC 6455 does not require the key to be cryptographically strong but
+	// some environments mandate a specific source of randomness.
+	//
+	// Defaults to crypto/rand.Reader.
+	RandReader io.Reader
+
+	// BufferedReader and BufferedWriter are reset to the connection and used
+	// to buffer its reads and writes, e.g. so that a client making frequent
+	// short connections can reuse preallocated buffers of a chosen size.
+	//
+	// The Conn owns them until it is closed. They must not be used by
+	// anything else, including another connection, until then.
+	//
+	// By default, they are taken from a pool shared by all connections and
+	// returned to it once the connection is closed.
+	BufferedReader *bufio.Reader
+	BufferedWriter *bufio.Writer
 }
 
 func (opts *DialOptions) cloneWithDefaults(ctx context.Context) (context.Context, context.CancelFunc, *DialOptions) {
@@ -84,6 +138,17 @@ func (opts *DialOptions) cloneWithDefaults(ctx context.Context) (context.Context
 		}
 		return nil
 	}
+	if o.DialContext != nil {
+		t := o.HTTPClient.Transport
+		if t == nil {
+			t = http.DefaultTransport
+		}
+		if ht, ok := t.(*http.Transport); ok {
+			ht = ht.Clone()
+			ht.DialContext = o.DialContext
+			newClient.Transport = ht
+		}
+	}
 	o.HTTPClient = &newClient
 
 	return ctx, cancel, &o
@@ -106,8 +171,38 @@ func Dial(ctx context.Context, u string, opts *DialOptions) (*Conn, *http.Respon
 	return dial(ctx, u, opts, nil)
 }
 
+// HandshakeError is returned by Dial when the server's response to the
+// handshake request is not a valid WebSocket upgrade, e.g. when the
+// endpoint does not speak WebSocket or rejected the subprotocols.
+// Errors making the request such as TLS failures are returned as is.
+type HandshakeError struct {
+	// StatusCode is the status code of the response.
+	StatusCode int
+	// Header is the header of the response.
+	Header http.Header
+	// Body is up to the first 1024 bytes of the response body.
+	Body []byte
+	// Err describes why the response was rejected.
+	Err error
+}
+
+func (e HandshakeError) Error() string {
+	return e.Err.Error()
+}
+
+func (e HandshakeError) Unwrap() error {
+	return e.Err
+}
+
 func dial(ctx context.Context, urls string, opts *DialOptions, rand io.Reader) (_ *Conn, _ *http.Response, err error) {
 	defer errd.Wrap(&err, "failed to WebSocket dial")
+	start := time.Now()
+
+	if opts != nil && opts.DialContext != nil && opts.HTTPClient != nil && opts.HTTPClient.Transport != nil {
+		if _, ok := opts.HTTPClient.Transport.(*http.Transport); !ok {
+			return nil, nil, errors.New("DialContext requires HTTPClient.Transport to be a *http.Transport")
+		}
+	}
 
 	var cancel context.CancelFunc
 	ctx, cancel, opts = opts.cloneWithDefaults(ctx)
@@ -115,6 +210,14 @@ func dial(ctx context.Context, urls string, opts *DialOptions, rand io.Reader) (
 		defer cancel()
 	}
 
+	err = validateCompressionLevel(opts.CompressionLevel)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if rand == nil {
+		rand = opts.RandReader
+	}
 	secWebSocketKey, err := secWebSocketKey(rand)
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to generate Sec-WebSocket-Key: %w", err)
@@ -144,27 +247,56 @@ func dial(ctx context.Context, urls string, opts *DialOptions, rand io.Reader) (
 			b, _ := io.ReadAll(r)
 			respBody.Close()
 			resp.Body = io.NopCloser(bytes.NewReader(b))
+
+			if he, ok := err.(HandshakeError); ok {
+				he.Body = b
+				err = he
+			}
 		}
 	}()
 
-	copts, err = verifyServerResponse(opts, copts, secWebSocketKey, resp)
+	copts, extCodecs, err := verifyServerResponse(opts, copts, secWebSocketKey, resp)
 	if err != nil {
-		return nil, resp, err
+		return nil, resp, HandshakeError{
+			StatusCode: resp.StatusCode,
+			Header:     resp.Header,
+			Err:        err,
+		}
 	}
+	handshakeDuration := time.Since(start)
 
 	rwc, ok := respBody.(io.ReadWriteCloser)
 	if !ok {
 		return nil, resp, fmt.Errorf("response body is not a io.ReadWriteCloser: %T", respBody)
 	}
 
+	br := opts.BufferedReader
+	if br != nil {
+		br.Reset(rwc)
+	} else {
+		br = getBufioReader(rwc)
+	}
+	bw := opts.BufferedWriter
+	if bw != nil {
+		bw.Reset(rwc)
+	} else {
+		bw = getBufioWriter(rwc)
+	}
+
 	return newConn(connConfig{
-		subprotocol:    resp.Header.Get("Sec-WebSocket-Protocol"),
-		rwc:            rwc,
-		client:         true,
-		copts:          copts,
-		flateThreshold: opts.CompressionThreshold,
-		br:             getBufioReader(rwc),
-		bw:             getBufioWriter(rwc),
+		subprotocol:       resp.Header.Get("Sec-WebSocket-Protocol"),
+		extensions:        extensionTokens(resp.Header),
+		rwc:               rwc,
+		client:            true,
+		copts:             copts,
+		flateThreshold:    opts.CompressionThreshold,
+		flateLevel:        opts.CompressionLevel,
+		extCodecs:         extCodecs,
+		handshakeDuration: handshakeDuration,
+		br:                br,
+		bw:                bw,
+		userBr:            opts.BufferedReader != nil,
+		userBw:            opts.BufferedWriter != nil,
 	}), resp, nil
 }
 
@@ -199,8 +331,15 @@ func handshakeRequest(ctx context.Context, urls string, opts *DialOptions, copts
 	if len(opts.Subprotocols) > 0 {
 		req.Header.Set("Sec-WebSocket-Protocol", strings.Join(opts.Subprotocols, ","))
 	}
+	var exts []string
 	if copts != nil {
-		req.Header.Set("Sec-WebSocket-Extensions", copts.String())
+		exts = append(exts, copts.String())
+	}
+	for _, ext := range opts.Extensions {
+		exts = append(exts, extensionOffer(ext))
+	}
+	if len(exts) > 0 {
+		req.Header.Set("Sec-WebSocket-Extensions", strings.Join(exts, ", "))
 	}
 
 	resp, err := opts.HTTPClient.Do(req)
@@ -222,21 +361,21 @@ func secWebSocketKey(rr io.Reader) (string, error) {
 	return base64.StdEncoding.EncodeToString(b), nil
 }
 
-func verifyServerResponse(opts *DialOptions, copts *compressionOptions, secWebSocketKey string, resp *http.Response) (*compressionOptions, error) {
+func verifyServerResponse(opts *DialOptions, copts *compressionOptions, secWebSocketKey string, resp *http.Response) (*compressionOptions, []ExtensionCodec, error) {
 	if resp.StatusCode != http.StatusSwitchingProtocols {
-		return nil, fmt.Errorf("expected handshake response status code %v but got %v", http.StatusSwitchingProtocols, resp.StatusCode)
+		return nil, nil, fmt.Errorf("expected handshake response status code %v but got %v", http.StatusSwitchingProtocols, resp.StatusCode)
 	}
 
 	if !headerContainsTokenIgnoreCase(resp.Header, "Connection", "Upgrade") {
-		return nil, fmt.Errorf("WebSocket protocol violation: Connection header %q does not contain Upgrade", resp.Header.Get("Connection"))
+		return nil, nil, fmt.Errorf("WebSocket protocol violation: Connection header %q does not contain Upgrade", resp.Header.Get("Connection"))
 	}
 
 	if !headerContainsTokenIgnoreCase(resp.Header, "Upgrade", "WebSocket") {
-		return nil, fmt.Errorf("WebSocket protocol violation: Upgrade header %q does not contain websocket", resp.Header.Get("Upgrade"))
+		return nil, nil, fmt.Errorf("WebSocket protocol violation: Upgrade header %q does not contain websocket", resp.Header.Get("Upgrade"))
 	}
 
-	if resp.Header.Get("Sec-WebSocket-Accept") != secWebSocketAccept(secWebSocketKey) {
-		return nil, fmt.Errorf("WebSocket protocol violation: invalid Sec-WebSocket-Accept %q, key %q",
+	if resp.Header.Get("Sec-WebSocket-Accept") != SecWebSocketAccept(secWebSocketKey) {
+		return nil, nil, fmt.Errorf("WebSocket protocol violation: invalid Sec-WebSocket-Accept %q, key %q",
 			resp.Header.Get("Sec-WebSocket-Accept"),
 			secWebSocketKey,
 		)
@@ -244,10 +383,17 @@ func verifyServerResponse(opts *DialOptions, copts *compressionOptions, secWebSo
 
 	err := verifySubprotocol(opts.Subprotocols, resp)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	return verifyServerExtensions(copts, resp.Header)
+	negotiated, codecs, err := verifyServerExtensions(copts, opts.Extensions, resp.Header)
+	if err != nil {
+		return nil, nil, err
+	}
+	if opts.RequireCompression && copts != nil && negotiated == nil {
+		return nil, nil, errors.New("server did not negotiate the required permessage-deflate extension")
+	}
+	return negotiated, codecs, nil
 }
 
 func verifySubprotocol(subprotos []string, resp *http.Response) error {
@@ -265,17 +411,36 @@ func verifySubprotocol(subprotos []string, resp *http.Response) error {
 	return fmt.Errorf("WebSocket protocol violation: unexpected Sec-WebSocket-Protocol from server: %q", proto)
 }
 
-func verifyServerExtensions(copts *compressionOptions, h http.Header) (*compressionOptions, error) {
-	exts := websocketExtensions(h)
-	if len(exts) == 0 {
-		return nil, nil
-	}
+func verifyServerExtensions(copts *compressionOptions, extensions []Extension, h http.Header) (*compressionOptions, []ExtensionCodec, error) {
+	var negotiated *compressionOptions
+	var codecs []ExtensionCodec
+	seen := make(map[Extension]bool)
+	for _, ext := range websocketExtensions(h) {
+		if ext.name == "permessage-deflate" && copts != nil && negotiated == nil {
+			var err error
+			negotiated, err = verifyServerDeflate(copts, ext)
+			if err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+
+		e := findExtension(extensions, ext.name)
+		if e == nil || seen[e] {
+			return nil, nil, fmt.Errorf("WebSocket protcol violation: unsupported extension from server: %+v", ext)
+		}
+		seen[e] = true
 
-	ext := exts[0]
-	if ext.name != "permessage-deflate" || len(exts) > 1 || copts == nil {
-		return nil, fmt.Errorf("WebSocket protcol violation: unsupported extensions from server: %+v", exts[1:])
+		codec, err := e.Negotiated(ext.params)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to negotiate extension %q: %w", ext.name, err)
+		}
+		codecs = append(codecs, codec)
 	}
+	return negotiated, codecs, nil
+}
 
+func verifyServerDeflate(copts *compressionOptions, ext websocketExtension) (*compressionOptions, error) {
 	_copts := *copts
 	copts = &_copts
 
@@ -4,13 +4,17 @@
 package websocket_test
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"crypto/rand"
+	"errors"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -52,6 +56,13 @@ func TestBadDials(t *testing.T) {
 					return 0, io.EOF
 				},
 			},
+			{
+				name: "badCompressionLevel",
+				url:  "ws://example.com",
+				opts: &websocket.DialOptions{
+					CompressionLevel: 10,
+				},
+			},
 			{
 				name:   "nilContext",
 				url:    "http://localhost",
@@ -97,6 +108,33 @@ func TestBadDials(t *testing.T) {
 		assert.Contains(t, err, "failed to WebSocket dial: expected handshake response status code 101 but got 0")
 	})
 
+	t.Run("handshakeError", func(t *testing.T) {
+		t.Parallel()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+
+		_, _, err := websocket.Dial(ctx, "ws://example.com", &websocket.DialOptions{
+			HTTPClient: mockHTTPClient(func(*http.Request) (*http.Response, error) {
+				h := http.Header{}
+				h.Set("X-Meow", "woof")
+				return &http.Response{
+					StatusCode: http.StatusForbidden,
+					Header:     h,
+					Body:       io.NopCloser(strings.NewReader(strings.Repeat("x", 2048))),
+				}, nil
+			}),
+		})
+		var he websocket.HandshakeError
+		if !errors.As(err, &he) {
+			t.Fatalf("expected HandshakeError: %v", err)
+		}
+		assert.Equal(t, "status code", http.StatusForbidden, he.StatusCode)
+		assert.Equal(t, "header", "woof", he.Header.Get("X-Meow"))
+		assert.Equal(t, "body", strings.Repeat("x", 1024), string(he.Body))
+		assert.Contains(t, err, "expected handshake response status code 101 but got 403")
+	})
+
 	t.Run("badBody", func(t *testing.T) {
 		t.Parallel()
 
@@ -121,6 +159,53 @@ func TestBadDials(t *testing.T) {
 		})
 		assert.Contains(t, err, "response body is not a io.ReadWriteCloser")
 	})
+
+	t.Run("randReader", func(t *testing.T) {
+		t.Parallel()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+
+		var key string
+		_, _, err := websocket.Dial(ctx, "ws://example.com", &websocket.DialOptions{
+			HTTPClient: mockHTTPClient(func(r *http.Request) (*http.Response, error) {
+				key = r.Header.Get("Sec-WebSocket-Key")
+				return nil, errors.New("meow")
+			}),
+			RandReader: bytes.NewReader(make([]byte, 16)),
+		})
+		assert.Contains(t, err, "meow")
+		assert.Equal(t, "key", "AAAAAAAAAAAAAAAAAAAAAA==", key)
+	})
+
+	t.Run("badAccept", func(t *testing.T) {
+		t.Parallel()
+
+		for _, accept := range []string{"", "xd", websocket.SecWebSocketAccept("meow")} {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+			defer cancel()
+
+			rt := func(r *http.Request) (*http.Response, error) {
+				h := http.Header{}
+				h.Set("Connection", "Upgrade")
+				h.Set("Upgrade", "websocket")
+				if accept != "" {
+					h.Set("Sec-WebSocket-Accept", accept)
+				}
+
+				return &http.Response{
+					StatusCode: http.StatusSwitchingProtocols,
+					Header:     h,
+					Body:       io.NopCloser(strings.NewReader("hi")),
+				}, nil
+			}
+
+			_, _, err := websocket.Dial(ctx, "ws://example.com", &websocket.DialOptions{
+				HTTPClient: mockHTTPClient(rt),
+			})
+			assert.Contains(t, err, "invalid Sec-WebSocket-Accept")
+		}
+	})
 }
 
 func Test_verifyHostOverride(t *testing.T) {
@@ -187,9 +272,10 @@ func Test_verifyServerHandshake(t *testing.T) {
 	t.Parallel()
 
 	testCases := []struct {
-		name     string
-		response func(w http.ResponseWriter)
-		success  bool
+		name               string
+		response           func(w http.ResponseWriter)
+		requireCompression bool
+		success            bool
 	}{
 		{
 			name: "badStatus",
@@ -255,6 +341,27 @@ func Test_verifyServerHandshake(t *testing.T) {
 			},
 			success: false,
 		},
+		{
+			name: "compressionStripped",
+			response: func(w http.ResponseWriter) {
+				w.Header().Set("Connection", "Upgrade")
+				w.Header().Set("Upgrade", "websocket")
+				w.WriteHeader(http.StatusSwitchingProtocols)
+			},
+			requireCompression: true,
+			success:            false,
+		},
+		{
+			name: "compressionRequired",
+			response: func(w http.ResponseWriter) {
+				w.Header().Set("Connection", "Upgrade")
+				w.Header().Set("Upgrade", "websocket")
+				w.Header().Set("Sec-WebSocket-Extensions", "permessage-deflate")
+				w.WriteHeader(http.StatusSwitchingProtocols)
+			},
+			requireCompression: true,
+			success:            true,
+		},
 		{
 			name: "success",
 			response: func(w http.ResponseWriter) {
@@ -287,7 +394,11 @@ func Test_verifyServerHandshake(t *testing.T) {
 			opts := &websocket.DialOptions{
 				Subprotocols: strings.Split(r.Header.Get("Sec-WebSocket-Protocol"), ","),
 			}
-			_, err = websocket.VerifyServerResponse(opts, websocket.CompressionModeOpts(opts.CompressionMode), key, resp)
+			if tc.requireCompression {
+				opts.CompressionMode = websocket.CompressionContextTakeover
+				opts.RequireCompression = true
+			}
+			_, _, err = websocket.VerifyServerResponse(opts, websocket.CompressionModeOpts(opts.CompressionMode), key, resp)
 			if tc.success {
 				assert.Success(t, err)
 			} else {
@@ -418,3 +529,74 @@ func TestDialViaProxy(t *testing.T) {
 	assertEcho(t, ctx, c)
 	assertClose(t, c)
 }
+
+func TestDialBufferedReaderWriter(t *testing.T) {
+	t.Parallel()
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := echoServer(w, r, nil)
+		assert.Success(t, err)
+	}))
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	opts := &websocket.DialOptions{
+		BufferedReader: bufio.NewReaderSize(nil, 8192),
+		BufferedWriter: bufio.NewWriterSize(nil, 8192),
+	}
+	// The buffers are reused once the previous connection is closed.
+	for i := 0; i < 2; i++ {
+		c, _, err := websocket.Dial(ctx, s.URL, opts)
+		assert.Success(t, err)
+
+		assertEcho(t, ctx, c)
+		assertClose(t, c)
+	}
+}
+
+func TestDialContext(t *testing.T) {
+	t.Parallel()
+
+	sock := filepath.Join(t.TempDir(), "ws.sock")
+	l, err := net.Listen("unix", sock)
+	assert.Success(t, err)
+
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := echoServer(w, r, nil)
+		assert.Success(t, err)
+	}))
+	s.Listener.Close()
+	s.Listener = l
+	s.Start()
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	t.Run("unix", func(t *testing.T) {
+		c, _, err := websocket.Dial(ctx, "ws://unix", &websocket.DialOptions{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", sock)
+			},
+		})
+		assert.Success(t, err)
+
+		assertEcho(t, ctx, c)
+		assertClose(t, c)
+	})
+
+	t.Run("badTransport", func(t *testing.T) {
+		_, _, err := websocket.Dial(ctx, "ws://unix", &websocket.DialOptions{
+			HTTPClient: mockHTTPClient(func(*http.Request) (*http.Response, error) {
+				return nil, nil
+			}),
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return nil, nil
+			},
+		})
+		assert.Contains(t, err, "DialContext requires HTTPClient.Transport to be a *http.Transport")
+	})
+}
@@ -28,10 +28,15 @@ func (c *Conn) RecordBytesRead() *int {
 	return &bytesRead
 }
 
+// ActiveGoroutines returns the number of goroutines tracked by c.wg
+// that are still running.
+func (c *Conn) ActiveGoroutines() int64 {
+	return c.goroutines.Load()
+}
+
 var ErrClosed = net.ErrClosed
 
 var ExportedDial = dial
-var SecWebSocketAccept = secWebSocketAccept
 var SecWebSocketKey = secWebSocketKey
 var VerifyServerResponse = verifyServerResponse
 
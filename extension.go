@@ -0,0 +1,214 @@
+//go:build !js
+// +build !js
+
+package websocket
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Extension is a custom WebSocket extension negotiated during the handshake.
+// See https://tools.ietf.org/html/rfc6455#section-9
+//
+// Register extensions with DialOptions.Extensions and AcceptOptions.Extensions.
+// permessage-deflate is built in and is configured with CompressionMode instead.
+type Extension interface {
+	// Name returns the extension token, e.g. "x-example".
+	Name() string
+
+	// Offer returns the parameters Dial offers in the handshake request.
+	Offer() []string
+
+	// Negotiated is called by Dial with the parameters of the server's
+	// response. It returns the codec for the connection or an error to fail
+	// the handshake.
+	Negotiated(params []string) (ExtensionCodec, error)
+
+	// Accept is called by Accept with the parameters offered by the client.
+	// It returns the parameters of the response and the codec for the
+	// connection, or false to decline the extension.
+	Accept(params []string) (response []string, codec ExtensionCodec, ok bool)
+}
+
+// ExtensionCodec transforms the data frames of a connection for a negotiated
+// Extension. Control frames are never passed to it.
+//
+// Compression runs closest to the application. Outgoing frames are passed to
+// each codec, in the order the extensions were negotiated, after compression
+// and before masking. Incoming frames are passed to each codec in reverse order
+// after unmasking and before decompression. Thus every codec sees the frame as
+// its peer's codec produced it.
+//
+// Incoming frames are buffered whole for the codecs and so must not exceed the
+// read limit, or 2 GiB if it is disabled.
+//
+// A codec is called with the read or write lock of the Conn held and must not
+// call methods of the Conn. If it panics, the panic is logged and the
+// connection is closed.
+type ExtensionCodec interface {
+	// WriteFrame is called with every outgoing data frame. It may set f.Rsv2
+	// and f.Rsv3 and replace f.Payload but must not modify f.Payload in place
+	// as it may be the caller's buffer.
+	WriteFrame(f *ExtensionFrame) error
+
+	// ReadFrame is called with every incoming data frame. It must clear the
+	// reserved bits it handles and may modify or replace f.Payload.
+	// If a reserved bit is still set after every codec has run, the connection
+	// fails with StatusProtocolError.
+	ReadFrame(f *ExtensionFrame) error
+}
+
+// ExtensionFrame is a data frame as seen by an ExtensionCodec.
+type ExtensionFrame struct {
+	// Type is the type of the message the frame starts or 0 for a
+	// continuation frame.
+	Type MessageType
+	Fin  bool
+
+	// Compressed reports whether the frame has the permessage-deflate bit set.
+	// Codecs must not change it.
+	Compressed bool
+
+	// Rsv2 and Rsv3 are the reserved bits available to extensions.
+	Rsv2, Rsv3 bool
+
+	Payload []byte
+}
+
+func extensionOffer(ext Extension) string {
+	return strings.Join(append([]string{ext.Name()}, ext.Offer()...), "; ")
+}
+
+func findExtension(extensions []Extension, name string) Extension {
+	for _, ext := range extensions {
+		if strings.EqualFold(ext.Name(), name) {
+			return ext
+		}
+	}
+	return nil
+}
+
+// acceptExtensions negotiates the registered extensions offered by the client in
+// the order they were offered. It returns the tokens of the response and the
+// codecs of the accepted extensions.
+func acceptExtensions(offered []websocketExtension, extensions []Extension) ([]string, []ExtensionCodec) {
+	var tokens []string
+	var codecs []ExtensionCodec
+	accepted := make(map[Extension]bool)
+	for _, offer := range offered {
+		ext := findExtension(extensions, offer.name)
+		if ext == nil || accepted[ext] {
+			continue
+		}
+		params, codec, ok := ext.Accept(offer.params)
+		if !ok {
+			continue
+		}
+		accepted[ext] = true
+		tokens = append(tokens, strings.Join(append([]string{ext.Name()}, params...), "; "))
+		codecs = append(codecs, codec)
+	}
+	return tokens, codecs
+}
+
+func (c *Conn) encodeExtensionFrame(fin bool, flate bool, opcode opcode, p []byte) ([]byte, error) {
+	f := ExtensionFrame{
+		Fin:        fin,
+		Compressed: flate,
+		Payload:    p,
+	}
+	if opcode != opContinuation {
+		f.Type = MessageType(opcode)
+	}
+	for _, codec := range c.extCodecs {
+		var err error
+		panicErr := recoverCallback("extension codec", func() {
+			err = codec.WriteFrame(&f)
+		})
+		if panicErr != nil {
+			// The frame lock is held so no close frame can be written.
+			return nil, panicErr
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode frame: %w", err)
+		}
+	}
+	c.writeHeader.rsv2 = f.Rsv2
+	c.writeHeader.rsv3 = f.Rsv3
+	return f.Payload, nil
+}
+
+// decodeExtensionFrame reads the whole payload of the frame just set and passes it
+// to the extension codecs. The result is then read from mr.extBuf.
+func (mr *msgReader) decodeExtensionFrame(h header) error {
+	mr.extBuf = nil
+	if len(mr.c.extCodecs) == 0 {
+		return nil
+	}
+
+	// The payload is buffered whole so bound it by the read limit first,
+	// and even without one by maxExtensionFramePayload.
+	limit := mr.limitReader.limit.Load()
+	if limit >= 0 && h.payloadLength >= limit {
+		err := fmt.Errorf("read limited at %v bytes", limit-1)
+		mr.c.writeError(StatusMessageTooBig, err)
+		return err
+	}
+	if h.payloadLength > maxExtensionFramePayload {
+		err := fmt.Errorf("extension frame payload of %v bytes exceeds the maximum of %v bytes", h.payloadLength, maxExtensionFramePayload)
+		mr.c.writeError(StatusMessageTooBig, err)
+		return err
+	}
+
+	p := make([]byte, h.payloadLength)
+	_, err := mr.c.readFramePayload(mr.ctx, p)
+	if err != nil {
+		return err
+	}
+	mr.payloadLength = 0
+	if h.masked {
+		mask(h.maskKey, p)
+	}
+
+	f := ExtensionFrame{
+		Fin:        h.fin,
+		Compressed: h.rsv1,
+		Rsv2:       h.rsv2,
+		Rsv3:       h.rsv3,
+		Payload:    p,
+	}
+	if h.opcode != opContinuation {
+		f.Type = MessageType(h.opcode)
+	}
+	for i := len(mr.c.extCodecs) - 1; i >= 0; i-- {
+		panicErr := recoverCallback("extension codec", func() {
+			err = mr.c.extCodecs[i].ReadFrame(&f)
+		})
+		if panicErr != nil {
+			mr.c.writeError(StatusInternalError, panicErr)
+			return panicErr
+		}
+		if err != nil {
+			err = fmt.Errorf("failed to decode frame: %w", err)
+			mr.c.writeError(StatusProtocolError, err)
+			return err
+		}
+	}
+	if f.Rsv2 || f.Rsv3 {
+		err := fmt.Errorf("received header with unexpected rsv bits set: %v:%v", f.Rsv2, f.Rsv3)
+		mr.c.writeError(StatusProtocolError, err)
+		return err
+	}
+
+	mr.extBuf = f.Payload
+	return nil
+}
+
+var errExtensionsNegotiated = errors.New("cannot be used with negotiated extensions")
+
+// maxExtensionFramePayload bounds the frames buffered for the extension codecs
+// when the read limit is disabled.
+const maxExtensionFramePayload = math.MaxInt32
@@ -0,0 +1,47 @@
+//go:build !js
+// +build !js
+
+package websocket
+
+import (
+	"context"
+	"time"
+)
+
+// Message is a WebSocket message read with ReadMessage.
+type Message struct {
+	Type MessageType
+	// Data is allocated for each message and is owned by the caller.
+	Data []byte
+	// ReceivedAt is when the first frame of the message was read.
+	ReceivedAt time.Time
+}
+
+// ReadMessage is a convenience method around Reader to read a single message
+// from the connection as a Message.
+//
+// Like Read, it must not be called concurrently with Reader.
+func (c *Conn) ReadMessage(ctx context.Context) (*Message, error) {
+	if c.prefetch != nil {
+		m, err := c.prefetch.next(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return &Message{Type: m.typ, Data: m.p, ReceivedAt: m.receivedAt}, nil
+	}
+
+	typ, r, err := c.Reader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	m := &Message{
+		Type:       typ,
+		ReceivedAt: time.Now(),
+	}
+
+	m.Data, err = readAll(r, c.expectedReadSize())
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
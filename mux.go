@@ -0,0 +1,413 @@
+//go:build !js
+// +build !js
+
+package websocket
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Multiplexer carries independent streams over a single Conn.
+//
+// Every stream frame is a binary message made of the 4 byte big endian
+// stream ID, a 1 byte frame type and the payload. Streams opened by the
+// client have odd IDs and streams opened by the server have even IDs so
+// both peers may open streams concurrently.
+//
+// Each stream has a receive window of 256 KB and a writer blocks until the
+// peer has read enough to grant it more, so a stream that is not read does
+// not hold up the others.
+//
+// The Multiplexer reads from the Conn until it is closed. Do not read from
+// or write to the Conn directly once it is wrapped.
+type Multiplexer struct {
+	c      *Conn
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	accept chan *Stream
+	closed chan struct{}
+
+	mu      sync.Mutex
+	streams map[uint32]*Stream
+	nextID  uint32
+	err     error
+}
+
+const (
+	muxOpen byte = iota
+	muxData
+	muxWindow
+	muxClose
+)
+
+const (
+	// muxWindowSize is the initial receive window of every stream.
+	muxWindowSize = 256 << 10
+	// muxMaxData is the max payload of a data frame. It keeps frames
+	// under the default read limit.
+	muxMaxData = 16 << 10
+	// muxAcceptBacklog is the number of streams opened by the peer that
+	// may be waiting in AcceptStream. Further streams are closed.
+	muxAcceptBacklog = 64
+)
+
+// NewMultiplexer returns a Multiplexer carrying streams over c.
+func NewMultiplexer(c *Conn) *Multiplexer {
+	m := &Multiplexer{
+		c:       c,
+		accept:  make(chan *Stream, muxAcceptBacklog),
+		closed:  make(chan struct{}),
+		streams: make(map[uint32]*Stream),
+		nextID:  2,
+	}
+	if c.client {
+		m.nextID = 1
+	}
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+
+	c.wgAdd()
+	go func() {
+		defer c.wgDone()
+		m.readLoop()
+	}()
+	return m
+}
+
+// OpenStream opens a new stream to the peer.
+func (m *Multiplexer) OpenStream(ctx context.Context) (*Stream, error) {
+	m.mu.Lock()
+	if m.err != nil {
+		m.mu.Unlock()
+		return nil, m.err
+	}
+	s := newStream(m, m.nextID)
+	m.nextID += 2
+	m.streams[s.id] = s
+	m.mu.Unlock()
+
+	err := m.c.Write(ctx, MessageBinary, muxFrame(s.id, muxOpen, nil))
+	if err != nil {
+		m.removeStream(s.id)
+		return nil, fmt.Errorf("failed to open stream: %w", err)
+	}
+	return s, nil
+}
+
+// AcceptStream waits for and returns the next stream opened by the peer.
+func (m *Multiplexer) AcceptStream(ctx context.Context) (*Stream, error) {
+	select {
+	case s := <-m.accept:
+		return s, nil
+	case <-m.closed:
+		return nil, m.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Close closes the Conn with StatusNormalClosure and all streams with it.
+func (m *Multiplexer) Close() error {
+	return m.c.Close(StatusNormalClosure, "")
+}
+
+// readLoop is tracked by the WaitGroup of the Conn and so must not call
+// Close, which waits on it.
+func (m *Multiplexer) readLoop() {
+	for {
+		typ, p, err := m.c.Read(m.ctx)
+		if err != nil {
+			m.fail(err)
+			return
+		}
+		if typ != MessageBinary || len(p) < 5 {
+			err = errors.New("received invalid stream frame")
+			m.c.closeHandshake(StatusProtocolError, err.Error())
+			m.fail(err)
+			return
+		}
+
+		err = m.handleFrame(binary.BigEndian.Uint32(p), p[4], p[5:])
+		if err != nil {
+			m.c.closeHandshake(StatusProtocolError, err.Error())
+			m.fail(err)
+			return
+		}
+	}
+}
+
+func (m *Multiplexer) handleFrame(id uint32, typ byte, p []byte) error {
+	if typ == muxOpen {
+		if (id%2 == 1) == m.c.client {
+			return fmt.Errorf("received open for stream %v with a local ID", id)
+		}
+		m.mu.Lock()
+		if m.streams[id] != nil {
+			m.mu.Unlock()
+			return fmt.Errorf("received open for existing stream %v", id)
+		}
+		s := newStream(m, id)
+		m.streams[id] = s
+		m.mu.Unlock()
+
+		select {
+		case m.accept <- s:
+		default:
+			s.Close()
+		}
+		return nil
+	}
+
+	m.mu.Lock()
+	s := m.streams[id]
+	m.mu.Unlock()
+	if s == nil {
+		// The stream was closed locally.
+		return nil
+	}
+
+	switch typ {
+	case muxData:
+		return s.receive(p)
+	case muxWindow:
+		if len(p) != 4 {
+			return fmt.Errorf("received invalid window update for stream %v", id)
+		}
+		s.grant(binary.BigEndian.Uint32(p))
+		return nil
+	case muxClose:
+		s.closeRemote()
+		return nil
+	default:
+		return fmt.Errorf("received unknown stream frame type %v", typ)
+	}
+}
+
+// fail closes every stream with err once the Conn is unusable.
+func (m *Multiplexer) fail(err error) {
+	m.cancel()
+
+	m.mu.Lock()
+	m.err = fmt.Errorf("multiplexer closed: %w", err)
+	streams := m.streams
+	m.streams = make(map[uint32]*Stream)
+	m.mu.Unlock()
+	close(m.closed)
+
+	for _, s := range streams {
+		s.fail(m.err)
+	}
+}
+
+func (m *Multiplexer) removeStream(id uint32) {
+	m.mu.Lock()
+	delete(m.streams, id)
+	m.mu.Unlock()
+}
+
+func muxFrame(id uint32, typ byte, p []byte) []byte {
+	b := make([]byte, 5+len(p))
+	binary.BigEndian.PutUint32(b, id)
+	b[4] = typ
+	copy(b[5:], p)
+	return b
+}
+
+// Stream is a logical stream of a Multiplexer.
+//
+// Read and Write are bounded by the lifetime of the Multiplexer. Closing a
+// stream closes both of its directions without affecting the other streams.
+// Once the peer closes the stream, Read returns io.EOF after the data already
+// received and Write returns an error.
+type Stream struct {
+	m  *Multiplexer
+	id uint32
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	buf  bytes.Buffer
+	// unacked is the number of bytes read since the last window update.
+	unacked    int
+	sendWindow int
+	closed     bool
+	peerClosed bool
+	err        error
+
+	// writeMu serializes writes so that the frames of a Write are
+	// not interleaved with those of another.
+	writeMu sync.Mutex
+}
+
+var _ io.ReadWriteCloser = &Stream{}
+
+func newStream(m *Multiplexer, id uint32) *Stream {
+	s := &Stream{
+		m:          m,
+		id:         id,
+		sendWindow: muxWindowSize,
+	}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// ID returns the ID of the stream.
+func (s *Stream) ID() uint32 {
+	return s.id
+}
+
+// Read reads data sent by the peer on the stream.
+func (s *Stream) Read(p []byte) (int, error) {
+	s.mu.Lock()
+	for s.buf.Len() == 0 {
+		switch {
+		case s.closed:
+			s.mu.Unlock()
+			return 0, errors.New("failed to read: stream closed")
+		case s.err != nil:
+			s.mu.Unlock()
+			return 0, s.err
+		case s.peerClosed:
+			s.mu.Unlock()
+			return 0, io.EOF
+		}
+		s.cond.Wait()
+	}
+
+	n, _ := s.buf.Read(p)
+	s.unacked += n
+	var grant uint32
+	if s.unacked >= muxWindowSize/2 {
+		grant = uint32(s.unacked)
+		s.unacked = 0
+	}
+	s.mu.Unlock()
+
+	if grant > 0 {
+		var b [4]byte
+		binary.BigEndian.PutUint32(b[:], grant)
+		err := s.m.c.Write(s.m.ctx, MessageBinary, muxFrame(s.id, muxWindow, b[:]))
+		if err != nil {
+			return n, fmt.Errorf("failed to grant window: %w", err)
+		}
+	}
+	return n, nil
+}
+
+// Write writes p to the stream, waiting for the peer to grant more of its
+// receive window as necessary.
+func (s *Stream) Write(p []byte) (int, error) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	var n int
+	for len(p) > 0 {
+		s.mu.Lock()
+		for s.sendWindow == 0 && s.writable() == nil {
+			s.cond.Wait()
+		}
+		err := s.writable()
+		if err != nil {
+			s.mu.Unlock()
+			return n, err
+		}
+		chunk := len(p)
+		if chunk > s.sendWindow {
+			chunk = s.sendWindow
+		}
+		if chunk > muxMaxData {
+			chunk = muxMaxData
+		}
+		s.sendWindow -= chunk
+		s.mu.Unlock()
+
+		err = s.m.c.Write(s.m.ctx, MessageBinary, muxFrame(s.id, muxData, p[:chunk]))
+		if err != nil {
+			return n, fmt.Errorf("failed to write: %w", err)
+		}
+		p = p[chunk:]
+		n += chunk
+	}
+	return n, nil
+}
+
+// writable returns why the stream cannot be written to, if it cannot.
+// It must be called with s.mu held.
+func (s *Stream) writable() error {
+	switch {
+	case s.closed:
+		return errors.New("failed to write: stream closed")
+	case s.err != nil:
+		return s.err
+	case s.peerClosed:
+		return errors.New("failed to write: stream closed by peer")
+	}
+	return nil
+}
+
+// Close closes the stream, discarding any unread data.
+func (s *Stream) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return errors.New("stream already closed")
+	}
+	s.closed = true
+	s.buf.Reset()
+	err := s.err
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	s.m.removeStream(s.id)
+	if err != nil {
+		return err
+	}
+
+	err = s.m.c.Write(s.m.ctx, MessageBinary, muxFrame(s.id, muxClose, nil))
+	if err != nil {
+		return fmt.Errorf("failed to close stream: %w", err)
+	}
+	return nil
+}
+
+func (s *Stream) receive(p []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Data read but not yet granted back still counts against the window.
+	if s.buf.Len()+s.unacked+len(p) > muxWindowSize {
+		return fmt.Errorf("stream %v exceeded its receive window", s.id)
+	}
+	s.buf.Write(p)
+	s.cond.Broadcast()
+	return nil
+}
+
+func (s *Stream) grant(n uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sendWindow += int(n)
+	s.cond.Broadcast()
+}
+
+func (s *Stream) closeRemote() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.peerClosed = true
+	s.cond.Broadcast()
+}
+
+func (s *Stream) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.err = err
+	s.cond.Broadcast()
+}
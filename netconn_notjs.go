@@ -6,14 +6,14 @@ package websocket
 import "net"
 
 func (nc *netConn) RemoteAddr() net.Addr {
-	if unc, ok := nc.c.rwc.(net.Conn); ok {
+	if unc, ok := nc.c.underlyingNetConn(); ok {
 		return unc.RemoteAddr()
 	}
 	return websocketAddr{}
 }
 
 func (nc *netConn) LocalAddr() net.Addr {
-	if unc, ok := nc.c.rwc.(net.Conn); ok {
+	if unc, ok := nc.c.underlyingNetConn(); ok {
 		return unc.LocalAddr()
 	}
 	return websocketAddr{}
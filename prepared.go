@@ -0,0 +1,119 @@
+//go:build !js
+// +build !js
+
+package websocket
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"errors"
+	"fmt"
+	"unicode/utf8"
+
+	"nhooyr.io/websocket/internal/errd"
+)
+
+// PreparedMessage is a message compressed once with PrepareMessage that can be
+// written to many connections with WritePrepared.
+//
+// It is safe for concurrent use.
+type PreparedMessage struct {
+	typ MessageType
+	// invalidUTF8 is set for text messages that are not valid UTF-8.
+	invalidUTF8 bool
+
+	// p is the uncompressed payload.
+	p []byte
+	// flateP is the compressed payload.
+	// nil if compression was not requested.
+	flateP []byte
+}
+
+// PrepareMessage prepares a data message of the given type so that it can be written
+// to many connections without being compressed for each one.
+//
+// If compress is true, the message is also compressed with a fresh deflate
+// context. The compressed message is only written to connections that negotiated
+// compression without server context takeover. As the compressed message does not
+// share the connection's sliding window, it cannot be written to connections using
+// context takeover and the uncompressed message is written instead.
+//
+// Text messages are validated to be UTF-8 once here. WritePrepared then fails
+// for an invalid one if the connection validates outgoing text, see
+// SetOutgoingTextValidation.
+//
+// Prepared messages are unmasked and so can only be written by server connections.
+func PrepareMessage(typ MessageType, p []byte, compress bool) (_ *PreparedMessage, err error) {
+	defer errd.Wrap(&err, "failed to prepare message")
+
+	if typ != MessageText && typ != MessageBinary {
+		return nil, fmt.Errorf("unexpected message type: %v", typ)
+	}
+
+	pm := &PreparedMessage{
+		typ:         typ,
+		invalidUTF8: typ == MessageText && !utf8.Valid(p),
+		p:           append([]byte(nil), p...),
+	}
+
+	if compress {
+		var buf bytes.Buffer
+		tw := &trimLastFourBytesWriter{
+			w: &buf,
+		}
+		fw := getFlateWriter(tw, flate.BestSpeed)
+		defer putFlateWriter(fw, flate.BestSpeed)
+
+		_, err = fw.Write(p)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compress: %w", err)
+		}
+		err = fw.Flush()
+		if err != nil {
+			return nil, fmt.Errorf("failed to flush flate: %w", err)
+		}
+
+		pm.flateP = buf.Bytes()
+	}
+
+	return pm, nil
+}
+
+// WritePrepared writes a message prepared with PrepareMessage to the connection.
+//
+// It returns an error on client connections as client frames must be masked
+// with a per connection key.
+func (c *Conn) WritePrepared(ctx context.Context, pm *PreparedMessage) error {
+	err := c.writePrepared(ctx, pm)
+	if err != nil {
+		return fmt.Errorf("failed to write prepared msg: %w", err)
+	}
+	return nil
+}
+
+func (c *Conn) writePrepared(ctx context.Context, pm *PreparedMessage) error {
+	if c.client {
+		return errors.New("prepared messages cannot be written by client connections")
+	}
+	if pm.typ != MessageText && pm.typ != MessageBinary {
+		return errors.New("message was not prepared with PrepareMessage")
+	}
+	if pm.invalidUTF8 && !c.noOutgoingTextValidation.Load() {
+		return errInvalidOutgoingUTF8
+	}
+
+	p, flate := pm.p, false
+	if pm.flateP != nil && c.flate() && !c.msgWriter.flateContextTakeover() {
+		p, flate = pm.flateP, true
+	}
+
+	err := c.msgWriter.mu.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.msgWriter.mu.unlock()
+
+	_, err = c.writeFrame(ctx, true, flate, opcode(pm.typ), p)
+	return err
+}
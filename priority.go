@@ -0,0 +1,137 @@
+//go:build !js
+// +build !js
+
+package websocket
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// WriteWithPriority is like Write but messages written with it are sent in
+// order of priority, higher first, when they are waiting on each other.
+// Equal priorities are sent in the order they were written.
+//
+// Use it to send urgent messages like flow control updates ahead of queued
+// bulk data. Only callers of WriteWithPriority are ordered amongst themselves.
+// Write and Writer compete with them for the connection as usual.
+//
+// Under a sustained load of higher priority messages, lower priority
+// messages may be starved.
+func (c *Conn) WriteWithPriority(ctx context.Context, priority int, typ MessageType, p []byte) error {
+	err := c.writeQueue.acquire(ctx, priority)
+	if err != nil {
+		return fmt.Errorf("failed to write msg: %w", err)
+	}
+	defer c.writeQueue.release()
+
+	return c.Write(ctx, typ, p)
+}
+
+// writeQueue grants its turn to the waiter with the highest priority.
+type writeQueue struct {
+	c *Conn
+
+	mu      sync.Mutex
+	busy    bool
+	seq     uint64
+	waiters writeWaiters
+}
+
+type writeWaiter struct {
+	priority int
+	seq      uint64
+	ready    chan struct{}
+	index    int
+}
+
+func (q *writeQueue) acquire(ctx context.Context, priority int) error {
+	q.mu.Lock()
+	if !q.busy {
+		q.busy = true
+		q.mu.Unlock()
+		return nil
+	}
+	q.seq++
+	w := &writeWaiter{
+		priority: priority,
+		seq:      q.seq,
+		ready:    make(chan struct{}),
+	}
+	heap.Push(&q.waiters, w)
+	q.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return nil
+	case <-q.c.closed:
+		q.remove(w)
+		return net.ErrClosed
+	case <-ctx.Done():
+		q.remove(w)
+		return ctx.Err()
+	}
+}
+
+// remove removes w from the queue. If w was granted its turn
+// concurrently, the turn is passed on.
+func (q *writeQueue) remove(w *writeWaiter) {
+	q.mu.Lock()
+	if w.index >= 0 {
+		heap.Remove(&q.waiters, w.index)
+		q.mu.Unlock()
+		return
+	}
+	q.mu.Unlock()
+	q.release()
+}
+
+func (q *writeQueue) release() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.waiters) == 0 {
+		q.busy = false
+		return
+	}
+	w := heap.Pop(&q.waiters).(*writeWaiter)
+	close(w.ready)
+}
+
+// writeWaiters implements heap.Interface.
+type writeWaiters []*writeWaiter
+
+func (ws writeWaiters) Len() int {
+	return len(ws)
+}
+
+func (ws writeWaiters) Less(i, j int) bool {
+	if ws[i].priority != ws[j].priority {
+		return ws[i].priority > ws[j].priority
+	}
+	return ws[i].seq < ws[j].seq
+}
+
+func (ws writeWaiters) Swap(i, j int) {
+	ws[i], ws[j] = ws[j], ws[i]
+	ws[i].index = i
+	ws[j].index = j
+}
+
+func (ws *writeWaiters) Push(x interface{}) {
+	w := x.(*writeWaiter)
+	w.index = len(*ws)
+	*ws = append(*ws, w)
+}
+
+func (ws *writeWaiters) Pop() interface{} {
+	old := *ws
+	w := old[len(old)-1]
+	old[len(old)-1] = nil
+	w.index = -1
+	*ws = old[:len(old)-1]
+	return w
+}
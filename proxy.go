@@ -0,0 +1,144 @@
+//go:build !js
+// +build !js
+
+package websocket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Proxy forwards the messages read from a to b and those read from b to a
+// until either connection is closed. Messages keep their type and boundaries
+// and are streamed so a large message is never buffered whole.
+//
+// When a peer closes its connection, the other connection is closed with the
+// same status code and reason. If a connection fails without a close frame,
+// the other is closed with StatusGoingAway.
+//
+// If the connection a message is read from and the one it is written to both
+// negotiated compression without context takeover in that direction, and no
+// custom extensions, compressed messages are forwarded as is rather than being
+// decompressed and compressed again. Then the read limit applies to the
+// compressed message and its UTF-8 is validated by the receiving peer only.
+// Otherwise messages are compressed as negotiated by the connection they are
+// written to.
+//
+// Proxy returns once both connections are closed. It returns nil if they
+// were closed with a close handshake and the error that ended the proxying
+// otherwise, e.g. when ctx is done. Do not read from or write to a or b
+// while Proxy is running.
+func Proxy(ctx context.Context, a, b *Conn) error {
+	errs := make(chan error, 2)
+	go func() {
+		errs <- proxyMessages(ctx, b, a)
+	}()
+	go func() {
+		errs <- proxyMessages(ctx, a, b)
+	}()
+
+	err := <-errs
+	<-errs
+	if CloseStatus(err) != -1 {
+		return nil
+	}
+	return err
+}
+
+// proxyMessages copies the messages of src to dst until src fails, then
+// closes dst accordingly.
+func proxyMessages(ctx context.Context, dst, src *Conn) error {
+	var buf []byte
+	passthrough := proxyCompressed(dst, src)
+	for {
+		var typ MessageType
+		var compressed bool
+		var r io.Reader
+		var err error
+		if passthrough {
+			typ, compressed, r, err = src.rawReader(ctx)
+		} else {
+			typ, r, err = src.Reader(ctx)
+		}
+		if err != nil {
+			closeProxied(dst, err)
+			return err
+		}
+
+		if compressed {
+			if buf == nil {
+				buf = make([]byte, 32<<10)
+			}
+			err = dst.writeCompressed(ctx, typ, r, buf)
+			if err != nil {
+				closeProxied(dst, err)
+				return fmt.Errorf("failed to proxy message: %w", err)
+			}
+			continue
+		}
+
+		w, err := dst.Writer(ctx, typ)
+		if err != nil {
+			return fmt.Errorf("failed to proxy message: %w", err)
+		}
+		_, err = io.Copy(w, r)
+		if err != nil {
+			closeProxied(dst, err)
+			return fmt.Errorf("failed to proxy message: %w", err)
+		}
+		err = w.Close()
+		if err != nil {
+			return fmt.Errorf("failed to proxy message: %w", err)
+		}
+	}
+}
+
+// proxyCompressed reports whether the compressed messages read from src can be
+// written to dst as is. Without context takeover, every compressed message
+// is a complete deflate stream that does not depend on the messages before it.
+func proxyCompressed(dst, src *Conn) bool {
+	return src.flate() && dst.flate() &&
+		!src.msgReader.flateContextTakeover() && !dst.msgWriter.flateContextTakeover() &&
+		len(src.extCodecs) == 0 && len(dst.extCodecs) == 0 && src.prefetch == nil
+}
+
+// writeCompressed writes a message of type typ whose payload, read from r, is
+// already compressed without context takeover. It is written in frames of
+// up to len(buf) bytes.
+func (c *Conn) writeCompressed(ctx context.Context, typ MessageType, r io.Reader, buf []byte) error {
+	err := c.msgWriter.mu.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.msgWriter.mu.unlock()
+
+	opcode := opcode(typ)
+	for {
+		n, err := io.ReadFull(r, buf)
+		fin := errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+		if err != nil && !fin {
+			return err
+		}
+		_, err = c.writeFrame(ctx, fin, true, opcode, buf[:n])
+		if err != nil {
+			return err
+		}
+		if fin {
+			return nil
+		}
+		opcode = opContinuation
+	}
+}
+
+// closeProxied closes c after reading from the other connection failed with
+// err. c may already be closed.
+func closeProxied(c *Conn, err error) {
+	var ce CloseError
+	if errors.As(err, &ce) && validWireCloseCode(ce.Code) {
+		c.Close(ce.Code, ce.Reason)
+		return
+	}
+	c.Close(StatusGoingAway, "")
+}
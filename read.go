@@ -5,13 +5,18 @@ package websocket
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"os"
 	"strings"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"nhooyr.io/websocket/internal/errd"
 	"nhooyr.io/websocket/internal/util"
@@ -27,6 +32,9 @@ import (
 //
 // Call CloseRead if you do not expect any data messages from the peer.
 //
+// If the deadline of the context is exceeded, the returned error matches
+// os.ErrDeadlineExceeded as well as context.DeadlineExceeded.
+//
 // Only one Reader may be open at a time.
 //
 // If you need a separate timeout on the Reader call and the Read itself,
@@ -34,19 +42,565 @@ import (
 // See https://github.com/nhooyr/websocket/issues/87#issue-451703332
 // Most users should not need this.
 func (c *Conn) Reader(ctx context.Context) (MessageType, io.Reader, error) {
+	if c.prefetch != nil {
+		m, err := c.prefetch.next(ctx)
+		if err != nil {
+			return 0, nil, err
+		}
+		return m.typ, bytes.NewReader(m.p), nil
+	}
 	return c.reader(ctx)
 }
 
 // Read is a convenience method around Reader to read a single message
 // from the connection.
+//
+// The returned slice is allocated for each message and is owned by the caller.
+// The connection does not retain a reassembly buffer between messages so
+// receiving a large message does not permanently increase its memory usage.
+//
+// An empty message is returned as a non nil empty slice. See
+// SetDropEmptyMessages to skip empty messages instead.
 func (c *Conn) Read(ctx context.Context) (MessageType, []byte, error) {
-	typ, r, err := c.Reader(ctx)
+	if c.prefetch != nil {
+		m, err := c.prefetch.next(ctx)
+		return m.typ, m.p, err
+	}
+	return c.read(ctx)
+}
+
+// ReadSeq is like Read but also returns the sequence number of the message.
+// Messages are numbered from 1 in the order they are read from the connection,
+// e.g. to detect reordering by concurrent consumers.
+func (c *Conn) ReadSeq(ctx context.Context) (seq uint64, typ MessageType, p []byte, err error) {
+	if c.prefetch != nil {
+		m, err := c.prefetch.next(ctx)
+		return m.seq, m.typ, m.p, err
+	}
+	typ, p, err = c.read(ctx)
 	if err != nil {
-		return 0, nil, err
+		return 0, 0, nil, err
+	}
+	return c.msgReader.seq, typ, p, nil
+}
+
+func (c *Conn) read(ctx context.Context) (MessageType, []byte, error) {
+	for {
+		typ, r, err := c.reader(ctx)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		b, err := readAll(r, c.expectedReadSize())
+		if err == nil && len(b) == 0 && c.dropEmptyMessages.Load() {
+			continue
+		}
+		return typ, b, err
+	}
+}
+
+// ReadOfType is like Read but discards data messages not of type typ until one
+// of type typ is read and returns its payload. Control frames are handled while
+// skipping and a close frame from the peer ends the read with its close error.
+//
+// Discarded messages are not buffered but still count against the read limit.
+func (c *Conn) ReadOfType(ctx context.Context, typ MessageType) ([]byte, error) {
+	for {
+		mtyp, r, err := c.Reader(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if mtyp != typ {
+			_, err = io.Copy(io.Discard, r)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		b, err := readAll(r, c.expectedReadSize())
+		if err == nil && len(b) == 0 && c.dropEmptyMessages.Load() {
+			continue
+		}
+		return b, err
+	}
+}
+
+// SetDropEmptyMessages sets whether Read and ReadBatch skip data messages with
+// an empty payload, e.g. when a peer sends them as signals the application
+// does not care about. Control frames are still handled while skipping.
+// Reader is not affected.
+//
+// By default, empty messages are returned by Read as a non nil empty slice.
+func (c *Conn) SetDropEmptyMessages(drop bool) {
+	c.dropEmptyMessages.Store(drop)
+}
+
+// expectedReadSize returns the capacity to allocate for a message read
+// with Read. It is never more than the read limit.
+func (c *Conn) expectedReadSize() int64 {
+	n := c.msgReader.expectedSize.Load()
+	if limit := c.msgReader.limitReader.limit.Load(); limit >= 0 && n > limit {
+		n = limit
+	}
+	return n
+}
+
+// readAll is io.ReadAll but the buffer is preallocated to size bytes.
+func readAll(r io.Reader, size int64) ([]byte, error) {
+	if size <= 0 {
+		return io.ReadAll(r)
+	}
+
+	b := make([]byte, 0, size)
+	for {
+		var n int
+		var err error
+		if len(b) < cap(b) {
+			n, err = r.Read(b[len(b):cap(b)])
+			b = b[:len(b)+n]
+		} else {
+			// Check for the end of the message before growing so that
+			// a message of exactly size bytes is not reallocated.
+			var tmp [512]byte
+			n, err = r.Read(tmp[:])
+			b = append(b, tmp[:n]...)
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				err = nil
+			}
+			return b, err
+		}
+	}
+}
+
+// ReadAvailable reads the next message like Read but returns whatever part of
+// it arrives within maxWait instead of waiting for all of it, e.g. for latency
+// sensitive streaming of long messages. complete reports whether the end of the
+// message has been read. Until it has, the next call continues the message
+// and returns the next part.
+//
+// Reads happen in the background and continue between calls. The ctx of the
+// call that starts a message bounds reading all of it. ReadAvailable must not
+// be mixed with other reads while a message is incomplete.
+func (c *Conn) ReadAvailable(ctx context.Context, maxWait time.Duration) (_ MessageType, p []byte, complete bool, err error) {
+	ar := c.available
+	if ar == nil {
+		typ, r, err := c.Reader(ctx)
+		if err != nil {
+			return 0, nil, false, err
+		}
+		ar = &availableReader{
+			typ:    typ,
+			r:      r,
+			chunks: make(chan availableChunk, 1),
+		}
+		c.available = ar
+	}
+
+	t := time.NewTimer(maxWait)
+	defer t.Stop()
+
+	for {
+		if !ar.reading {
+			ar.reading = true
+			c.wgAdd()
+			go func() {
+				defer c.wgDone()
+				b := make([]byte, 4096)
+				n, err := ar.r.Read(b)
+				ar.chunks <- availableChunk{b[:n], err}
+			}()
+		}
+
+		select {
+		case chunk := <-ar.chunks:
+			ar.reading = false
+			p = append(p, chunk.p...)
+			if errors.Is(chunk.err, io.EOF) {
+				c.available = nil
+				return ar.typ, p, true, nil
+			}
+			if chunk.err != nil {
+				c.available = nil
+				return ar.typ, p, false, chunk.err
+			}
+		case <-t.C:
+			return ar.typ, p, false, nil
+		case <-ctx.Done():
+			return ar.typ, p, false, ctx.Err()
+		}
+	}
+}
+
+// availableReader is the state of a message being read with ReadAvailable.
+type availableReader struct {
+	typ MessageType
+	r   io.Reader
+	// reading is whether a read is in progress in the background.
+	reading bool
+	chunks  chan availableChunk
+}
+
+type availableChunk struct {
+	p   []byte
+	err error
+}
+
+// ExtendReadDeadline replaces the context bounding the read in progress with
+// ctx without starting a new read. If no read is in progress, ctx bounds the
+// connection until the next read begins.
+//
+// Use it to keep a connection that is being read from with a short context
+// from timing out while the application is busy. As with reads, if ctx expires
+// the connection is closed with StatusPolicyViolation.
+func (c *Conn) ExtendReadDeadline(ctx context.Context) error {
+	select {
+	case <-c.closed:
+		return net.ErrClosed
+	case c.readTimeout <- ctx:
+		return nil
+	}
+}
+
+// SetPrefetch enables reading the next message in the background while the
+// application is processing the current one so that the next Read or Reader
+// call returns it without waiting on the connection.
+//
+// The tradeoff is that one message is always read ahead into memory, up to the
+// read limit, even if the application is not ready for it. Reads in the
+// background are not bounded by the context passed to Read. Expiration of that
+// context only bounds waiting for the next message and closes the connection
+// as usual.
+//
+// It is disabled by default. It must be enabled before the connection is read
+// from and cannot be disabled once enabled.
+func (c *Conn) SetPrefetch(enabled bool) {
+	if !enabled || c.prefetch != nil {
+		return
+	}
+
+	pf := &prefetcher{
+		c:        c,
+		msgs:     make(chan prefetchedMsg),
+		done:     make(chan struct{}),
+		priority: c.readPriority,
+	}
+	c.prefetch = pf
+
+	if pf.priority == nil {
+		c.wgAdd()
+		go func() {
+			defer c.wgDone()
+			pf.err = pf.loop(pf.msgs)
+			close(pf.done)
+		}()
+		return
+	}
+
+	in := make(chan prefetchedMsg)
+	readErr := make(chan error, 1)
+	c.wgAdd()
+	go func() {
+		defer c.wgDone()
+		readErr <- pf.loop(in)
+	}()
+	c.wgAdd()
+	go func() {
+		defer c.wgDone()
+		pf.err = pf.schedule(in, readErr)
+		close(pf.done)
+	}()
+}
+
+// UndeliveredCount returns the number of data messages read from the
+// connection with SetPrefetch that were not yet returned to the application,
+// e.g. for a credit based flow control protocol on top of the connection.
+//
+// It returns 0 without SetPrefetch as messages are then only read when asked
+// for.
+func (c *Conn) UndeliveredCount() int {
+	if c.prefetch == nil {
+		return 0
+	}
+	return int(c.prefetch.undelivered.Load())
+}
+
+// SetReadPriority sets a function to prioritize the messages read ahead with
+// SetPrefetch. Up to 16 messages are then read ahead and the one with the
+// highest priority is returned first. Messages of equal priority are returned
+// in the order they were read.
+//
+// So that low priority messages are not starved, the oldest message read ahead
+// is returned once 8 messages were returned before it. ReadSeq can be used to
+// restore the order messages were read in.
+//
+// If fn panics, the connection is closed with StatusInternalError.
+// It has no effect without SetPrefetch and must be called before SetPrefetch.
+func (c *Conn) SetReadPriority(fn func(typ MessageType, p []byte) int) {
+	c.readPriority = fn
+}
+
+const (
+	// priorityQueueSize is the max number of messages read ahead with
+	// SetReadPriority.
+	priorityQueueSize = 16
+	// maxPriorityBypass is the number of messages that may be returned
+	// before the oldest message read ahead.
+	maxPriorityBypass = 8
+)
+
+type prefetchedMsg struct {
+	seq      uint64
+	flate    bool
+	typ      MessageType
+	p        []byte
+	priority int
+	// receivedAt is when the message was read from the connection.
+	receivedAt time.Time
+}
+
+// prefetcher reads messages ahead of the application.
+type prefetcher struct {
+	c    *Conn
+	msgs chan prefetchedMsg
+	// done is closed once err is set.
+	done chan struct{}
+	err  error
+
+	priority func(typ MessageType, p []byte) int
+	// queue holds the messages read ahead by priority. It is owned by
+	// schedule until done is closed and by the reader afterwards so that
+	// the messages read before the error are still returned.
+	queue    []prefetchedMsg
+	bypassed int
+
+	// undelivered counts the messages read but not yet returned.
+	undelivered atomic.Int64
+}
+
+// loop reads messages into msgs until the connection fails.
+func (pf *prefetcher) loop(msgs chan<- prefetchedMsg) error {
+	for {
+		typ, p, err := pf.c.read(context.Background())
+		if err != nil {
+			return err
+		}
+		receivedAt := time.Now()
+		pf.undelivered.Add(1)
+
+		select {
+		case <-pf.c.closed:
+			pf.undelivered.Add(-1)
+			return net.ErrClosed
+		case msgs <- prefetchedMsg{seq: pf.c.msgReader.seq, flate: pf.c.msgReader.flate, typ: typ, p: p, receivedAt: receivedAt}:
+		}
+	}
+}
+
+// schedule queues the messages read from in and delivers them to pf.msgs by
+// priority until the loop reading them fails. The messages still queued are
+// then returned by next.
+func (pf *prefetcher) schedule(in <-chan prefetchedMsg, readErr <-chan error) error {
+	for {
+		var out chan<- prefetchedMsg
+		var next int
+		if len(pf.queue) > 0 {
+			out = pf.msgs
+			next = nextPrioritized(pf.queue, pf.bypassed)
+		}
+		recv := in
+		if len(pf.queue) >= priorityQueueSize {
+			recv = nil
+		}
+
+		var m prefetchedMsg
+		if out != nil {
+			m = pf.queue[next]
+		}
+		select {
+		case err := <-readErr:
+			return err
+		case m := <-recv:
+			panicErr := recoverCallback("read priority", func() {
+				m.priority = pf.priority(m.typ, m.p)
+			})
+			if panicErr != nil {
+				pf.c.writeError(StatusInternalError, panicErr)
+				return panicErr
+			}
+			pf.queue = append(pf.queue, m)
+		case out <- m:
+			pf.dequeue(next)
+		}
+	}
+}
+
+// dequeue removes the message at index i of the queue.
+func (pf *prefetcher) dequeue(i int) prefetchedMsg {
+	m := pf.queue[i]
+	if i == 0 {
+		pf.bypassed = 0
+	} else {
+		pf.bypassed++
+	}
+	pf.queue = append(pf.queue[:i], pf.queue[i+1:]...)
+	return m
+}
+
+// queued returns the next message left in the queue once done is closed.
+func (pf *prefetcher) queued() (prefetchedMsg, bool) {
+	if len(pf.queue) == 0 {
+		return prefetchedMsg{}, false
+	}
+	m := pf.dequeue(nextPrioritized(pf.queue, pf.bypassed))
+	pf.delivered(m)
+	return m, true
+}
+
+// delivered must be called with every message returned to the application.
+func (pf *prefetcher) delivered(m prefetchedMsg) {
+	pf.c.lastReadCompressed = m.flate
+	pf.undelivered.Add(-1)
+}
+
+// nextPrioritized returns the index in queue of the message to deliver next,
+// that is the oldest one with the highest priority or the oldest one if it was
+// bypassed too often.
+func nextPrioritized(queue []prefetchedMsg, bypassed int) int {
+	if bypassed >= maxPriorityBypass {
+		return 0
+	}
+	next := 0
+	for i, m := range queue {
+		if m.priority > queue[next].priority {
+			next = i
+		}
 	}
+	return next
+}
+
+func (pf *prefetcher) batch(ctx context.Context, max int) ([]Message, error) {
+	m, err := pf.next(ctx)
+	if err != nil {
+		return nil, err
+	}
+	msgs := []Message{{Type: m.typ, Data: m.p, ReceivedAt: m.receivedAt}}
 
-	b, err := io.ReadAll(r)
-	return typ, b, err
+	for len(msgs) < max {
+		select {
+		case m := <-pf.msgs:
+			pf.delivered(m)
+			msgs = append(msgs, Message{Type: m.typ, Data: m.p, ReceivedAt: m.receivedAt})
+		case <-pf.done:
+			m, ok := pf.queued()
+			if !ok {
+				return msgs, nil
+			}
+			msgs = append(msgs, Message{Type: m.typ, Data: m.p, ReceivedAt: m.receivedAt})
+		default:
+			return msgs, nil
+		}
+	}
+	return msgs, nil
+}
+
+func (pf *prefetcher) next(ctx context.Context) (prefetchedMsg, error) {
+	select {
+	case m := <-pf.msgs:
+		pf.delivered(m)
+		return m, nil
+	case <-pf.done:
+		m, ok := pf.queued()
+		if ok {
+			return m, nil
+		}
+		return prefetchedMsg{}, pf.err
+	case <-ctx.Done():
+		err := fmt.Errorf("failed to read prefetched msg: %w", readCtxErr(ctx))
+		pf.c.close(err)
+		return prefetchedMsg{}, err
+	}
+}
+
+// ReadBatch reads up to max messages from the connection. It blocks until the
+// first message is read and then reads the messages whose frames are already
+// buffered, amortizing the per call overhead for consumers of many small
+// messages. Control frames in between are handled as usual.
+//
+// If an error occurs after the first message, the messages read so far are
+// returned along with it. It returns an error if max is not positive.
+//
+// Like Read, it must not be called concurrently with Reader.
+func (c *Conn) ReadBatch(ctx context.Context, max int) ([]Message, error) {
+	if max <= 0 {
+		return nil, fmt.Errorf("failed to read batch: invalid max %v", max)
+	}
+	if c.prefetch != nil {
+		return c.prefetch.batch(ctx, max)
+	}
+
+	var msgs []Message
+	for len(msgs) < max {
+		if len(msgs) > 0 && !c.messageBuffered() {
+			break
+		}
+
+		m, err := c.ReadMessage(ctx)
+		if err != nil {
+			return msgs, err
+		}
+		if len(m.Data) == 0 && c.dropEmptyMessages.Load() {
+			continue
+		}
+		msgs = append(msgs, *m)
+	}
+	return msgs, nil
+}
+
+// messageBuffered reports whether the frames of the next data message,
+// along with any control frames before it, are buffered so that reading
+// it does not block on the connection.
+func (c *Conn) messageBuffered() bool {
+	b, _ := c.br.Peek(c.br.Buffered())
+	for {
+		if len(b) < 2 {
+			return false
+		}
+		fin := b[0]&(1<<7) != 0
+		op := opcode(b[0] & 0xf)
+		masked := b[1]&(1<<7) != 0
+
+		n := 2
+		payloadLength := int64(b[1] & 0x7f)
+		switch payloadLength {
+		case 126:
+			if len(b) < n+2 {
+				return false
+			}
+			payloadLength = int64(binary.BigEndian.Uint16(b[n:]))
+			n += 2
+		case 127:
+			if len(b) < n+8 {
+				return false
+			}
+			payloadLength = int64(binary.BigEndian.Uint64(b[n:]))
+			n += 8
+		}
+		if masked {
+			n += 4
+		}
+
+		if payloadLength < 0 || int64(len(b)-n) < payloadLength {
+			return false
+		}
+		b = b[int64(n)+payloadLength:]
+
+		if fin && (op == opText || op == opBinary || op == opContinuation) {
+			return true
+		}
+	}
 }
 
 // CloseRead starts a goroutine to read from the connection until it is closed
@@ -63,10 +617,10 @@ func (c *Conn) Read(ctx context.Context) (MessageType, []byte, error) {
 func (c *Conn) CloseRead(ctx context.Context) context.Context {
 	ctx, cancel := context.WithCancel(ctx)
 
-	c.wg.Add(1)
+	c.wgAdd()
 	go func() {
 		defer c.CloseNow()
-		defer c.wg.Done()
+		defer c.wgDone()
 		defer cancel()
 		_, _, err := c.Reader(ctx)
 		if err == nil {
@@ -96,6 +650,197 @@ func (c *Conn) SetReadLimit(n int64) {
 
 const defaultReadLimit = 32768
 
+// SetTextValidation sets whether text messages read from the connection are
+// validated to be UTF-8 as required by RFC 6455.
+// Runes split across frames are handled.
+//
+// When invalid UTF-8 is read, the connection will be closed with StatusInvalidFramePayloadData.
+//
+// Validation is enabled by default. Disable it to avoid the overhead when the peer is trusted.
+// It must not be called concurrently with Reader or Read.
+func (c *Conn) SetTextValidation(enabled bool) {
+	c.msgReader.skipUTF8Validation = !enabled
+}
+
+// SetUTF8Validator replaces the validator used for text messages read from
+// the connection, e.g. with a SIMD accelerated one.
+//
+// fn is called with the successive bytes of each text message as they are
+// read and must report whether they are valid UTF-8 so far, handling runes
+// split across calls. last is set on the final call for the message, which may
+// have an empty p, and fn must then also report whether the message ended on a
+// rune boundary. The next call after that is for a new message.
+//
+// It has no effect if text validation is disabled with SetTextValidation.
+// If fn panics, the panic is logged and the connection is closed with
+// StatusInternalError.
+//
+// By default, the standard library's unicode/utf8 is used. Pass nil to restore
+// it. It must not be called concurrently with Reader or Read.
+func (c *Conn) SetUTF8Validator(fn func(p []byte, last bool) bool) {
+	c.msgReader.utf8Func = fn
+}
+
+// SetExpectedMessageSize sets the capacity in bytes preallocated for each
+// message read with Read. If messages are usually around n bytes, this
+// avoids repeatedly growing the buffer as the message is read at the cost
+// of allocating n bytes for every message, including smaller ones.
+// It is capped at the read limit and does not affect Reader.
+//
+// By default, the buffer starts small and grows as needed. Set to 0 to
+// restore the default.
+func (c *Conn) SetExpectedMessageSize(n int) {
+	c.msgReader.expectedSize.Store(int64(n))
+}
+
+// SetReadProgressCallback sets a function to be called as each frame of the
+// message being read is read, e.g. to report the progress of a large
+// upload. bytesSoFar is the total payload length of the frames read so far,
+// which is the compressed length for compressed messages, and fin is true
+// for the final frame.
+//
+// It is called from the goroutine reading the message. If it panics, the panic
+// is logged and the connection is closed with StatusInternalError. Pass nil to
+// remove the callback. It must not be called concurrently with Reader or Read.
+func (c *Conn) SetReadProgressCallback(fn func(bytesSoFar int64, fin bool)) {
+	c.msgReader.progressCallback = fn
+}
+
+// SetMessageReadCallback sets a function to be called once each data message
+// has been read to the end, e.g. to measure the latency of a decode pipeline.
+// n is the length of the message as returned to the application, i.e. after
+// decompression, and dur is the time from reading the header of its first
+// frame to reading the rest of it.
+//
+// It is called from the goroutine reading the message. If it panics, the panic
+// is logged and the connection is closed with StatusInternalError. Pass nil to
+// remove the callback. It must not be called concurrently with Reader or Read.
+func (c *Conn) SetMessageReadCallback(fn func(typ MessageType, n int, dur time.Duration)) {
+	c.msgReader.msgCallback = fn
+}
+
+// minDecompressionRatioCheck is the decompressed length of a message below
+// which the max decompression ratio is not enforced as short repetitive
+// messages legitimately compress very well.
+const minDecompressionRatioCheck = 64 << 10
+
+// SetMaxDecompressionRatio sets the max ratio of the decompressed length of
+// a compressed message to its compressed length. It protects against a peer
+// sending a small message that inflates to a huge one, a decompression bomb.
+// The ratio is enforced as the message is decompressed, once it is longer
+// than 64 KB, so the message is never inflated in full.
+//
+// When the ratio is exceeded, the connection is closed with StatusMessageTooBig.
+// The read limit still applies to the decompressed length.
+//
+// By default, there is no max ratio. Set to 0 to disable. It must not be called
+// concurrently with Reader or Read.
+func (c *Conn) SetMaxDecompressionRatio(ratio float64) {
+	c.msgReader.maxDecompressionRatio = ratio
+}
+
+// SetMaxFragments sets the max number of frames a single data message
+// may be fragmented into. It protects against a peer sending a message
+// as many tiny fragments which the read limit does not catch.
+//
+// When the limit is hit, the connection will be closed with StatusPolicyViolation.
+//
+// By default, there is no limit. Set to 0 to disable.
+func (c *Conn) SetMaxFragments(n int) {
+	c.msgReader.maxFragments.Store(int64(n))
+}
+
+// SetLifetimeReadLimit sets the max number of bytes that may be read from
+// the connection over its lifetime. Unlike SetReadLimit, it is a running
+// total across all messages including control frames. Only frame payloads
+// are counted.
+//
+// The limit is checked against the length of every frame before its payload
+// is read. When the limit is hit, the connection will be closed with
+// StatusPolicyViolation.
+//
+// By default, there is no limit. Set to 0 to disable.
+func (c *Conn) SetLifetimeReadLimit(n int64) {
+	c.lifetimeReadLimit.Store(n)
+}
+
+// SetReadMessageRateLimit sets the max number of data messages per second
+// that Reader and Read deliver. Messages are spaced evenly to smooth out
+// bursts and, as nothing is read from the connection in between, a bursty
+// peer is slowed down by TCP flow control. Control frames do not count
+// against the limit.
+//
+// The wait is bounded by the context passed to Reader or Read.
+//
+// By default, there is no limit. Set to 0 to disable.
+func (c *Conn) SetReadMessageRateLimit(maxPerSecond int) {
+	c.maxReadMessageRate.Store(int64(maxPerSecond))
+}
+
+// waitReadMessageRate blocks until the next message may be read under the
+// limit set with SetReadMessageRateLimit. It must be called with readMu held.
+func (c *Conn) waitReadMessageRate(ctx context.Context) error {
+	limit := c.maxReadMessageRate.Load()
+	if limit <= 0 {
+		return nil
+	}
+
+	now := time.Now()
+	if c.nextReadMessage.After(now) {
+		t := time.NewTimer(c.nextReadMessage.Sub(now))
+		defer t.Stop()
+		select {
+		case <-c.closed:
+			return net.ErrClosed
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+		now = c.nextReadMessage
+	}
+	c.nextReadMessage = now.Add(time.Second / time.Duration(limit))
+	return nil
+}
+
+// SetMessageAssemblyTimeout sets the max duration from reading the first
+// frame of a fragmented message to reading its final frame. If it is exceeded,
+// the connection is closed with StatusPolicyViolation.
+//
+// It protects against a peer that holds resources by dribbling the fragments
+// of a message, which a timeout on every read does not catch as the reads
+// keep succeeding. Messages sent as a single frame are not affected.
+//
+// By default, there is no timeout. Set to 0 to disable.
+func (c *Conn) SetMessageAssemblyTimeout(d time.Duration) {
+	c.assemblyTimeout.Store(int64(d))
+}
+
+// startAssembly starts the assembly timeout of the fragmented message just
+// reset, if any. It must be called with readMu held.
+func (mr *msgReader) startAssembly() error {
+	d := time.Duration(mr.c.assemblyTimeout.Load())
+	if d <= 0 {
+		return nil
+	}
+	mr.assembling = true
+	return mr.c.setAssemblyDeadline(time.Now().Add(d))
+}
+
+// stopAssembly stops the assembly timeout once the final frame is read.
+func (mr *msgReader) stopAssembly() error {
+	mr.assembling = false
+	return mr.c.setAssemblyDeadline(time.Time{})
+}
+
+func (c *Conn) setAssemblyDeadline(deadline time.Time) error {
+	select {
+	case <-c.closed:
+		return net.ErrClosed
+	case c.assemblyDeadline <- deadline:
+		return nil
+	}
+}
+
 func newMsgReader(c *Conn) *msgReader {
 	mr := &msgReader{
 		c:   c,
@@ -146,7 +891,9 @@ func (mr *msgReader) close() {
 	}
 
 	if mr.c.client {
-		putBufioReader(mr.c.br)
+		if !mr.c.userBr {
+			putBufioReader(mr.c.br)
+		}
 		mr.c.br = nil
 	}
 }
@@ -170,6 +917,14 @@ func (c *Conn) readRSV1Illegal(h header) bool {
 	return false
 }
 
+func (c *Conn) readRSV23Illegal(h header) bool {
+	// rsv2 and rsv3 are only allowed on data frames for negotiated extensions.
+	if len(c.extCodecs) == 0 {
+		return true
+	}
+	return h.opcode != opText && h.opcode != opBinary && h.opcode != opContinuation
+}
+
 func (c *Conn) readLoop(ctx context.Context) (header, error) {
 	for {
 		h, err := c.readFrameHeader(ctx)
@@ -177,7 +932,7 @@ func (c *Conn) readLoop(ctx context.Context) (header, error) {
 			return header{}, err
 		}
 
-		if h.rsv1 && c.readRSV1Illegal(h) || h.rsv2 || h.rsv3 {
+		if h.rsv1 && c.readRSV1Illegal(h) || (h.rsv2 || h.rsv3) && c.readRSV23Illegal(h) {
 			err := fmt.Errorf("received header with unexpected rsv bits set: %v:%v:%v", h.rsv1, h.rsv2, h.rsv3)
 			c.writeError(StatusProtocolError, err)
 			return header{}, err
@@ -187,6 +942,13 @@ func (c *Conn) readLoop(ctx context.Context) (header, error) {
 			return header{}, errors.New("received unmasked frame from client")
 		}
 
+		c.readBytes += h.payloadLength
+		if limit := c.lifetimeReadLimit.Load(); limit > 0 && c.readBytes > limit {
+			err := fmt.Errorf("read lifetime limited at %v bytes", limit)
+			c.writeError(StatusPolicyViolation, err)
+			return header{}, err
+		}
+
 		switch h.opcode {
 		case opClose, opPing, opPong:
 			err = c.handleControl(ctx, h)
@@ -207,6 +969,41 @@ func (c *Conn) readLoop(ctx context.Context) (header, error) {
 	}
 }
 
+// readCtxErr returns the error of the expired read context ctx. Deadlines
+// also match os.ErrDeadlineExceeded as with the errors of a net.Conn.
+func readCtxErr(ctx context.Context) error {
+	err := ctx.Err()
+	if errors.Is(err, context.DeadlineExceeded) {
+		return deadlineExceededError{}
+	}
+	return err
+}
+
+// deadlineExceededError matches both context.DeadlineExceeded and
+// os.ErrDeadlineExceeded. It wraps the error the read failed with
+// after the deadline, if any.
+type deadlineExceededError struct {
+	err error
+}
+
+func (e deadlineExceededError) Error() string {
+	if e.err == nil {
+		return context.DeadlineExceeded.Error()
+	}
+	return fmt.Sprintf("%v: %v", context.DeadlineExceeded, e.err)
+}
+
+func (e deadlineExceededError) Unwrap() error {
+	return e.err
+}
+
+func (deadlineExceededError) Timeout() bool   { return true }
+func (deadlineExceededError) Temporary() bool { return true }
+
+func (deadlineExceededError) Is(target error) bool {
+	return target == context.DeadlineExceeded || target == os.ErrDeadlineExceeded
+}
+
 func (c *Conn) readFrameHeader(ctx context.Context) (header, error) {
 	select {
 	case <-c.closed:
@@ -216,12 +1013,15 @@ func (c *Conn) readFrameHeader(ctx context.Context) (header, error) {
 
 	h, err := readFrameHeader(c.br, c.readHeaderBuf[:])
 	if err != nil {
+		// The timeoutLoop closes the connection on expiry so check ctx first.
+		if ctx.Err() != nil {
+			return header{}, readCtxErr(ctx)
+		}
 		select {
 		case <-c.closed:
 			return header{}, net.ErrClosed
-		case <-ctx.Done():
-			return header{}, ctx.Err()
 		default:
+			err = abnormalClosureError{err}
 			c.close(err)
 			return header{}, err
 		}
@@ -245,13 +1045,14 @@ func (c *Conn) readFramePayload(ctx context.Context, p []byte) (int, error) {
 
 	n, err := io.ReadFull(c.br, p)
 	if err != nil {
+		if ctx.Err() != nil {
+			return n, readCtxErr(ctx)
+		}
 		select {
 		case <-c.closed:
 			return n, net.ErrClosed
-		case <-ctx.Done():
-			return n, ctx.Err()
 		default:
-			err = fmt.Errorf("failed to read frame payload: %w", err)
+			err = fmt.Errorf("failed to read frame payload: %w", abnormalClosureError{err})
 			c.close(err)
 			return n, err
 		}
@@ -295,16 +1096,48 @@ func (c *Conn) handleControl(ctx context.Context, h header) (err error) {
 	switch h.opcode {
 	case opPing:
 		if c.pingCallback != nil {
-			c.pingCallback()
+			err := recoverCallback("ping callback", c.pingCallback)
+			if err != nil {
+				c.writeError(StatusInternalError, err)
+				return err
+			}
+		}
+		if c.pingHandler != nil {
+			var handlerErr error
+			err := recoverCallback("ping handler", func() {
+				handlerErr = c.pingHandler(b)
+			})
+			if err != nil {
+				c.writeError(StatusInternalError, err)
+				return err
+			}
+			if handlerErr != nil {
+				err = fmt.Errorf("rejected ping: %w", handlerErr)
+				c.writeError(StatusPolicyViolation, err)
+				return err
+			}
+		}
+		ok, err := c.allowPing()
+		if !ok {
+			return err
 		}
 		return c.writeControl(ctx, opPong, b)
 	case opPong:
 		c.activePingsMu.Lock()
+		defer c.activePingsMu.Unlock()
+
 		pong, ok := c.activePings[string(b)]
-		c.activePingsMu.Unlock()
 		if ok {
+			// A nil payload means the pong matched the ping.
+			select {
+			case pong <- nil:
+			default:
+			}
+			return nil
+		}
+		for pong := range c.anyPongs {
 			select {
-			case pong <- struct{}{}:
+			case pong <- append([]byte(nil), b...):
 			default:
 			}
 		}
@@ -315,7 +1148,18 @@ func (c *Conn) handleControl(ctx context.Context, h header) (err error) {
 		c.readCloseFrameErr = err
 	}()
 
-	ce, err := parseClosePayload(b)
+	c.closeMu.Lock()
+	c.rawCloseFrame = append([]byte{}, b...)
+	c.closeMu.Unlock()
+
+	var ce CloseError
+	panicErr := recoverCallback("close decoder", func() {
+		ce, err = c.decodeClose(b)
+	})
+	if panicErr != nil {
+		c.writeError(StatusInternalError, panicErr)
+		return panicErr
+	}
 	if err != nil {
 		err = fmt.Errorf("received invalid close payload: %w", err)
 		c.writeError(StatusProtocolError, err)
@@ -324,13 +1168,24 @@ func (c *Conn) handleControl(ctx context.Context, h header) (err error) {
 
 	err = fmt.Errorf("received close frame: %w", ce)
 	c.setCloseErr(err)
-	c.writeClose(ce.Code, ce.Reason)
+	if c.closeEchoPolicy == CloseEchoNormal {
+		c.writeClose(StatusNormalClosure, "")
+	} else {
+		c.writeClose(ce.Code, ce.Reason)
+	}
 	c.close(err)
 	return err
 }
 
 func (c *Conn) reader(ctx context.Context) (_ MessageType, _ io.Reader, err error) {
 	defer errd.Wrap(&err, "failed to get reader")
+	defer func() {
+		// After the timeout the read may still fail otherwise, e.g. with
+		// the peer's response to the close frame written by the timeoutLoop.
+		if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			err = deadlineExceededError{err}
+		}
+	}()
 
 	err = c.readMu.lock(ctx)
 	if err != nil {
@@ -344,6 +1199,11 @@ func (c *Conn) reader(ctx context.Context) (_ MessageType, _ io.Reader, err erro
 		return 0, nil, err
 	}
 
+	err = c.waitReadMessageRate(ctx)
+	if err != nil {
+		return 0, nil, err
+	}
+
 	h, err := c.readLoop(ctx)
 	if err != nil {
 		return 0, nil, err
@@ -356,10 +1216,47 @@ func (c *Conn) reader(ctx context.Context) (_ MessageType, _ io.Reader, err erro
 	}
 
 	c.msgReader.reset(ctx, h)
+	if !h.fin {
+		err = c.msgReader.startAssembly()
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+	err = c.msgReader.decodeExtensionFrame(h)
+	if err != nil {
+		return 0, nil, err
+	}
+	if c.prefetch == nil {
+		c.lastReadCompressed = h.rsv1
+	}
 
 	return MessageType(h.opcode), c.msgReader, nil
 }
 
+// rawReader is like reader but a compressed message is read as sent by the
+// peer, without the trailing 4 bytes of the deflate stream, instead of being
+// decompressed. It reports whether the message is compressed.
+// UTF-8 is not validated and the read limit applies to the compressed payload.
+func (c *Conn) rawReader(ctx context.Context) (_ MessageType, compressed bool, _ io.Reader, _ error) {
+	typ, r, err := c.reader(ctx)
+	if err != nil || !c.msgReader.flate {
+		return typ, false, r, err
+	}
+
+	mr := c.msgReader
+	mr.raw = true
+	mr.putFlateReader()
+	mr.limitReader.r = mr.readFunc
+	return typ, true, r, nil
+}
+
+// LastReadCompressed reports whether the peer compressed the last data
+// message returned by Reader or Read. It does not change until the next
+// message is returned.
+func (c *Conn) LastReadCompressed() bool {
+	return c.lastReadCompressed
+}
+
 type msgReader struct {
 	c *Conn
 
@@ -374,6 +1271,40 @@ type msgReader struct {
 	fin           bool
 	payloadLength int64
 	maskKey       uint32
+	// extBuf is the unread payload of the current frame as decoded by
+	// the extension codecs.
+	extBuf []byte
+
+	fragments    int64
+	maxFragments xsync.Int64
+	// expectedSize is the capacity preallocated by Read.
+	expectedSize xsync.Int64
+	// progress is the payload length of the frames of the message so far.
+	progress         int64
+	frameReported    bool
+	progressCallback func(bytesSoFar int64, fin bool)
+	// seq is the sequence number of the current message.
+	seq uint64
+
+	// typ, start and n describe the current message for msgCallback.
+	typ         MessageType
+	start       time.Time
+	n           int
+	msgReported bool
+	msgCallback func(typ MessageType, n int, dur time.Duration)
+
+	maxDecompressionRatio float64
+	// assembling is whether the assembly timeout of the message is running.
+	assembling bool
+
+	// raw is whether the compressed message is read without being
+	// decompressed. See rawReader.
+	raw bool
+
+	text               bool
+	skipUTF8Validation bool
+	utf8               utf8Validator
+	utf8Func           func(p []byte, last bool) bool
 
 	// util.ReaderFunc(mr.Read) to avoid continuous allocations.
 	readFunc util.ReaderFunc
@@ -382,6 +1313,18 @@ type msgReader struct {
 func (mr *msgReader) reset(ctx context.Context, h header) {
 	mr.ctx = ctx
 	mr.flate = h.rsv1
+	mr.fragments = 1
+	mr.progress = 0
+	mr.seq++
+	mr.typ = MessageType(h.opcode)
+	mr.n = 0
+	mr.msgReported = false
+	if mr.msgCallback != nil {
+		mr.start = time.Now()
+	}
+	mr.text = h.opcode == opText
+	mr.raw = false
+	mr.utf8.reset()
 	mr.limitReader.reset(mr.readFunc)
 
 	if mr.flate {
@@ -395,6 +1338,8 @@ func (mr *msgReader) setFrame(h header) {
 	mr.fin = h.fin
 	mr.payloadLength = h.payloadLength
 	mr.maskKey = h.maskKey
+	mr.progress += h.payloadLength
+	mr.frameReported = false
 }
 
 func (mr *msgReader) Read(p []byte) (n int, err error) {
@@ -405,12 +1350,35 @@ func (mr *msgReader) Read(p []byte) (n int, err error) {
 	defer mr.c.readMu.unlock()
 
 	n, err = mr.limitReader.Read(p)
+	mr.n += n
+	if mr.flate && mr.maxDecompressionRatio > 0 && mr.n > minDecompressionRatioCheck {
+		compressed := mr.progress - mr.payloadLength - int64(len(mr.extBuf))
+		if float64(mr.n) > mr.maxDecompressionRatio*float64(compressed) {
+			rerr := fmt.Errorf("message decompressed to more than %v times its compressed size", mr.maxDecompressionRatio)
+			mr.c.writeError(StatusMessageTooBig, rerr)
+			return n, fmt.Errorf("failed to read: %w", rerr)
+		}
+	}
 	if mr.flate && mr.flateContextTakeover() {
 		p = p[:n]
 		mr.dict.write(p)
 	}
-	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) && mr.fin && mr.flate {
+	eof := errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) && mr.fin && mr.flate
+	if mr.text && !mr.skipUTF8Validation && !mr.raw {
+		valid, verr := mr.validUTF8(p[:n], eof)
+		if verr != nil {
+			return n, verr
+		}
+		if !valid {
+			return n, mr.invalidUTF8()
+		}
+	}
+	if eof {
 		mr.putFlateReader()
+		err = mr.reportMessage()
+		if err != nil {
+			return n, err
+		}
 		return n, io.EOF
 	}
 	if err != nil {
@@ -420,11 +1388,71 @@ func (mr *msgReader) Read(p []byte) (n int, err error) {
 	return n, err
 }
 
+// reportMessage calls msgCallback once the message has been read.
+func (mr *msgReader) reportMessage() error {
+	if mr.msgCallback == nil || mr.msgReported {
+		return nil
+	}
+	mr.msgReported = true
+
+	dur := time.Since(mr.start)
+	err := recoverCallback("message read callback", func() {
+		mr.msgCallback(mr.typ, mr.n, dur)
+	})
+	if err != nil {
+		mr.c.writeError(StatusInternalError, err)
+		return fmt.Errorf("failed to read: %w", err)
+	}
+	return nil
+}
+
+// validUTF8 validates the next bytes p of the text message being read with
+// the validator set with SetUTF8Validator or utf8 by default.
+func (mr *msgReader) validUTF8(p []byte, last bool) (bool, error) {
+	if mr.utf8Func == nil {
+		return mr.utf8.write(p) && (!last || mr.utf8.done()), nil
+	}
+
+	var valid bool
+	err := recoverCallback("UTF-8 validator", func() {
+		valid = mr.utf8Func(p, last)
+	})
+	if err != nil {
+		mr.c.writeError(StatusInternalError, err)
+		return false, fmt.Errorf("failed to read: %w", err)
+	}
+	return valid, nil
+}
+
+func (mr *msgReader) invalidUTF8() error {
+	err := errors.New("received invalid UTF-8 in text message")
+	mr.c.writeError(StatusInvalidFramePayloadData, err)
+	return fmt.Errorf("failed to read: %w", err)
+}
+
 func (mr *msgReader) read(p []byte) (int, error) {
 	for {
+		if len(mr.extBuf) > 0 {
+			n := copy(p, mr.extBuf)
+			mr.extBuf = mr.extBuf[n:]
+			return n, nil
+		}
+
 		if mr.payloadLength == 0 {
+			if !mr.frameReported {
+				mr.frameReported = true
+				if mr.progressCallback != nil {
+					err := recoverCallback("read progress callback", func() {
+						mr.progressCallback(mr.progress, mr.fin)
+					})
+					if err != nil {
+						mr.c.writeError(StatusInternalError, err)
+						return 0, err
+					}
+				}
+			}
 			if mr.fin {
-				if mr.flate {
+				if mr.flate && !mr.raw {
 					return mr.flateTail.Read(p)
 				}
 				return 0, io.EOF
@@ -439,7 +1467,25 @@ func (mr *msgReader) read(p []byte) (int, error) {
 				mr.c.writeError(StatusProtocolError, err)
 				return 0, err
 			}
+
+			mr.fragments++
+			maxFragments := mr.maxFragments.Load()
+			if maxFragments > 0 && mr.fragments > maxFragments {
+				err := fmt.Errorf("message fragmented into more than %v frames", maxFragments)
+				mr.c.writeError(StatusPolicyViolation, err)
+				return 0, err
+			}
 			mr.setFrame(h)
+			if h.fin && mr.assembling {
+				err = mr.stopAssembly()
+				if err != nil {
+					return 0, err
+				}
+			}
+			err = mr.decodeExtensionFrame(h)
+			if err != nil {
+				return 0, err
+			}
 
 			continue
 		}
@@ -505,3 +1551,56 @@ func (lr *limitReader) Read(p []byte) (int, error) {
 	}
 	return n, err
 }
+
+// utf8Validator incrementally validates UTF-8 that may be split
+// at arbitrary byte boundaries.
+type utf8Validator struct {
+	// tail holds the bytes of a rune split across writes.
+	tail    [utf8.UTFMax]byte
+	tailLen int
+}
+
+func (v *utf8Validator) reset() {
+	v.tailLen = 0
+}
+
+// write reports whether p is valid UTF-8 as a continuation of the
+// bytes previously written.
+func (v *utf8Validator) write(p []byte) bool {
+	if v.tailLen > 0 {
+		n := copy(v.tail[v.tailLen:], p)
+		buf := v.tail[:v.tailLen+n]
+		r, size := utf8.DecodeRune(buf)
+		if r == utf8.RuneError && size == 1 {
+			if utf8.FullRune(buf) {
+				return false
+			}
+			// All of p is part of the still incomplete rune.
+			v.tailLen = len(buf)
+			return true
+		}
+		p = p[size-v.tailLen:]
+		v.tailLen = 0
+	}
+
+	// Hold back a trailing incomplete rune until the next write.
+	end := len(p)
+	for i := len(p) - 1; i >= 0 && i >= len(p)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(p[i]) {
+			if !utf8.FullRune(p[i:]) {
+				end = i
+			}
+			break
+		}
+	}
+	if !utf8.Valid(p[:end]) {
+		return false
+	}
+	v.tailLen = copy(v.tail[:], p[end:])
+	return true
+}
+
+// done reports whether the bytes written ended on a rune boundary.
+func (v *utf8Validator) done() bool {
+	return v.tailLen == 0
+}
@@ -0,0 +1,958 @@
+//go:build !js
+// +build !js
+
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"nhooyr.io/websocket/internal/test/assert"
+	"nhooyr.io/websocket/internal/xsync"
+)
+
+// newRawConnPair returns a client and server Conn connected with net.Pipe
+// so that tests can write arbitrary frames with writeFrame.
+func newRawConnPair(t *testing.T) (ctx context.Context, client, server *Conn) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	t.Cleanup(cancel)
+
+	cc, sc := net.Pipe()
+	client = newConn(connConfig{
+		rwc:    cc,
+		client: true,
+		br:     getBufioReader(cc),
+		bw:     getBufioWriter(cc),
+	})
+	server = newConn(connConfig{
+		rwc: sc,
+		br:  bufio.NewReader(sc),
+		bw:  bufio.NewWriter(sc),
+	})
+	t.Cleanup(func() {
+		client.CloseNow()
+		server.CloseNow()
+	})
+	return ctx, client, server
+}
+
+func TestUnexpectedFrames(t *testing.T) {
+	t.Parallel()
+
+	t.Run("continuationWithoutMessage", func(t *testing.T) {
+		t.Parallel()
+
+		ctx, client, server := newRawConnPair(t)
+
+		errs := xsync.Go(func() error {
+			_, err := client.writeFrame(ctx, true, false, opContinuation, []byte("x"))
+			if err != nil {
+				return err
+			}
+			_, _, err = client.Reader(ctx)
+			if CloseStatus(err) != StatusProtocolError {
+				return err
+			}
+			return nil
+		})
+
+		_, _, err := server.Reader(ctx)
+		assert.Contains(t, err, "received continuation frame without text or binary frame")
+		assert.Success(t, <-errs)
+	})
+
+	t.Run("newMessageBeforeFin", func(t *testing.T) {
+		t.Parallel()
+
+		ctx, client, server := newRawConnPair(t)
+
+		errs := xsync.Go(func() error {
+			_, err := client.writeFrame(ctx, false, false, opText, []byte("a"))
+			if err != nil {
+				return err
+			}
+			_, err = client.writeFrame(ctx, true, false, opBinary, []byte("b"))
+			if err != nil {
+				return err
+			}
+			_, _, err = client.Reader(ctx)
+			if CloseStatus(err) != StatusProtocolError {
+				return err
+			}
+			return nil
+		})
+
+		_, r, err := server.Reader(ctx)
+		assert.Success(t, err)
+		_, err = io.ReadAll(r)
+		assert.Contains(t, err, "received new data message without finishing the previous message")
+		assert.Success(t, <-errs)
+	})
+}
+
+func TestPingEcho(t *testing.T) {
+	t.Parallel()
+
+	t.Run("conformant", func(t *testing.T) {
+		t.Parallel()
+
+		ctx, client, server := newRawConnPair(t)
+		client.CloseRead(ctx)
+		server.CloseRead(ctx)
+
+		pong, err := client.PingEcho(ctx, []byte("meow"))
+		assert.Success(t, err)
+		assert.Equal(t, "pong", "meow", string(pong))
+	})
+
+	t.Run("nonConformant", func(t *testing.T) {
+		t.Parallel()
+
+		ctx, client, server := newRawConnPair(t)
+		server.SetPingCallback(func() {
+			server.writeFrame(ctx, true, false, opPong, []byte("woof"))
+		})
+		client.CloseRead(ctx)
+		server.CloseRead(ctx)
+
+		pong, err := client.PingEcho(ctx, []byte("meow"))
+		assert.Success(t, err)
+		assert.Equal(t, "pong", "woof", string(pong))
+	})
+
+	t.Run("bigPayload", func(t *testing.T) {
+		t.Parallel()
+
+		ctx, client, _ := newRawConnPair(t)
+
+		_, err := client.PingEcho(ctx, make([]byte, maxControlPayload+1))
+		assert.Contains(t, err, "payload max is 125")
+	})
+}
+
+func TestHealthy(t *testing.T) {
+	t.Parallel()
+
+	ctx, client, server := newRawConnPair(t)
+	// Only the first ping of the second is answered.
+	server.SetPingRateLimit(1)
+	client.CloseRead(ctx)
+	server.CloseRead(ctx)
+
+	assert.Equal(t, "healthy", true, client.Healthy(ctx, time.Second))
+	assert.Equal(t, "healthy", false, client.Healthy(ctx, time.Millisecond*50))
+	assert.Equal(t, "closed", false, client.IsClosed())
+}
+
+func TestHealthyStalledWrite(t *testing.T) {
+	t.Parallel()
+
+	ctx, client, server := newRawConnPair(t)
+	server.SetReadLimit(1 << 21)
+
+	// The server does not read yet so the write holds the frame lock.
+	msg := make([]byte, 1<<20)
+	werr := xsync.Go(func() error {
+		return client.Write(ctx, MessageBinary, msg)
+	})
+	time.Sleep(time.Millisecond * 10)
+
+	assert.Equal(t, "healthy", false, client.Healthy(ctx, time.Millisecond*50))
+	assert.Equal(t, "closed", false, client.IsClosed())
+
+	_, p, err := server.Read(ctx)
+	assert.Success(t, err)
+	assert.Equal(t, "msg", len(msg), len(p))
+	assert.Success(t, <-werr)
+}
+
+func TestHealthyBufferedWriter(t *testing.T) {
+	t.Parallel()
+
+	ctx, client, _ := newRawConnPair(t)
+
+	// The frame is buffered until the Writer is flushed or closed.
+	w, err := client.Writer(ctx, MessageBinary)
+	assert.Success(t, err)
+	_, err = w.Write([]byte("meow"))
+	assert.Success(t, err)
+	assert.Equal(t, "pending", true, client.PendingWriteBytes() > 0)
+
+	// Nothing reads the ping so writing it times out. Discarding it would
+	// discard the frame of the Writer too.
+	assert.Equal(t, "healthy", false, client.Healthy(ctx, time.Millisecond*50))
+	assert.Equal(t, "closed", true, client.IsClosed())
+}
+
+func TestDeadPeerDetectionStalledWrite(t *testing.T) {
+	t.Parallel()
+
+	ctx, client, server := newRawConnPair(t)
+	server.SetReadLimit(1 << 21)
+	client.CloseRead(ctx)
+
+	// The server does not read yet so the write holds the frame lock and a
+	// ping is missed.
+	msg := make([]byte, 1<<20)
+	werr := xsync.Go(func() error {
+		return client.Write(ctx, MessageBinary, msg)
+	})
+	client.SetDeadPeerDetection(time.Millisecond*20, time.Millisecond*20, 100)
+	time.Sleep(time.Millisecond * 50)
+
+	_, p, err := server.Read(ctx)
+	assert.Success(t, err)
+	assert.Equal(t, "msg", len(msg), len(p))
+	assert.Success(t, <-werr)
+
+	server.CloseRead(ctx)
+	time.Sleep(time.Millisecond * 100)
+	assert.Equal(t, "closed", false, client.IsClosed())
+}
+
+func TestSetPingHandler(t *testing.T) {
+	t.Parallel()
+
+	ctx, client, server := newRawConnPair(t)
+	server.SetPingHandler(func(payload []byte) error {
+		if string(payload) != "token" {
+			return errors.New("invalid token")
+		}
+		return nil
+	})
+	client.CloseRead(ctx)
+
+	errs := xsync.Go(func() error {
+		_, _, err := server.Read(ctx)
+		return err
+	})
+
+	_, err := client.PingEcho(ctx, []byte("token"))
+	assert.Success(t, err)
+
+	_, err = client.PingEcho(ctx, []byte("meow"))
+	assert.Error(t, err)
+	err = <-errs
+	assert.Contains(t, err, "rejected ping: invalid token")
+}
+
+func TestRawCloseFrame(t *testing.T) {
+	t.Parallel()
+
+	ctx, client, server := newRawConnPair(t)
+
+	errs := xsync.Go(func() error {
+		_, err := client.writeFrame(ctx, true, false, opClose, []byte{0x03})
+		if err != nil {
+			return err
+		}
+		_, _, err = client.Reader(ctx)
+		if CloseStatus(err) != StatusProtocolError {
+			return err
+		}
+		return nil
+	})
+
+	assert.Equal(t, "raw close frame", []byte(nil), server.RawCloseFrame())
+
+	_, _, err := server.Reader(ctx)
+	assert.Contains(t, err, "received invalid close payload")
+	assert.Success(t, <-errs)
+	assert.Equal(t, "raw close frame", []byte{0x03}, server.RawCloseFrame())
+}
+
+func TestAbnormalClosure(t *testing.T) {
+	t.Parallel()
+
+	ctx, client, server := newRawConnPair(t)
+
+	// Drop the connection without a close handshake.
+	server.rwc.Close()
+
+	_, _, err := client.Reader(ctx)
+	assert.ErrorIs(t, ErrAbnormalClosure, err)
+	assert.ErrorIs(t, io.EOF, err)
+
+	err = client.Write(ctx, MessageText, []byte("x"))
+	assert.Error(t, err)
+}
+
+func TestPingRateLimit(t *testing.T) {
+	t.Parallel()
+
+	ctx, client, server := newRawConnPair(t)
+	server.SetPingRateLimit(3)
+
+	pongs := make(chan []byte, 10)
+	client.activePingsMu.Lock()
+	client.anyPongs[pongs] = struct{}{}
+	client.activePingsMu.Unlock()
+
+	clientCtx := client.CloseRead(ctx)
+	server.CloseRead(ctx)
+
+	for i := 0; i < 5; i++ {
+		_, err := client.writeFrame(ctx, true, false, opPing, []byte{byte(i)})
+		assert.Success(t, err)
+	}
+
+	for i := 0; i < 3; i++ {
+		select {
+		case p := <-pongs:
+			assert.Equal(t, "pong", []byte{byte(i)}, p)
+		case <-ctx.Done():
+			t.Fatal(ctx.Err())
+		}
+	}
+
+	// The flood closes the connection.
+	_, err := client.writeFrame(ctx, true, false, opPing, []byte{5})
+	assert.Success(t, err)
+	_, err = client.writeFrame(ctx, true, false, opPing, []byte{6})
+	assert.Success(t, err)
+
+	select {
+	case <-clientCtx.Done():
+	case <-ctx.Done():
+		t.Fatal(ctx.Err())
+	}
+	assert.Equal(t, "pongs", 0, len(pongs))
+	client.closeMu.Lock()
+	defer client.closeMu.Unlock()
+	assert.Equal(t, "close status", StatusPolicyViolation, CloseStatus(client.closeErr))
+}
+
+type nopCloserRW struct {
+	io.Reader
+	io.Writer
+}
+
+func (nopCloserRW) Close() error {
+	return nil
+}
+
+func TestReadBatch(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	// Frame the messages up front so that they are all buffered.
+	var frames bytes.Buffer
+	w := nopCloserRW{Writer: &frames}
+	client := newConn(connConfig{
+		rwc:    w,
+		client: true,
+		br:     bufio.NewReader(w),
+		bw:     bufio.NewWriter(w),
+	})
+	defer client.CloseNow()
+	for _, msg := range []string{"a", "b", "c"} {
+		err := client.Write(ctx, MessageText, []byte(msg))
+		assert.Success(t, err)
+	}
+	_, err := client.writeFrame(ctx, true, false, opPing, nil)
+	assert.Success(t, err)
+	frames.Write([]byte{0x81})
+
+	r := nopCloserRW{Reader: &frames, Writer: io.Discard}
+	server := newConn(connConfig{
+		rwc: r,
+		br:  bufio.NewReader(r),
+		bw:  bufio.NewWriter(r),
+	})
+	defer server.CloseNow()
+
+	_, err = server.ReadBatch(ctx, 0)
+	assert.Contains(t, err, "invalid max 0")
+
+	msgs, err := server.ReadBatch(ctx, 2)
+	assert.Success(t, err)
+	assert.Equal(t, "msgs", 2, len(msgs))
+	assert.Equal(t, "msg", "b", string(msgs[1].Data))
+
+	// The ping and the partial frame after the last message are not read.
+	msgs, err = server.ReadBatch(ctx, 10)
+	assert.Success(t, err)
+	assert.Equal(t, "msgs", 1, len(msgs))
+	assert.Equal(t, "msg", "c", string(msgs[0].Data))
+}
+
+func TestReadBatchDropEmptyMessages(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	var frames bytes.Buffer
+	w := nopCloserRW{Writer: &frames}
+	client := newConn(connConfig{
+		rwc:    w,
+		client: true,
+		br:     bufio.NewReader(w),
+		bw:     bufio.NewWriter(w),
+	})
+	defer client.CloseNow()
+	for _, msg := range []string{"", "a", "", "b"} {
+		err := client.Write(ctx, MessageText, []byte(msg))
+		assert.Success(t, err)
+	}
+
+	r := nopCloserRW{Reader: &frames, Writer: io.Discard}
+	server := newConn(connConfig{
+		rwc: r,
+		br:  bufio.NewReader(r),
+		bw:  bufio.NewWriter(r),
+	})
+	defer server.CloseNow()
+	server.SetDropEmptyMessages(true)
+
+	msgs, err := server.ReadBatch(ctx, 10)
+	assert.Success(t, err)
+	assert.Equal(t, "msgs", 2, len(msgs))
+	assert.Equal(t, "msg", "a", string(msgs[0].Data))
+	assert.Equal(t, "msg", "b", string(msgs[1].Data))
+}
+
+func TestSetExpectedMessageSize(t *testing.T) {
+	t.Parallel()
+
+	ctx, client, server := newRawConnPair(t)
+	server.SetExpectedMessageSize(64)
+
+	for _, n := range []int{64, 10, 1000} {
+		p := bytes.Repeat([]byte{'x'}, n)
+		errs := xsync.Go(func() error {
+			return client.Write(ctx, MessageBinary, p)
+		})
+		_, b, err := server.Read(ctx)
+		assert.Success(t, err)
+		assert.Success(t, <-errs)
+		assert.Equal(t, "msg", p, b)
+		if n <= 64 {
+			assert.Equal(t, "cap", 64, cap(b))
+		}
+	}
+
+	errs := xsync.Go(func() error {
+		return client.Write(ctx, MessageBinary, []byte("meow"))
+	})
+	m, err := server.ReadMessage(ctx)
+	assert.Success(t, err)
+	assert.Success(t, <-errs)
+	assert.Equal(t, "msg", "meow", string(m.Data))
+	assert.Equal(t, "cap", 64, cap(m.Data))
+
+	// The preallocation is capped at the read limit.
+	server.SetReadLimit(16)
+	assert.Equal(t, "expected size", int64(17), server.expectedReadSize())
+}
+
+func TestRecorder(t *testing.T) {
+	t.Parallel()
+
+	ctx, client, server := newRawConnPair(t)
+
+	var rec bytes.Buffer
+	assert.Success(t, server.SetRecorder(&rec))
+
+	errs := xsync.Go(func() error {
+		for _, msg := range []string{"a", "b"} {
+			err := client.Write(ctx, MessageText, []byte(msg))
+			if err != nil {
+				return err
+			}
+		}
+		_, _, err := client.Read(ctx)
+		return err
+	})
+	for _, msg := range []string{"a", "b"} {
+		_, b, err := server.Read(ctx)
+		assert.Success(t, err)
+		assert.Equal(t, "msg", msg, string(b))
+	}
+	err := server.Write(ctx, MessageText, []byte("c"))
+	assert.Success(t, err)
+	assert.Success(t, <-errs)
+
+	replay := NewReplayConn(&rec, false, CompressionDisabled)
+	defer replay.CloseNow()
+	for _, msg := range []string{"a", "b"} {
+		_, b, err := replay.Read(ctx)
+		assert.Success(t, err)
+		assert.Equal(t, "msg", msg, string(b))
+	}
+	err = replay.Write(ctx, MessageText, []byte("c"))
+	assert.Success(t, err)
+	_, _, err = replay.Read(ctx)
+	assert.ErrorIs(t, io.EOF, err)
+}
+
+func TestReadProgressCallback(t *testing.T) {
+	t.Parallel()
+
+	ctx, client, server := newRawConnPair(t)
+
+	type progress struct {
+		n   int64
+		fin bool
+	}
+	var got []progress
+	server.SetReadProgressCallback(func(n int64, fin bool) {
+		got = append(got, progress{n, fin})
+	})
+
+	errs := xsync.Go(func() error {
+		_, err := client.writeFrame(ctx, false, false, opBinary, []byte("ab"))
+		if err != nil {
+			return err
+		}
+		_, err = client.writeFrame(ctx, false, false, opContinuation, nil)
+		if err != nil {
+			return err
+		}
+		_, err = client.writeFrame(ctx, true, false, opContinuation, []byte("cde"))
+		return err
+	})
+
+	_, b, err := server.Read(ctx)
+	assert.Success(t, err)
+	assert.Success(t, <-errs)
+	assert.Equal(t, "msg", "abcde", string(b))
+	assert.Equal(t, "progress", []progress{{2, false}, {2, false}, {5, true}}, got)
+}
+
+func TestSetMessageReadCallback(t *testing.T) {
+	t.Parallel()
+
+	ctx, client, server := newRawConnPair(t)
+
+	var types []MessageType
+	var sizes []int
+	server.SetMessageReadCallback(func(typ MessageType, n int, dur time.Duration) {
+		types = append(types, typ)
+		sizes = append(sizes, n)
+		assert.Equal(t, "non negative", true, dur >= 0)
+	})
+
+	errs := xsync.Go(func() error {
+		err := client.Write(ctx, MessageText, []byte("meow"))
+		if err != nil {
+			return err
+		}
+		return client.Write(ctx, MessageBinary, nil)
+	})
+
+	for i := 0; i < 2; i++ {
+		_, _, err := server.Read(ctx)
+		assert.Success(t, err)
+	}
+	assert.Success(t, <-errs)
+	assert.Equal(t, "types", []MessageType{MessageText, MessageBinary}, types)
+	assert.Equal(t, "sizes", []int{4, 0}, sizes)
+}
+
+func TestSetUTF8Validator(t *testing.T) {
+	t.Parallel()
+
+	ctx, client, server := newRawConnPair(t)
+
+	var got []byte
+	var lasts int
+	server.SetUTF8Validator(func(p []byte, last bool) bool {
+		got = append(got, p...)
+		if last {
+			lasts++
+		}
+		return !bytes.Contains(p, []byte("woof"))
+	})
+
+	errs := xsync.Go(func() error {
+		err := client.Write(ctx, MessageText, []byte("meow"))
+		if err != nil {
+			return err
+		}
+		err = client.Write(ctx, MessageText, []byte("woof"))
+		if err != nil {
+			return err
+		}
+		_, _, err = client.Read(ctx)
+		if CloseStatus(err) != StatusInvalidFramePayloadData {
+			return fmt.Errorf("unexpected close error: %w", err)
+		}
+		return nil
+	})
+
+	_, b, err := server.Read(ctx)
+	assert.Success(t, err)
+	assert.Equal(t, "msg", "meow", string(b))
+	assert.Equal(t, "validated", "meow", string(got))
+	assert.Equal(t, "lasts", 1, lasts)
+
+	_, _, err = server.Read(ctx)
+	assert.Contains(t, err, "invalid UTF-8")
+	assert.Success(t, <-errs)
+}
+
+func TestReadDeadlineExceeded(t *testing.T) {
+	t.Parallel()
+
+	ctx, client, server := newRawConnPair(t)
+	// Responds to the close frame written on the timeout.
+	errs := xsync.Go(func() error {
+		_, _, err := client.Read(ctx)
+		if CloseStatus(err) != StatusPolicyViolation {
+			return err
+		}
+		return nil
+	})
+
+	readCtx, cancel := context.WithTimeout(ctx, time.Millisecond*10)
+	defer cancel()
+	_, _, err := server.Read(readCtx)
+	assert.ErrorIs(t, os.ErrDeadlineExceeded, err)
+	assert.ErrorIs(t, context.DeadlineExceeded, err)
+	if status := CloseStatus(err); status != -1 {
+		assert.Equal(t, "close status", StatusPolicyViolation, status)
+	}
+	assert.Success(t, <-errs)
+}
+
+func TestSetReadMessageRateLimit(t *testing.T) {
+	t.Parallel()
+
+	ctx, client, server := newRawConnPair(t)
+	server.SetReadMessageRateLimit(20)
+
+	errs := xsync.Go(func() error {
+		for i := 0; i < 3; i++ {
+			err := client.Write(ctx, MessageText, []byte("meow"))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		_, _, err := server.Read(ctx)
+		assert.Success(t, err)
+	}
+	// The first message is not delayed.
+	if d := time.Since(start); d < time.Millisecond*100 {
+		t.Fatalf("expected the reads to take at least 100ms but took %v", d)
+	}
+	assert.Success(t, <-errs)
+}
+
+func TestEmptyMessages(t *testing.T) {
+	t.Parallel()
+
+	ctx, client, server := newRawConnPair(t)
+
+	errs := xsync.Go(func() error {
+		for _, p := range []string{"", "", "meow"} {
+			err := client.Write(ctx, MessageText, []byte(p))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	_, b, err := server.Read(ctx)
+	assert.Success(t, err)
+	assert.Equal(t, "non nil", true, b != nil)
+	assert.Equal(t, "len", 0, len(b))
+
+	server.SetDropEmptyMessages(true)
+	_, b, err = server.Read(ctx)
+	assert.Success(t, err)
+	assert.Equal(t, "msg", "meow", string(b))
+	assert.Success(t, <-errs)
+}
+
+func TestReadOfType(t *testing.T) {
+	t.Parallel()
+
+	ctx, client, server := newRawConnPair(t)
+
+	errs := xsync.Go(func() error {
+		err := client.Write(ctx, MessageText, []byte("noise"))
+		if err != nil {
+			return err
+		}
+		err = client.Write(ctx, MessageBinary, []byte("meow"))
+		if err != nil {
+			return err
+		}
+		err = client.Write(ctx, MessageText, []byte("noise"))
+		if err != nil {
+			return err
+		}
+		return client.Close(StatusGoingAway, "bye")
+	})
+
+	b, err := server.ReadOfType(ctx, MessageBinary)
+	assert.Success(t, err)
+	assert.Equal(t, "msg", "meow", string(b))
+
+	_, err = server.ReadOfType(ctx, MessageBinary)
+	assert.Equal(t, "close status", StatusGoingAway, CloseStatus(err))
+	assert.Success(t, <-errs)
+}
+
+func TestSetTimeoutsEnabled(t *testing.T) {
+	t.Parallel()
+
+	ctx, client, server := newRawConnPair(t)
+	server.SetTimeoutsEnabled(false)
+
+	errs := xsync.Go(func() error {
+		time.Sleep(time.Millisecond * 50)
+		return client.Write(ctx, MessageText, []byte("meow"))
+	})
+
+	readCtx, cancel := context.WithTimeout(ctx, time.Millisecond*10)
+	defer cancel()
+	_, b, err := server.Read(readCtx)
+	assert.Success(t, err)
+	assert.Equal(t, "msg", "meow", string(b))
+	assert.Success(t, <-errs)
+}
+
+func TestReadAvailable(t *testing.T) {
+	t.Parallel()
+
+	ctx, client, server := newRawConnPair(t)
+
+	flushed := make(chan struct{})
+	errs := xsync.Go(func() error {
+		w, err := client.Writer(ctx, MessageText)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write([]byte("hello"))
+		if err != nil {
+			return err
+		}
+		err = w.(interface{ Flush() error }).Flush()
+		if err != nil {
+			return err
+		}
+		<-flushed
+		_, err = w.Write([]byte(" world"))
+		if err != nil {
+			return err
+		}
+		return w.Close()
+	})
+
+	typ, p, complete, err := server.ReadAvailable(ctx, time.Millisecond*50)
+	assert.Success(t, err)
+	assert.Equal(t, "type", MessageText, typ)
+	assert.Equal(t, "complete", false, complete)
+	assert.Equal(t, "partial", "hello", string(p))
+	close(flushed)
+
+	var rest []byte
+	for !complete {
+		_, p, complete, err = server.ReadAvailable(ctx, time.Millisecond*50)
+		assert.Success(t, err)
+		rest = append(rest, p...)
+	}
+	assert.Equal(t, "rest", " world", string(rest))
+	assert.Success(t, <-errs)
+}
+
+func TestSetMessageAssemblyTimeout(t *testing.T) {
+	t.Parallel()
+
+	ctx, client, server := newRawConnPair(t)
+	server.SetMessageAssemblyTimeout(time.Millisecond * 100)
+
+	errs := xsync.Go(func() error {
+		_, p, err := server.Read(ctx)
+		if err != nil {
+			return err
+		}
+		assert.Equal(t, "msg", "fragmented", string(p))
+
+		_, _, err = server.Read(ctx)
+		return err
+	})
+
+	_, err := client.writeFrame(ctx, false, false, opText, []byte("frag"))
+	assert.Success(t, err)
+	_, err = client.writeFrame(ctx, true, false, opContinuation, []byte("mented"))
+	assert.Success(t, err)
+
+	w, err := client.Writer(ctx, MessageText)
+	assert.Success(t, err)
+	_, err = w.Write([]byte("dribbled"))
+	assert.Success(t, err)
+	err = w.(interface{ Flush() error }).Flush()
+	assert.Success(t, err)
+
+	_, _, err = client.Read(ctx)
+	assert.Equal(t, "close status", StatusPolicyViolation, CloseStatus(err))
+	err = <-errs
+	assert.Error(t, err)
+
+	server.closeMu.Lock()
+	err = server.closeErr
+	server.closeMu.Unlock()
+	assert.Contains(t, err, "message assembly timed out")
+}
+
+func TestSetReadPriority(t *testing.T) {
+	t.Parallel()
+
+	ctx, client, server := newRawConnPair(t)
+	server.SetReadPriority(func(typ MessageType, p []byte) int {
+		if typ == MessageText {
+			return 1
+		}
+		return 0
+	})
+	server.SetPrefetch(true)
+	client.CloseRead(ctx)
+
+	for i := 0; i < 2; i++ {
+		err := client.Write(ctx, MessageBinary, []byte{byte(i)})
+		assert.Success(t, err)
+	}
+	for i := 0; i < maxPriorityBypass+1; i++ {
+		err := client.Write(ctx, MessageText, []byte{byte(i)})
+		assert.Success(t, err)
+	}
+	// Once the pong is received every message has been queued.
+	err := client.Ping(ctx)
+	assert.Success(t, err)
+
+	var got []string
+	for i := 0; i < maxPriorityBypass+3; i++ {
+		typ, p, err := server.Read(ctx)
+		assert.Success(t, err)
+		got = append(got, fmt.Sprintf("%v%v", typ, p))
+	}
+	assert.Equal(t, "messages", []string{
+		"MessageText[0]", "MessageText[1]", "MessageText[2]", "MessageText[3]",
+		"MessageText[4]", "MessageText[5]", "MessageText[6]", "MessageText[7]",
+		"MessageBinary[0]", "MessageText[8]", "MessageBinary[1]",
+	}, got)
+}
+
+func TestSetReadPriorityClose(t *testing.T) {
+	t.Parallel()
+
+	ctx, client, server := newRawConnPair(t)
+	server.SetReadPriority(func(typ MessageType, p []byte) int {
+		if typ == MessageText {
+			return 1
+		}
+		return 0
+	})
+	server.SetPrefetch(true)
+	client.CloseRead(ctx)
+
+	for i := 0; i < 3; i++ {
+		err := client.Write(ctx, MessageBinary, []byte{byte(i)})
+		assert.Success(t, err)
+	}
+	err := client.Write(ctx, MessageText, []byte{0})
+	assert.Success(t, err)
+	err = client.Close(StatusNormalClosure, "")
+	assert.Success(t, err)
+
+	var got []string
+	for i := 0; i < 4; i++ {
+		typ, p, err := server.Read(ctx)
+		assert.Success(t, err)
+		got = append(got, fmt.Sprintf("%v%v", typ, p))
+	}
+	assert.Equal(t, "messages", []string{
+		"MessageText[0]", "MessageBinary[0]", "MessageBinary[1]", "MessageBinary[2]",
+	}, got)
+
+	_, _, err = server.Read(ctx)
+	assert.Equal(t, "close status", StatusNormalClosure, CloseStatus(err))
+}
+
+func TestPrefetchReceivedAt(t *testing.T) {
+	t.Parallel()
+
+	ctx, client, server := newRawConnPair(t)
+	server.SetPrefetch(true)
+
+	readMessage := []func() (Message, error){
+		func() (Message, error) {
+			m, err := server.ReadMessage(ctx)
+			if err != nil {
+				return Message{}, err
+			}
+			return *m, nil
+		},
+		func() (Message, error) {
+			msgs, err := server.ReadBatch(ctx, 1)
+			if err != nil {
+				return Message{}, err
+			}
+			return msgs[0], nil
+		},
+	}
+	for _, read := range readMessage {
+		// The write returns once the message is being read in the background.
+		err := client.Write(ctx, MessageBinary, []byte("meow"))
+		assert.Success(t, err)
+		time.Sleep(time.Millisecond * 10)
+
+		delivered := time.Now()
+		m, err := read()
+		assert.Success(t, err)
+		if !m.ReceivedAt.Before(delivered) {
+			t.Fatalf("message received at %v, not before it was delivered at %v", m.ReceivedAt, delivered)
+		}
+	}
+}
+
+func TestUndeliveredCount(t *testing.T) {
+	t.Parallel()
+
+	ctx, client, server := newRawConnPair(t)
+	assert.Equal(t, "undelivered", 0, server.UndeliveredCount())
+	server.SetReadPriority(func(MessageType, []byte) int {
+		return 0
+	})
+	server.SetPrefetch(true)
+	client.CloseRead(ctx)
+
+	for i := 0; i < 3; i++ {
+		err := client.Write(ctx, MessageBinary, []byte{byte(i)})
+		assert.Success(t, err)
+	}
+	// Once the pong is received every message has been read ahead.
+	err := client.Ping(ctx)
+	assert.Success(t, err)
+	assert.Equal(t, "undelivered", 3, server.UndeliveredCount())
+
+	_, _, err = server.Read(ctx)
+	assert.Success(t, err)
+	assert.Equal(t, "undelivered", 2, server.UndeliveredCount())
+
+	msgs, err := server.ReadBatch(ctx, 10)
+	assert.Success(t, err)
+	assert.Equal(t, "msgs", 2, len(msgs))
+	assert.Equal(t, "undelivered", 0, server.UndeliveredCount())
+}
@@ -0,0 +1,191 @@
+//go:build !js
+// +build !js
+
+package websocket
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// Directions of the records written by SetRecorder.
+const (
+	recordRead  byte = 'r'
+	recordWrite byte = 'w'
+)
+
+// SetRecorder records the raw bytes read from and written to the underlying
+// connection to w so that they can be replayed later with NewReplayConn.
+//
+// Every read or write is recorded as a direction byte, 'r' or 'w', followed
+// by the length of the data as a 4 byte big endian integer and then the data.
+// A record may contain part of a frame or many frames. Errors writing to w are
+// ignored.
+//
+// It is implemented with SwapTransport and so returns an error under the same
+// conditions, except that frames which arrived along with the handshake are
+// recorded as they are read. Call it before the connection is used.
+func (c *Conn) SetRecorder(w io.Writer) error {
+	rec := &recorder{w: w}
+	c.closeMu.Lock()
+	rwc := c.rwc
+	if c.brPrefix != nil {
+		rec.prefix = c.brPrefix
+	}
+	c.closeMu.Unlock()
+	if nc, ok := rwc.(net.Conn); ok {
+		// Keep the net.Conn methods available for deadlines.
+		return c.swapTransport(recordingNetConn{nc, rec}, true)
+	}
+	return c.swapTransport(recordingRWC{rwc, rec}, true)
+}
+
+// NewReplayConn returns a Conn that reads the data recorded as read by
+// SetRecorder from recording. Writes to the Conn are discarded. Once the
+// recording is exhausted, reads return io.EOF.
+//
+// client and mode must match the recorded connection, with mode being the
+// compression mode that was negotiated.
+func NewReplayConn(recording io.Reader, client bool, mode CompressionMode) *Conn {
+	rwc := &replayRWC{r: bufio.NewReader(recording)}
+
+	var copts *compressionOptions
+	if mode != CompressionDisabled {
+		copts = mode.opts()
+	}
+	return newConn(connConfig{
+		rwc:    rwc,
+		client: client,
+		copts:  copts,
+		br:     bufio.NewReader(rwc),
+		bw:     bufio.NewWriter(rwc),
+	})
+}
+
+type recorder struct {
+	mu sync.Mutex
+	w  io.Writer
+	// prefix is read before the connection if set. See Conn.brPrefix.
+	prefix io.Reader
+}
+
+// read reads from prefix until it is exhausted and then from r, recording
+// what it read.
+func (r *recorder) read(rd io.Reader, p []byte) (int, error) {
+	if r.prefix != nil {
+		n, err := r.prefix.Read(p)
+		if errors.Is(err, io.EOF) {
+			r.prefix = nil
+		}
+		if n > 0 {
+			r.record(recordRead, p[:n])
+			return n, nil
+		}
+	}
+	n, err := rd.Read(p)
+	if n > 0 {
+		r.record(recordRead, p[:n])
+	}
+	return n, err
+}
+
+func (r *recorder) record(dir byte, p []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var h [5]byte
+	h[0] = dir
+	binary.BigEndian.PutUint32(h[1:], uint32(len(p)))
+	_, err := r.w.Write(h[:])
+	if err != nil {
+		return
+	}
+	r.w.Write(p)
+}
+
+type recordingRWC struct {
+	io.ReadWriteCloser
+	rec *recorder
+}
+
+func (rw recordingRWC) Read(p []byte) (int, error) {
+	return rw.rec.read(rw.ReadWriteCloser, p)
+}
+
+func (rw recordingRWC) Write(p []byte) (int, error) {
+	n, err := rw.ReadWriteCloser.Write(p)
+	if n > 0 {
+		rw.rec.record(recordWrite, p[:n])
+	}
+	return n, err
+}
+
+type recordingNetConn struct {
+	net.Conn
+	rec *recorder
+}
+
+func (nc recordingNetConn) Read(p []byte) (int, error) {
+	return nc.rec.read(nc.Conn, p)
+}
+
+func (nc recordingNetConn) Write(p []byte) (int, error) {
+	n, err := nc.Conn.Write(p)
+	if n > 0 {
+		nc.rec.record(recordWrite, p[:n])
+	}
+	return n, err
+}
+
+// replayRWC reads the records of a recording written by SetRecorder.
+type replayRWC struct {
+	r *bufio.Reader
+	// buf is the unread remainder of the current read record.
+	buf []byte
+}
+
+func (rr *replayRWC) Read(p []byte) (int, error) {
+	for len(rr.buf) == 0 {
+		dir, err := rr.r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+
+		var h [4]byte
+		_, err = io.ReadFull(rr.r, h[:])
+		if err != nil {
+			return 0, fmt.Errorf("failed to read record length: %w", err)
+		}
+		n := binary.BigEndian.Uint32(h[:])
+
+		switch dir {
+		case recordRead:
+			rr.buf = make([]byte, n)
+			_, err = io.ReadFull(rr.r, rr.buf)
+		case recordWrite:
+			_, err = rr.r.Discard(int(n))
+		default:
+			return 0, fmt.Errorf("invalid record direction %q", dir)
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to read record: %w", err)
+		}
+	}
+
+	n := copy(p, rr.buf)
+	rr.buf = rr.buf[n:]
+	return n, nil
+}
+
+func (rr *replayRWC) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (rr *replayRWC) Close() error {
+	return nil
+}
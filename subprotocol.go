@@ -0,0 +1,52 @@
+package websocket
+
+import (
+	"strings"
+)
+
+// SubprotocolParams is a subprotocol parsed as a name followed by parameters
+// separated by semicolons, e.g. "chat.v2; level=3; compact".
+//
+// Offered subprotocols are separated by commas, so parameter values cannot
+// contain commas.
+type SubprotocolParams struct {
+	// Raw is the subprotocol as negotiated.
+	Raw string
+	// Name is the part before the first semicolon.
+	Name string
+	// Params maps the name of each parameter to its value with any quotes
+	// removed. A parameter without a value maps to the empty string.
+	// It is nil if there are no parameters.
+	Params map[string]string
+}
+
+// SubprotocolParams returns the negotiated subprotocol parsed into its name
+// and parameters. See Subprotocol.
+func (c *Conn) SubprotocolParams() SubprotocolParams {
+	return parseSubprotocol(c.Subprotocol())
+}
+
+func parseSubprotocol(s string) SubprotocolParams {
+	sp := SubprotocolParams{
+		Raw: s,
+	}
+
+	vals := strings.Split(s, ";")
+	sp.Name = strings.TrimSpace(vals[0])
+	for _, v := range vals[1:] {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		if sp.Params == nil {
+			sp.Params = make(map[string]string)
+		}
+		k, v, _ := strings.Cut(v, "=")
+		v = strings.TrimSpace(v)
+		if len(v) >= 2 && v[0] == '"' && v[len(v)-1] == '"' {
+			v = v[1 : len(v)-1]
+		}
+		sp.Params[strings.TrimSpace(k)] = v
+	}
+	return sp
+}
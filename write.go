@@ -12,7 +12,10 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"compress/flate"
 
@@ -25,8 +28,16 @@ import (
 //
 // You must close the writer once you have written the entire message.
 //
+// Written data may be buffered until the writer is closed. The writer has a
+// Flush() error method that sends the data written so far to the peer without
+// ending the message, e.g. to stream a long lived message promptly.
+//
 // Only one writer can be open at a time, multiple calls will block until the previous writer
 // is closed.
+//
+// An open writer only holds the connection while writing a frame. Control frames,
+// e.g. those of Ping and Close, are written between the frames of the message as
+// RFC 6455 allows and so do not wait for the writer to be closed.
 func (c *Conn) Writer(ctx context.Context, typ MessageType) (io.WriteCloser, error) {
 	w, err := c.writer(ctx, typ)
 	if err != nil {
@@ -42,13 +53,311 @@ func (c *Conn) Writer(ctx context.Context, typ MessageType) (io.WriteCloser, err
 // If compression is disabled or the compression threshold is not met, then it
 // will write the message in a single frame.
 func (c *Conn) Write(ctx context.Context, typ MessageType, p []byte) error {
-	_, err := c.write(ctx, typ, p)
+	_, err := c.write(ctx, typ, p, nil)
 	if err != nil {
 		return fmt.Errorf("failed to write msg: %w", err)
 	}
 	return nil
 }
 
+// WriteDeadline is like Write but bounds the write by the duration d instead
+// of a context. A zero duration means no timeout.
+func (c *Conn) WriteDeadline(typ MessageType, p []byte, d time.Duration) error {
+	ctx := context.Background()
+	if d > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d)
+		defer cancel()
+	}
+	return c.Write(ctx, typ, p)
+}
+
+// WriteAck writes a message and then reads until a message for which
+// ackMatch returns true arrives, e.g. for at least once delivery where the
+// application acknowledges every message. Messages that do not match are
+// discarded.
+//
+// WriteAck reads from the connection itself and so must not be combined with
+// a concurrent Reader or Read loop. As with Read, the connection is closed if
+// ctx expires before the ack arrives so resend on a new connection.
+func (c *Conn) WriteAck(ctx context.Context, typ MessageType, p []byte, ackMatch func(MessageType, []byte) bool) error {
+	err := c.Write(ctx, typ, p)
+	if err != nil {
+		return err
+	}
+
+	for {
+		typ, b, err := c.Read(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to read ack: %w", err)
+		}
+		if ackMatch(typ, b) {
+			return nil
+		}
+	}
+}
+
+// SetDefaultWriteContext sets the context WriteDefault writes with, e.g. to
+// bound writes by a request scoped context without passing it around.
+//
+// Changing it also applies to the WriteDefault calls in progress, so a
+// blocked write picks up the new deadline. Pass nil to clear it.
+func (c *Conn) SetDefaultWriteContext(ctx context.Context) {
+	c.defaultWriteCtxMu.Lock()
+	defer c.defaultWriteCtxMu.Unlock()
+
+	dc := c.defaultWriteCtx
+	if dc == nil || dc.Context.Err() != nil {
+		if ctx == nil {
+			c.defaultWriteCtx = nil
+			return
+		}
+		dc = newDefaultWriteContext(c)
+		c.defaultWriteCtx = dc
+	} else {
+		close(dc.set)
+		dc.set = make(chan struct{})
+	}
+	dc.ctx = ctx
+	if ctx != nil && ctx.Err() != nil {
+		dc.end(ctx.Err())
+	}
+}
+
+// WriteDefault is like Write but uses the context set with
+// SetDefaultWriteContext. Without one, the write is only bounded by
+// the connection.
+func (c *Conn) WriteDefault(typ MessageType, p []byte) error {
+	var ctx context.Context = context.Background()
+	c.defaultWriteCtxMu.Lock()
+	if dc := c.defaultWriteCtx; dc != nil && (dc.ctx != nil || dc.Context.Err() != nil) {
+		ctx = dc
+	}
+	c.defaultWriteCtxMu.Unlock()
+	return c.Write(ctx, typ, p)
+}
+
+// defaultWriteContext is shared by all WriteDefault calls and follows the
+// default write context of c as it is changed with SetDefaultWriteContext.
+// It is done once the default it follows is and then replaced by the next call
+// to SetDefaultWriteContext.
+type defaultWriteContext struct {
+	context.Context
+	c      *Conn
+	cancel context.CancelFunc
+
+	// ctx is the default followed and set is closed and replaced whenever
+	// it changes. Both are guarded by c.defaultWriteCtxMu.
+	ctx context.Context
+	set chan struct{}
+
+	mu  sync.Mutex
+	err error
+}
+
+func newDefaultWriteContext(c *Conn) *defaultWriteContext {
+	ctx, cancel := context.WithCancel(context.Background())
+	dc := &defaultWriteContext{
+		Context: ctx,
+		c:       c,
+		cancel:  cancel,
+		set:     make(chan struct{}),
+	}
+
+	if !c.isClosed() {
+		c.wgAdd()
+		go func() {
+			defer c.wgDone()
+			dc.follow()
+		}()
+	}
+	return dc
+}
+
+func (dc *defaultWriteContext) follow() {
+	c := dc.c
+	for {
+		c.defaultWriteCtxMu.Lock()
+		ctx, set := dc.ctx, dc.set
+		c.defaultWriteCtxMu.Unlock()
+		var done <-chan struct{}
+		if ctx != nil {
+			done = ctx.Done()
+		}
+
+		select {
+		case <-done:
+			c.defaultWriteCtxMu.Lock()
+			current := dc.ctx == ctx
+			if current {
+				dc.end(ctx.Err())
+			}
+			c.defaultWriteCtxMu.Unlock()
+			if current {
+				return
+			}
+		case <-set:
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+// end cancels dc with the error of the default that ended it.
+func (dc *defaultWriteContext) end(err error) {
+	dc.mu.Lock()
+	if dc.err == nil {
+		dc.err = err
+	}
+	dc.mu.Unlock()
+	dc.cancel()
+}
+
+func (dc *defaultWriteContext) Deadline() (time.Time, bool) {
+	dc.c.defaultWriteCtxMu.Lock()
+	ctx := dc.ctx
+	dc.c.defaultWriteCtxMu.Unlock()
+	if ctx == nil {
+		return time.Time{}, false
+	}
+	return ctx.Deadline()
+}
+
+// Err returns the error of the default write context that ended the write.
+func (dc *defaultWriteContext) Err() error {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	if dc.err == nil {
+		return dc.Context.Err()
+	}
+	return dc.err
+}
+
+// WriteSync is like Write but guarantees that the message has been flushed to
+// the underlying connection when it returns, e.g. for synchronous protocols.
+//
+// Write currently flushes at the end of every message as well but WriteSync
+// makes it a guarantee. The extra flush reacquires the frame write lock and so
+// costs a little under concurrent writes.
+func (c *Conn) WriteSync(ctx context.Context, typ MessageType, p []byte) error {
+	_, err := c.write(ctx, typ, p, nil)
+	if err == nil {
+		err = c.flush(ctx)
+		if err != nil {
+			err = fmt.Errorf("failed to flush: %w", err)
+			c.close(err)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write msg: %w", err)
+	}
+	return nil
+}
+
+// PartialWriteError is returned when writing a frame to the connection failed
+// after part of it was written. The connection is closed and the error it was
+// closed with wraps PartialWriteError too.
+//
+// It means the message may have been partially delivered to the peer.
+type PartialWriteError struct {
+	// Written is the number of bytes the underlying connection accepted
+	// while the frame was written, including its header and any frames
+	// buffered before it.
+	Written int
+	Err     error
+}
+
+func (e PartialWriteError) Error() string {
+	return fmt.Sprintf("partial write of %v bytes: %v", e.Written, e.Err)
+}
+
+func (e PartialWriteError) Unwrap() error {
+	return e.Err
+}
+
+// WriteResult describes a message written with WriteWithStats.
+type WriteResult struct {
+	// Size is the length of the message.
+	Size int
+	// WireSize is the length of the message as written to the connection,
+	// excluding frame headers. It is smaller than Size when compression
+	// was effective.
+	WireSize int
+	// Compressed is whether the message was compressed.
+	Compressed bool
+}
+
+// WriteFrom writes a message of n bytes read from r in a single frame and
+// returns the number of payload bytes written. The message is never
+// compressed.
+//
+// If c is a server and the underlying connection implements io.ReaderFrom,
+// the payload is handed to ReadFrom instead of being copied through the
+// write buffer. For a *net.TCPConn and an *os.File this lets the kernel
+// use sendfile. Client frames must be masked so they always take the
+// buffered path.
+//
+// r must produce at least n bytes. If it does not, the connection is closed
+// as the frame header announcing n bytes has already been written. For the
+// same reason, the connection is closed if a text message turns out not to be
+// valid UTF-8, see SetOutgoingTextValidation.
+//
+// WriteFrom returns an error if custom extensions were negotiated as they
+// need the whole payload of the frame.
+func (c *Conn) WriteFrom(ctx context.Context, typ MessageType, r io.Reader, n int64) (int64, error) {
+	if typ != MessageText && typ != MessageBinary {
+		return 0, fmt.Errorf("failed to write from reader: unexpected message type: %v", typ)
+	}
+	if len(c.extCodecs) > 0 {
+		return 0, fmt.Errorf("failed to write from reader: %w", errExtensionsNegotiated)
+	}
+
+	var vr *utf8ValidatingReader
+	if typ == MessageText && !c.noOutgoingTextValidation.Load() {
+		vr = &utf8ValidatingReader{r: r}
+		r = vr
+	}
+
+	err := c.msgWriter.mu.lock(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer c.msgWriter.mu.unlock()
+
+	written, err := c.writeFramePayloadOf(ctx, true, false, opcode(typ), framePayload{r: r, n: n}, false)
+	if err == nil && vr != nil && !vr.v.done() {
+		// The frame was already written.
+		c.close(errInvalidOutgoingUTF8)
+		return int64(written), errInvalidOutgoingUTF8
+	}
+	return int64(written), err
+}
+
+// utf8ValidatingReader fails once what was read from r is not valid UTF-8.
+type utf8ValidatingReader struct {
+	r io.Reader
+	v utf8Validator
+}
+
+func (vr *utf8ValidatingReader) Read(p []byte) (int, error) {
+	n, err := vr.r.Read(p)
+	if !vr.v.write(p[:n]) {
+		return 0, errInvalidOutgoingUTF8
+	}
+	return n, err
+}
+
+// WriteWithStats is like Write but also reports how well the message
+// compressed, e.g. to tune the compression threshold.
+func (c *Conn) WriteWithStats(ctx context.Context, typ MessageType, p []byte) (WriteResult, error) {
+	var res WriteResult
+	_, err := c.write(ctx, typ, p, &res)
+	if err != nil {
+		return res, fmt.Errorf("failed to write msg: %w", err)
+	}
+	return res, nil
+}
+
 type msgWriter struct {
 	c *Conn
 
@@ -59,9 +368,21 @@ type msgWriter struct {
 	ctx    context.Context
 	opcode opcode
 	flate  bool
+	// res is updated with the stats of the message if set.
+	res *WriteResult
+
+	validateUTF8 bool
+	utf8         utf8Validator
 
 	trimWriter  *trimLastFourBytesWriter
 	flateWriter *flate.Writer
+
+	// gen is incremented for every message so that a stale
+	// idle flush does not flush the next message.
+	gen          uint64
+	idleFlush    time.Duration
+	idleTimer    *time.Timer
+	idleTimerGen uint64
 }
 
 func newMsgWriter(c *Conn) *msgWriter {
@@ -81,7 +402,7 @@ func (mw *msgWriter) ensureFlate() {
 	}
 
 	if mw.flateWriter == nil {
-		mw.flateWriter = getFlateWriter(mw.trimWriter)
+		mw.flateWriter = getFlateWriter(mw.trimWriter, mw.c.flateLevel)
 	}
 	mw.flate = true
 }
@@ -94,43 +415,143 @@ func (mw *msgWriter) flateContextTakeover() bool {
 }
 
 func (c *Conn) writer(ctx context.Context, typ MessageType) (io.WriteCloser, error) {
-	err := c.msgWriter.reset(ctx, typ)
+	err := c.msgWriter.mu.lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	err = c.msgWriter.reset(ctx, typ)
 	if err != nil {
+		c.msgWriter.mu.unlock()
 		return nil, err
 	}
 	return c.msgWriter, nil
 }
 
-func (c *Conn) write(ctx context.Context, typ MessageType, p []byte) (int, error) {
-	mw, err := c.writer(ctx, typ)
+// abortableWrite reports whether a write may be aborted without closing the
+// connection. See TimeoutAbortWrite.
+func (c *Conn) abortableWrite() bool {
+	return !c.flate() && TimeoutPolicy(c.writeTimeoutPolicy.Load()) == TimeoutAbortWrite
+}
+
+func (c *Conn) write(ctx context.Context, typ MessageType, p []byte, res *WriteResult) (int, error) {
+	abortable := c.abortableWrite()
+	var err error
+	if abortable {
+		err = c.msgWriter.mu.lockNoClose(ctx)
+	} else {
+		err = c.msgWriter.mu.lock(ctx)
+	}
 	if err != nil {
 		return 0, err
 	}
+	defer c.msgWriter.mu.unlock()
+
+	return c.writeLocked(ctx, typ, p, res, abortable)
+}
+
+// writeLocked writes a message. It must be called with msgWriter.mu held.
+func (c *Conn) writeLocked(ctx context.Context, typ MessageType, p []byte, res *WriteResult, abortable bool) (int, error) {
+	if res != nil {
+		res.Size = len(p)
+	}
+
+	validateUTF8 := typ == MessageText && !c.noOutgoingTextValidation.Load()
+	if validateUTF8 && !utf8.Valid(p) {
+		return 0, errInvalidOutgoingUTF8
+	}
 
 	if !c.flate() {
-		defer c.msgWriter.mu.unlock()
-		return c.writeFrame(ctx, true, false, c.msgWriter.opcode, p)
+		n, err := c.writeFrameAbortable(ctx, true, false, opcode(typ), p, abortable)
+		if res != nil {
+			res.WireSize = n
+		}
+		return n, err
 	}
 
+	mw := c.msgWriter
+	err := mw.reset(ctx, typ)
+	if err != nil {
+		return 0, err
+	}
+	mw.res = res
+	// p was validated whole.
+	mw.validateUTF8 = false
+
 	n, err := mw.Write(p)
 	if err != nil {
 		return n, err
 	}
 
-	err = mw.Close()
+	err = mw.closeMessage()
 	return n, err
 }
 
+// WriteAll writes msgs in order without any other data message being written
+// between them, e.g. for a sequence of messages that is logically atomic.
+// Control frames may still be written between them. ReceivedAt is ignored.
+//
+// The messages are buffered and flushed once after the last one so that they
+// are coalesced into as few writes to the underlying connection as the buffer
+// allows, e.g. ten small messages are sent with one write instead of ten.
+// Under TimeoutAbortWrite, every message is flushed as it is written.
+//
+// If a message cannot be written, the error reports how many were sent, i.e.
+// flushed to the underlying connection. Messages still buffered at the time
+// are counted as not sent even if some of their bytes were written.
+func (c *Conn) WriteAll(ctx context.Context, msgs []Message) error {
+	abortable := c.abortableWrite()
+	var err error
+	if abortable {
+		err = c.msgWriter.mu.lockNoClose(ctx)
+	} else {
+		err = c.msgWriter.mu.lock(ctx)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write msgs: %w", err)
+	}
+	defer c.msgWriter.mu.unlock()
+
+	// An aborted write discards the buffer so it must only hold one message.
+	c.deferFlush.Store(!abortable)
+	defer c.deferFlush.Store(false)
+
+	for i, m := range msgs {
+		if i == len(msgs)-1 {
+			// The last message flushes all of them.
+			c.deferFlush.Store(false)
+		}
+		_, err = c.writeLocked(ctx, m.Type, m.Data, nil, abortable)
+		if err != nil {
+			// Buffered messages are only known to be sent once flushed.
+			sent := i
+			if !abortable && i > 0 {
+				c.deferFlush.Store(false)
+				if c.flush(ctx) != nil {
+					sent = 0
+				}
+			}
+			return fmt.Errorf("failed to write msgs: sent %v of %v: %w", sent, len(msgs), err)
+		}
+	}
+	return nil
+}
+
+// reset prepares mw to write a new message. It must be called with mu held.
 func (mw *msgWriter) reset(ctx context.Context, typ MessageType) error {
-	err := mw.mu.lock(ctx)
+	err := mw.writeMu.lock(ctx)
 	if err != nil {
 		return err
 	}
+	defer mw.writeMu.unlock()
 
+	mw.gen++
 	mw.ctx = ctx
 	mw.opcode = opcode(typ)
 	mw.flate = false
 	mw.closed = false
+	mw.res = nil
+	mw.validateUTF8 = typ == MessageText && !mw.c.noOutgoingTextValidation.Load()
+	mw.utf8.reset()
 
 	mw.trimWriter.reset()
 
@@ -139,7 +560,7 @@ func (mw *msgWriter) reset(ctx context.Context, typ MessageType) error {
 
 func (mw *msgWriter) putFlateWriter() {
 	if mw.flateWriter != nil {
-		putFlateWriter(mw.flateWriter)
+		putFlateWriter(mw.flateWriter, mw.c.flateLevel)
 		mw.flateWriter = nil
 	}
 }
@@ -163,14 +584,22 @@ func (mw *msgWriter) Write(p []byte) (_ int, err error) {
 		}
 	}()
 
+	if mw.validateUTF8 && !mw.utf8.write(p) {
+		return 0, errInvalidOutgoingUTF8
+	}
+
 	if mw.c.flate() {
 		// Only enables flate if the length crosses the
 		// threshold on the first frame
-		if mw.opcode != opContinuation && len(p) >= mw.c.flateThreshold {
+		if mw.opcode != opContinuation && mw.c.shouldCompress(MessageType(mw.opcode), len(p)) {
 			mw.ensureFlate()
 		}
 	}
 
+	if mw.idleFlush > 0 {
+		mw.resetIdleTimer()
+	}
+
 	if mw.flate {
 		return mw.flateWriter.Write(p)
 	}
@@ -178,8 +607,127 @@ func (mw *msgWriter) Write(p []byte) (_ int, err error) {
 	return mw.write(p)
 }
 
+// SetWriterIdleFlush sets the duration after which a message being streamed
+// with Writer is flushed to the peer if there have been no writes.
+//
+// Without it, data written to a Writer may be buffered until the buffer fills
+// or the Writer is closed. With it, buffered data is sent to the peer as a
+// frame of the message while keeping the message open, which is useful for
+// streaming sporadic data like log lines as a single message.
+//
+// By default, there is no idle flush. Set to 0 to disable.
+func (c *Conn) SetWriterIdleFlush(d time.Duration) {
+	c.msgWriter.idleFlush = d
+}
+
+// SetCompressionForType sets which messages of type typ are compressed.
+// It has no effect unless compression was negotiated or if typ is not
+// MessageText or MessageBinary.
+//
+// The policy is applied when a message is started so messages already
+// being written are unaffected. Uncompressed messages are valid under
+// context takeover so policies may be changed at any time.
+//
+// By default, both types use CompressionThresholdBased.
+func (c *Conn) SetCompressionForType(typ MessageType, policy CompressionPolicy) {
+	if typ != MessageText && typ != MessageBinary {
+		return
+	}
+	c.compressionPolicy[typ].Store(int32(policy))
+}
+
+// shouldCompress reports whether a message of type typ whose first write
+// is n bytes should be compressed.
+func (c *Conn) shouldCompress(typ MessageType, n int) bool {
+	if typ != MessageText && typ != MessageBinary {
+		return false
+	}
+	switch CompressionPolicy(c.compressionPolicy[typ].Load()) {
+	case CompressionAlways:
+		return true
+	case CompressionNever:
+		return false
+	default:
+		return n >= c.flateThreshold
+	}
+}
+
+// resetIdleTimer must be called with writeMu held.
+func (mw *msgWriter) resetIdleTimer() {
+	mw.idleTimerGen = mw.gen
+	if mw.idleTimer == nil {
+		mw.idleTimer = time.AfterFunc(mw.idleFlush, mw.flushIdle)
+		return
+	}
+	mw.idleTimer.Reset(mw.idleFlush)
+}
+
+func (mw *msgWriter) stopIdleTimer() {
+	if mw.idleTimer != nil {
+		mw.idleTimer.Stop()
+	}
+}
+
+func (mw *msgWriter) flushIdle() {
+	if !mw.writeMu.tryLock() {
+		// There is an active write so the writer is not idle.
+		return
+	}
+	defer mw.writeMu.unlock()
+
+	if mw.closed || mw.idleTimerGen != mw.gen || mw.c.isClosed() {
+		return
+	}
+
+	mw.flush()
+}
+
+// Flush writes the data buffered for the message to the connection without
+// ending the message.
+func (mw *msgWriter) Flush() error {
+	err := mw.writeMu.lock(mw.ctx)
+	if err != nil {
+		return fmt.Errorf("failed to flush: %w", err)
+	}
+	defer mw.writeMu.unlock()
+
+	if mw.closed {
+		return errors.New("cannot use closed writer")
+	}
+	return mw.flush()
+}
+
+// flush writes any data buffered for the current message to the connection.
+// It must be called with writeMu held.
+func (mw *msgWriter) flush() (err error) {
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("failed to flush: %w", err)
+			mw.c.close(err)
+		}
+	}()
+
+	if mw.flate {
+		err = mw.flateWriter.Flush()
+		if err != nil {
+			return fmt.Errorf("failed to flush flate: %w", err)
+		}
+		// The sync marker written by Flush only ends a message when the
+		// writer is closed so it must be sent.
+		err = mw.trimWriter.flushTail()
+		if err != nil {
+			return fmt.Errorf("failed to flush flate: %w", err)
+		}
+	}
+
+	return mw.c.flush(mw.ctx)
+}
+
 func (mw *msgWriter) write(p []byte) (int, error) {
 	n, err := mw.c.writeFrame(mw.ctx, false, mw.flate, mw.opcode, p)
+	if mw.res != nil {
+		mw.res.WireSize += n
+	}
 	if err != nil {
 		return n, fmt.Errorf("failed to write data frame: %w", err)
 	}
@@ -188,7 +736,17 @@ func (mw *msgWriter) write(p []byte) (int, error) {
 }
 
 // Close flushes the frame to the connection.
-func (mw *msgWriter) Close() (err error) {
+func (mw *msgWriter) Close() error {
+	err := mw.closeMessage()
+	if err != nil {
+		return err
+	}
+	mw.mu.unlock()
+	return nil
+}
+
+// closeMessage ends the message without releasing mu.
+func (mw *msgWriter) closeMessage() (err error) {
 	defer errd.Wrap(&err, "failed to close writer")
 
 	err = mw.writeMu.lock(mw.ctx)
@@ -201,6 +759,13 @@ func (mw *msgWriter) Close() (err error) {
 		return errors.New("writer already closed")
 	}
 	mw.closed = true
+	mw.stopIdleTimer()
+
+	if mw.validateUTF8 && !mw.utf8.done() {
+		// The rest of the message was already written.
+		mw.c.close(errInvalidOutgoingUTF8)
+		return errInvalidOutgoingUTF8
+	}
 
 	if mw.flate {
 		err = mw.flateWriter.Flush()
@@ -214,28 +779,40 @@ func (mw *msgWriter) Close() (err error) {
 		return fmt.Errorf("failed to write fin frame: %w", err)
 	}
 
+	if mw.res != nil {
+		mw.res.Compressed = mw.flate
+		mw.res = nil
+	}
 	if mw.flate && !mw.flateContextTakeover() {
 		mw.putFlateWriter()
 	}
-	mw.mu.unlock()
 	return nil
 }
 
 func (mw *msgWriter) close() {
 	if mw.c.client {
 		mw.c.writeFrameMu.forceLock()
-		putBufioWriter(mw.c.bw)
+		if !mw.c.userBw {
+			putBufioWriter(mw.c.bw)
+		}
 	}
 
 	mw.writeMu.forceLock()
+	mw.stopIdleTimer()
 	mw.putFlateWriter()
 }
 
 func (c *Conn) writeControl(ctx context.Context, opcode opcode, p []byte) error {
+	return c.writeControlAbortable(ctx, opcode, p, false)
+}
+
+// writeControlAbortable is writeControl but if abortable is set, the
+// connection is not closed when ctx expires. See writeFrameAbortable.
+func (c *Conn) writeControlAbortable(ctx context.Context, opcode opcode, p []byte, abortable bool) error {
 	ctx, cancel := context.WithTimeout(ctx, time.Second*5)
 	defer cancel()
 
-	_, err := c.writeFrame(ctx, true, false, opcode, p)
+	_, err := c.writeFrameAbortable(ctx, true, false, opcode, p, abortable)
 	if err != nil {
 		return fmt.Errorf("failed to write control frame %v: %w", opcode, err)
 	}
@@ -243,8 +820,39 @@ func (c *Conn) writeControl(ctx context.Context, opcode opcode, p []byte) error
 }
 
 // frame handles all writes to the connection.
-func (c *Conn) writeFrame(ctx context.Context, fin bool, flate bool, opcode opcode, p []byte) (_ int, err error) {
-	err = c.writeFrameMu.lock(ctx)
+func (c *Conn) writeFrame(ctx context.Context, fin bool, flate bool, opcode opcode, p []byte) (int, error) {
+	return c.writeFrameAbortable(ctx, fin, flate, opcode, p, false)
+}
+
+// writeFrameAbortable is writeFrame but if abortable is set, the connection
+// is not closed when ctx expires. See TimeoutAbortWrite.
+func (c *Conn) writeFrameAbortable(ctx context.Context, fin bool, flate bool, opcode opcode, p []byte, abortable bool) (int, error) {
+	return c.writeFramePayloadOf(ctx, fin, flate, opcode, framePayload{p: p}, abortable)
+}
+
+// framePayload is the payload of a frame being written. It is either p
+// or the next n bytes of r.
+type framePayload struct {
+	p []byte
+	r io.Reader
+	n int64
+}
+
+func (fp framePayload) len() int64 {
+	if fp.r != nil {
+		return fp.n
+	}
+	return int64(len(fp.p))
+}
+
+func (c *Conn) writeFramePayloadOf(ctx context.Context, fin bool, flate bool, opcode opcode, fp framePayload, abortable bool) (n int, err error) {
+	defer c.startWriteStallTimer()()
+
+	if abortable {
+		err = c.writeFrameMu.lockNoClose(ctx)
+	} else {
+		err = c.writeFrameMu.lock(ctx)
+	}
 	if err != nil {
 		return 0, err
 	}
@@ -267,6 +875,12 @@ func (c *Conn) writeFrame(ctx context.Context, fin bool, flate bool, opcode opco
 		}
 	}
 	defer c.writeFrameMu.unlock()
+	defer c.updatePendingWriteBytes()
+
+	if abortable {
+		c.writeAbortable.Store(true)
+		defer c.writeAbortable.Store(false)
+	}
 
 	select {
 	case <-c.closed:
@@ -274,23 +888,53 @@ func (c *Conn) writeFrame(ctx context.Context, fin bool, flate bool, opcode opco
 	case c.writeTimeout <- ctx:
 	}
 
+	// Aborting discards everything buffered and so is only possible if bw
+	// holds nothing but this frame, e.g. no frames of an open Writer, and
+	// none of the frame reached the connection.
+	abortable = abortable && c.bw.Buffered() == 0
+	socketWritten := c.socketWritten.Load()
+
 	defer func() {
 		if err != nil {
+			// Check ctx first as the timeoutLoop closes the connection
+			// once it expires.
 			select {
-			case <-c.closed:
-				err = net.ErrClosed
 			case <-ctx.Done():
 				err = ctx.Err()
 			default:
+				select {
+				case <-c.closed:
+					err = net.ErrClosed
+				default:
+					err = abnormalClosureError{err}
+					written := c.socketWritten.Load() - socketWritten
+					if written > 0 {
+						err = PartialWriteError{Written: int(written), Err: err}
+					}
+				}
+			}
+			if !abortable || c.socketWritten.Load() != socketWritten || !c.abortWrite(ctx) {
+				c.close(err)
 			}
-			c.close(err)
 			err = fmt.Errorf("failed to write frame: %w", err)
 		}
 	}()
 
+	// Report the length of the caller's payload rather than the one of
+	// the frame encoded by the extensions.
+	written := int(fp.len())
+	c.writeHeader.rsv2 = false
+	c.writeHeader.rsv3 = false
+	if len(c.extCodecs) > 0 && fp.r == nil && (opcode == opContinuation || opcode == opText || opcode == opBinary) {
+		fp.p, err = c.encodeExtensionFrame(fin, flate, opcode, fp.p)
+		if err != nil {
+			return 0, err
+		}
+	}
+
 	c.writeHeader.fin = fin
 	c.writeHeader.opcode = opcode
-	c.writeHeader.payloadLength = int64(len(p))
+	c.writeHeader.payloadLength = fp.len()
 
 	if c.client {
 		c.writeHeader.masked = true
@@ -311,12 +955,17 @@ func (c *Conn) writeFrame(ctx context.Context, fin bool, flate bool, opcode opco
 		return 0, err
 	}
 
-	n, err := c.writeFramePayload(p)
+	if fp.r != nil {
+		n, err = c.writeFramePayloadFrom(fp.r, fp.n)
+	} else {
+		n, err = c.writeFramePayload(fp.p)
+	}
 	if err != nil {
 		return n, err
 	}
 
-	if c.writeHeader.fin {
+	deferFlush := c.deferFlush.Load() && (opcode == opText || opcode == opBinary || opcode == opContinuation)
+	if c.writeHeader.fin && !deferFlush {
 		err = c.bw.Flush()
 		if err != nil {
 			return n, fmt.Errorf("failed to flush: %w", err)
@@ -332,7 +981,136 @@ func (c *Conn) writeFrame(ctx context.Context, fin bool, flate bool, opcode opco
 	case c.writeTimeout <- context.Background():
 	}
 
-	return n, nil
+	if abortable && ctx.Err() != nil {
+		// The timeoutLoop may have interrupted the write after it completed.
+		if nc, ok := c.underlyingNetConn(); ok {
+			nc.SetWriteDeadline(time.Time{})
+		}
+	}
+
+	return written, nil
+}
+
+// abortWrite recovers from a write interrupted by the timeoutLoop
+// under TimeoutAbortWrite. It reports whether the connection can
+// still be used.
+func (c *Conn) abortWrite(ctx context.Context) bool {
+	nc, ok := c.underlyingNetConn()
+	if !ok || ctx.Err() == nil {
+		return false
+	}
+
+	select {
+	case <-c.closed:
+		return false
+	case c.writeTimeout <- context.Background():
+	}
+
+	err := nc.SetWriteDeadline(time.Time{})
+	if err != nil {
+		return false
+	}
+	// Discards the frame, none of which was written, and the sticky write
+	// error.
+	c.bw.Reset(c.socketWriter())
+	return true
+}
+
+// PendingWriteBytes returns the number of bytes of frames buffered by the
+// Conn that have not yet been written to the underlying connection, e.g.
+// the frames of a message being streamed with Writer. It does not include
+// data held by the compressor or the socket send buffer.
+//
+// It is updated once every frame is written so a frame being written is not
+// reflected until it completes.
+func (c *Conn) PendingWriteBytes() int {
+	return int(c.pendingWriteBytes.Load())
+}
+
+// updatePendingWriteBytes must be called with writeFrameMu held.
+func (c *Conn) updatePendingWriteBytes() {
+	c.pendingWriteBytes.Store(int64(c.bw.Buffered()))
+}
+
+// UnsafeWriteRaw writes p to the underlying connection as is, without any
+// WebSocket framing or masking. It is intended only for testing how a peer
+// handles malformed input such as invalid frames. Writing p will almost
+// certainly corrupt the stream.
+//
+// p is written between frames, not in the middle of one.
+func (c *Conn) UnsafeWriteRaw(ctx context.Context, p []byte) (err error) {
+	defer errd.Wrap(&err, "failed to write raw bytes")
+
+	err = c.writeFrameMu.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.writeFrameMu.unlock()
+	defer c.updatePendingWriteBytes()
+
+	select {
+	case <-c.closed:
+		return net.ErrClosed
+	case c.writeTimeout <- ctx:
+	}
+
+	_, err = c.bw.Write(p)
+	if err == nil {
+		err = c.bw.Flush()
+	}
+	if err != nil {
+		select {
+		case <-c.closed:
+			return net.ErrClosed
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+		c.close(err)
+		return err
+	}
+
+	select {
+	case <-c.closed:
+		return net.ErrClosed
+	case c.writeTimeout <- context.Background():
+	}
+	return nil
+}
+
+// flush flushes any buffered frames to the connection.
+func (c *Conn) flush(ctx context.Context) error {
+	err := c.writeFrameMu.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.writeFrameMu.unlock()
+	defer c.updatePendingWriteBytes()
+
+	select {
+	case <-c.closed:
+		return net.ErrClosed
+	case c.writeTimeout <- ctx:
+	}
+
+	err = c.bw.Flush()
+	if err != nil {
+		select {
+		case <-c.closed:
+			return net.ErrClosed
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+		return err
+	}
+
+	select {
+	case <-c.closed:
+		return net.ErrClosed
+	case c.writeTimeout <- context.Background():
+	}
+	return nil
 }
 
 func (c *Conn) writeFramePayload(p []byte) (n int, err error) {
@@ -342,6 +1120,10 @@ func (c *Conn) writeFramePayload(p []byte) (n int, err error) {
 		return c.bw.Write(p)
 	}
 
+	if c.writeBuf == nil || c.writeBufNoReuse.Load() {
+		return c.writeFramePayloadScratch(p)
+	}
+
 	maskKey := c.writeHeader.maskKey
 	for len(p) > 0 {
 		// If the buffer is full, we need to flush.
@@ -374,6 +1156,184 @@ func (c *Conn) writeFramePayload(p []byte) (n int, err error) {
 	return n, nil
 }
 
+// writeFramePayloadScratch masks p in a dedicated scratch buffer before
+// writing it to bw instead of masking in place in the buffer of bw.
+func (c *Conn) writeFramePayloadScratch(p []byte) (n int, err error) {
+	if c.writeScratch == nil {
+		c.writeScratch = make([]byte, 4096)
+	}
+
+	maskKey := c.writeHeader.maskKey
+	for len(p) > 0 {
+		j := copy(c.writeScratch, p)
+		maskKey = mask(maskKey, c.writeScratch[:j])
+
+		m, err := c.bw.Write(c.writeScratch[:j])
+		n += m
+		if err != nil {
+			return n, err
+		}
+		p = p[j:]
+	}
+	return n, nil
+}
+
+// SetWriteBufferReuse sets whether client connections mask outgoing
+// payloads in place in the buffer of their bufio.Writer.
+//
+// Client frames have to be masked without modifying the caller's data. By
+// default, the connection extracts the buffer backing its bufio.Writer with
+// extractBufioWriterBuf when it is created and masks the payload after
+// copying it there, avoiding a copy. This relies on the bufio.Writer not
+// being reset with a different buffer and on nothing else writing to the
+// buffer, so disable it if a custom transport layer conflicts with that.
+// Payloads are then copied into a dedicated 4 KB scratch buffer and masked
+// there before being written.
+//
+// It has no effect on server connections. By default, the buffer is reused.
+func (c *Conn) SetWriteBufferReuse(reuse bool) {
+	c.writeBufNoReuse.Store(!reuse)
+}
+
+// SetSocketWriteObserver sets fn to be called with the number of bytes of
+// every write to the underlying connection, i.e. every flush of the buffered
+// frames. Use it to see how well writes are coalesced when tuning buffer sizes
+// or TCP_NODELAY.
+//
+// fn is called on the writing goroutine with the write lock held and must not
+// block. While it is set, payloads written with WriteFrom go through the
+// buffer instead of directly to the connection so that every write is observed.
+//
+// Any buffered frames are flushed first. Set to nil to remove the observer.
+func (c *Conn) SetSocketWriteObserver(fn func(n int)) {
+	err := c.writeFrameMu.lockNoClose(context.Background())
+	if err != nil {
+		return
+	}
+	defer c.writeFrameMu.unlock()
+
+	// Reset discards the buffered frames.
+	err = c.bw.Flush()
+	if err != nil {
+		c.close(fmt.Errorf("failed to flush: %w", err))
+		return
+	}
+	c.socketWriteObserver = fn
+	c.bw.Reset(c.socketWriter())
+}
+
+// socketWriter returns the writer bw must write to.
+// It must be called with writeFrameMu held.
+func (c *Conn) socketWriter() io.Writer {
+	w := countingWriter{w: c.rwc, n: &c.socketWritten}
+	if c.socketWriteObserver == nil {
+		return w
+	}
+	return observedWriter{w: w, fn: c.socketWriteObserver}
+}
+
+// countingWriter counts the bytes written to w in n.
+type countingWriter struct {
+	w io.Writer
+	n *atomic.Int64
+}
+
+func (cw countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n.Add(int64(n))
+	return n, err
+}
+
+type observedWriter struct {
+	w  io.Writer
+	fn func(n int)
+}
+
+func (ow observedWriter) Write(p []byte) (int, error) {
+	n, err := ow.w.Write(p)
+	if n > 0 {
+		panicErr := recoverCallback("socket write observer", func() {
+			ow.fn(n)
+		})
+		if panicErr != nil && err == nil {
+			err = panicErr
+		}
+	}
+	return n, err
+}
+
+var errInvalidOutgoingUTF8 = errors.New("text message is not valid UTF-8")
+
+// SetOutgoingTextValidation sets whether text messages written to the
+// connection are validated to be UTF-8 as required by RFC 6455.
+//
+// A message that is not valid UTF-8 is not written and an error is returned.
+// With Writer, the message may already be partially written so the connection
+// is closed as well, as it is with WriteFrom. Messages written with
+// UnsafeWriteRaw are not validated.
+//
+// Disable it only to interoperate with a non conformant peer that expects
+// arbitrary bytes in text messages as the frames are then not compliant.
+//
+// Validation is enabled by default.
+func (c *Conn) SetOutgoingTextValidation(enabled bool) {
+	c.noOutgoingTextValidation.Store(!enabled)
+}
+
+// writeFramePayloadFrom writes the next n bytes of r as the frame payload.
+func (c *Conn) writeFramePayloadFrom(r io.Reader, n int64) (_ int, err error) {
+	defer errd.Wrap(&err, "failed to write frame payload")
+
+	r = io.LimitReader(r, n)
+
+	if rf, ok := c.rwc.(io.ReaderFrom); ok && !c.writeHeader.masked && c.socketWriteObserver == nil {
+		// Flush the header so the payload can bypass the buffer.
+		err = c.bw.Flush()
+		if err != nil {
+			return 0, err
+		}
+		written, err := rf.ReadFrom(r)
+		c.socketWritten.Add(written)
+		if err == nil && written < n {
+			err = io.ErrUnexpectedEOF
+		}
+		return int(written), err
+	}
+
+	maskKey := c.writeHeader.maskKey
+	var written int64
+	for written < n {
+		if c.bw.Available() == 0 {
+			err = c.bw.Flush()
+			if err != nil {
+				return int(written), err
+			}
+		}
+
+		buf := c.bw.AvailableBuffer()
+		if int64(cap(buf)) > n-written {
+			buf = buf[:n-written]
+		} else {
+			buf = buf[:cap(buf)]
+		}
+
+		m, err := io.ReadFull(r, buf)
+		if c.writeHeader.masked {
+			maskKey = mask(maskKey, buf[:m])
+		}
+		c.bw.Write(buf[:m])
+		written += int64(m)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return int(written), err
+		}
+	}
+
+	return int(written), nil
+}
+
 // extractBufioWriterBuf grabs the []byte backing a *bufio.Writer
 // and returns it.
 func extractBufioWriterBuf(bw *bufio.Writer, w io.Writer) []byte {
@@ -0,0 +1,668 @@
+//go:build !js
+// +build !js
+
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"nhooyr.io/websocket/internal/test/assert"
+	"nhooyr.io/websocket/internal/test/xrand"
+	"nhooyr.io/websocket/internal/xsync"
+)
+
+func TestWriteTimeoutPolicy(t *testing.T) {
+	t.Parallel()
+
+	ctx, client, server := newRawConnPair(t)
+	server.SetWriteTimeoutPolicy(TimeoutAbortWrite)
+
+	// The client is not reading so the write blocks.
+	wctx, cancel := context.WithTimeout(ctx, time.Millisecond*50)
+	defer cancel()
+	err := server.Write(wctx, MessageText, []byte("first"))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded: %v", err)
+	}
+
+	errs := xsync.Go(func() error {
+		return server.Write(ctx, MessageText, []byte("second"))
+	})
+
+	_, b, err := client.Read(ctx)
+	assert.Success(t, err)
+	assert.Equal(t, "msg", "second", string(b))
+	assert.Success(t, <-errs)
+}
+
+func TestWriteTimeoutPolicyPartialFrame(t *testing.T) {
+	t.Parallel()
+
+	ctx, client, server := newRawConnPair(t)
+	server.SetWriteTimeoutPolicy(TimeoutAbortWrite)
+	client.SetReadLimit(1 << 21)
+
+	// The client reads the start of the frame and then stops.
+	errs := xsync.Go(func() error {
+		_, r, err := client.Reader(ctx)
+		if err != nil {
+			return err
+		}
+		_, err = r.Read(make([]byte, 1))
+		return err
+	})
+
+	wctx, cancel := context.WithTimeout(ctx, time.Millisecond*50)
+	defer cancel()
+	err := server.Write(wctx, MessageBinary, make([]byte, 1<<20))
+	assert.ErrorIs(t, context.DeadlineExceeded, err)
+	assert.Success(t, <-errs)
+	assert.Equal(t, "closed", true, server.IsClosed())
+}
+
+func TestSwapTransport(t *testing.T) {
+	t.Parallel()
+
+	ctx, client, server := newRawConnPair(t)
+
+	errs := xsync.Go(func() error {
+		return client.Write(ctx, MessageText, []byte("first"))
+	})
+	_, b, err := server.Read(ctx)
+	assert.Success(t, err)
+	assert.Equal(t, "msg", "first", string(b))
+	assert.Success(t, <-errs)
+
+	cc, sc := net.Pipe()
+	assert.Success(t, client.SwapTransport(cc))
+	assert.Success(t, server.SwapTransport(sc))
+
+	errs = xsync.Go(func() error {
+		return client.Write(ctx, MessageText, []byte("second"))
+	})
+	_, b, err = server.Read(ctx)
+	assert.Success(t, err)
+	assert.Equal(t, "msg", "second", string(b))
+	assert.Success(t, <-errs)
+
+	t.Run("partialRead", func(t *testing.T) {
+		errs := xsync.Go(func() error {
+			return client.Write(ctx, MessageText, []byte("third"))
+		})
+
+		_, r, err := server.Reader(ctx)
+		assert.Success(t, err)
+		_, err = r.Read(make([]byte, 1))
+		assert.Success(t, err)
+		assert.Success(t, <-errs)
+
+		err = server.SwapTransport(sc)
+		assert.Contains(t, err, "message partially read")
+	})
+}
+
+func TestSwapTransportConcurrent(t *testing.T) {
+	t.Parallel()
+
+	ctx, client, _ := newRawConnPair(t)
+	nc := NetConn(ctx, client, MessageBinary)
+
+	errs := xsync.Go(func() error {
+		for i := 0; i < 100; i++ {
+			cc, _ := net.Pipe()
+			err := client.SwapTransport(cc)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	for i := 0; i < 100; i++ {
+		nc.RemoteAddr()
+	}
+	assert.Success(t, <-errs)
+}
+
+func TestPartialWriteError(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	newFailingConn := func(n, bufSize int) *Conn {
+		// The connection fails after n bytes.
+		w := &limitedWriter{n: n}
+		rw := nopCloserRW{Reader: bytes.NewReader(nil), Writer: w}
+		c := newConn(connConfig{
+			rwc: rw,
+			br:  bufio.NewReader(rw),
+			bw:  bufio.NewWriterSize(rw, bufSize),
+		})
+		t.Cleanup(func() {
+			c.CloseNow()
+		})
+		return c
+	}
+
+	c := newFailingConn(20, 16)
+	err := c.Write(ctx, MessageBinary, make([]byte, 100))
+	var pwe PartialWriteError
+	if !errors.As(err, &pwe) {
+		t.Fatalf("expected PartialWriteError: %v", err)
+	}
+	assert.Equal(t, "written", 20, pwe.Written)
+	assert.ErrorIs(t, ErrAbnormalClosure, err)
+
+	c.closeMu.Lock()
+	if !errors.As(c.closeErr, &pwe) {
+		t.Fatalf("expected close error to wrap PartialWriteError: %v", c.closeErr)
+	}
+	c.closeMu.Unlock()
+
+	// The whole frame is buffered and the flush fails.
+	c = newFailingConn(5, 4096)
+	err = c.Write(ctx, MessageBinary, make([]byte, 100))
+	if !errors.As(err, &pwe) {
+		t.Fatalf("expected PartialWriteError: %v", err)
+	}
+	assert.Equal(t, "written", 5, pwe.Written)
+
+	c = newFailingConn(0, 4096)
+	err = c.Write(ctx, MessageBinary, make([]byte, 100))
+	assert.ErrorIs(t, ErrAbnormalClosure, err)
+	if errors.As(err, &pwe) {
+		t.Fatalf("unexpected PartialWriteError: %v", err)
+	}
+}
+
+type limitedWriter struct {
+	n int
+}
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	if len(p) > w.n {
+		n := w.n
+		w.n = 0
+		return n, errors.New("connection reset")
+	}
+	w.n -= len(p)
+	return len(p), nil
+}
+
+func TestWriteSync(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	var frames bytes.Buffer
+	rw := nopCloserRW{Reader: bytes.NewReader(nil), Writer: &frames}
+	c := newConn(connConfig{
+		rwc: rw,
+		br:  bufio.NewReader(rw),
+		bw:  bufio.NewWriter(rw),
+	})
+	defer c.CloseNow()
+
+	err := c.WriteSync(ctx, MessageText, []byte("meow"))
+	assert.Success(t, err)
+	assert.Equal(t, "frames", []byte("\x81\x04meow"), frames.Bytes())
+}
+
+func TestWriteWithPriority(t *testing.T) {
+	t.Parallel()
+
+	ctx, client, server := newRawConnPair(t)
+
+	// The first write blocks until the server reads.
+	errs := xsync.Go(func() error {
+		return client.WriteWithPriority(ctx, 0, MessageText, []byte("first"))
+	})
+	waitWaiters := func(n int) {
+		for {
+			client.writeQueue.mu.Lock()
+			busy, l := client.writeQueue.busy, len(client.writeQueue.waiters)
+			client.writeQueue.mu.Unlock()
+			if busy && l == n {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	waitWaiters(0)
+
+	for i, msg := range []string{"low", "high", "low2"} {
+		priority := 0
+		if msg == "high" {
+			priority = 10
+		}
+		msg := msg
+		errs2 := xsync.Go(func() error {
+			return client.WriteWithPriority(ctx, priority, MessageText, []byte(msg))
+		})
+		waitWaiters(i + 1)
+		defer func() {
+			assert.Success(t, <-errs2)
+		}()
+	}
+
+	for _, exp := range []string{"first", "high", "low", "low2"} {
+		_, b, err := server.Read(ctx)
+		assert.Success(t, err)
+		assert.Equal(t, "msg", exp, string(b))
+	}
+	assert.Success(t, <-errs)
+}
+
+// readerFromRW is a nopCloserRW that implements io.ReaderFrom and records
+// whether ReadFrom was used.
+type readerFromRW struct {
+	nopCloserRW
+	readFrom bool
+}
+
+func (rw *readerFromRW) ReadFrom(r io.Reader) (int64, error) {
+	rw.readFrom = true
+	return io.Copy(rw.Writer, r)
+}
+
+func TestWriteFrom(t *testing.T) {
+	t.Parallel()
+
+	// writeFrom writes p with WriteFrom from a Conn with the given role and
+	// returns the message read back by its peer.
+	writeFrom := func(t *testing.T, client bool, p []byte, n int64) (*readerFromRW, []byte, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+		defer cancel()
+
+		var frames bytes.Buffer
+		w := &readerFromRW{nopCloserRW: nopCloserRW{Writer: &frames}}
+		c := newConn(connConfig{
+			rwc:    w,
+			client: client,
+			br:     bufio.NewReader(w),
+			bw:     bufio.NewWriterSize(w, 64),
+		})
+		defer c.CloseNow()
+
+		written, err := c.WriteFrom(ctx, MessageBinary, bytes.NewReader(p), n)
+		if err != nil {
+			return w, nil, err
+		}
+		assert.Equal(t, "written", n, written)
+
+		r := nopCloserRW{Reader: &frames, Writer: io.Discard}
+		peer := newConn(connConfig{
+			rwc:    r,
+			client: !client,
+			br:     bufio.NewReader(r),
+			bw:     bufio.NewWriter(r),
+		})
+		defer peer.CloseNow()
+
+		typ, b, err := peer.Read(ctx)
+		assert.Success(t, err)
+		assert.Equal(t, "type", MessageBinary, typ)
+		return w, b, nil
+	}
+
+	p := bytes.Repeat([]byte("meow"), 100)
+
+	t.Run("server", func(t *testing.T) {
+		t.Parallel()
+
+		w, b, err := writeFrom(t, false, p, int64(len(p)))
+		assert.Success(t, err)
+		assert.Equal(t, "readFrom", true, w.readFrom)
+		assert.Equal(t, "msg", p, b)
+	})
+
+	t.Run("client", func(t *testing.T) {
+		t.Parallel()
+
+		w, b, err := writeFrom(t, true, p, int64(len(p)))
+		assert.Success(t, err)
+		assert.Equal(t, "readFrom", false, w.readFrom)
+		assert.Equal(t, "msg", p, b)
+	})
+
+	t.Run("short", func(t *testing.T) {
+		t.Parallel()
+
+		for _, client := range []bool{false, true} {
+			_, _, err := writeFrom(t, client, p, int64(len(p))+1)
+			assert.ErrorIs(t, io.ErrUnexpectedEOF, err)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		t.Parallel()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+		defer cancel()
+
+		for _, typ := range []MessageType{0, MessageType(opPing), MessageType(opClose)} {
+			rw := nopCloserRW{Reader: bytes.NewReader(nil), Writer: io.Discard}
+			c := newConn(connConfig{
+				rwc: rw,
+				br:  bufio.NewReader(rw),
+				bw:  bufio.NewWriter(rw),
+			})
+			_, err := c.WriteFrom(ctx, typ, bytes.NewReader(p), int64(len(p)))
+			assert.Contains(t, err, "unexpected message type")
+			c.CloseNow()
+		}
+
+		for _, text := range []string{"meow\xff meow", "meow\xe2\x82"} {
+			var frames bytes.Buffer
+			rw := nopCloserRW{Reader: bytes.NewReader(nil), Writer: &frames}
+			c := newConn(connConfig{
+				rwc: rw,
+				br:  bufio.NewReader(rw),
+				bw:  bufio.NewWriter(rw),
+			})
+			_, err := c.WriteFrom(ctx, MessageText, bytes.NewReader([]byte(text)), int64(len(text)))
+			assert.ErrorIs(t, errInvalidOutgoingUTF8, err)
+			assert.Equal(t, "closed", true, c.IsClosed())
+		}
+	})
+}
+
+func BenchmarkMaskedWrite(b *testing.B) {
+	ctx := context.Background()
+	w := nopCloserRW{Writer: io.Discard}
+	c := newConn(connConfig{
+		rwc:    w,
+		client: true,
+		br:     bufio.NewReader(w),
+		bw:     bufio.NewWriter(w),
+	})
+	defer c.CloseNow()
+
+	p := xrand.Bytes(512)
+	b.SetBytes(int64(len(p)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := c.Write(ctx, MessageBinary, p)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestWriteAllFlushesOnce(t *testing.T) {
+	t.Parallel()
+
+	ctx, client, server := newRawConnPair(t)
+
+	var writes []int
+	client.SetSocketWriteObserver(func(n int) {
+		writes = append(writes, n)
+	})
+
+	errs := xsync.Go(func() error {
+		return client.WriteAll(ctx, []Message{
+			{Type: MessageText, Data: []byte("meow")},
+			{Type: MessageText, Data: []byte("woof")},
+		})
+	})
+	for _, exp := range []string{"meow", "woof"} {
+		_, b, err := server.Read(ctx)
+		assert.Success(t, err)
+		assert.Equal(t, "msg", exp, string(b))
+	}
+	assert.Success(t, <-errs)
+
+	// Both 10 byte frames are flushed at once.
+	assert.Equal(t, "writes", []int{20}, writes)
+}
+
+func TestWriteAllFlushError(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	// The connection fails on the flush of the last message.
+	rw := nopCloserRW{Reader: bytes.NewReader(nil), Writer: &limitedWriter{}}
+	c := newConn(connConfig{
+		rwc: rw,
+		br:  bufio.NewReader(rw),
+		bw:  bufio.NewWriter(rw),
+	})
+	defer c.CloseNow()
+
+	err := c.WriteAll(ctx, []Message{
+		{Type: MessageText, Data: []byte("meow")},
+		{Type: MessageText, Data: []byte("woof")},
+		{Type: MessageText, Data: []byte("purr")},
+	})
+	assert.Contains(t, err, "sent 0 of 3")
+}
+
+// BenchmarkWriteAll compares the writes to the underlying connection of
+// writing 10 small messages with Write and with WriteAll. Write takes 10
+// writes/op and WriteAll takes 1.
+func BenchmarkWriteAll(b *testing.B) {
+	msgs := make([]Message, 10)
+	for i := range msgs {
+		msgs[i] = Message{Type: MessageBinary, Data: xrand.Bytes(64)}
+	}
+
+	for _, all := range []bool{false, true} {
+		name := "Write"
+		if all {
+			name = "WriteAll"
+		}
+		b.Run(name, func(b *testing.B) {
+			ctx := context.Background()
+			w := nopCloserRW{Writer: io.Discard}
+			c := newConn(connConfig{
+				rwc:    w,
+				client: true,
+				br:     bufio.NewReader(w),
+				bw:     bufio.NewWriter(w),
+			})
+			defer c.CloseNow()
+
+			var writes int
+			c.SetSocketWriteObserver(func(n int) {
+				writes++
+			})
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if all {
+					err := c.WriteAll(ctx, msgs)
+					if err != nil {
+						b.Fatal(err)
+					}
+					continue
+				}
+				for _, m := range msgs {
+					err := c.Write(ctx, m.Type, m.Data)
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+			b.ReportMetric(float64(writes)/float64(b.N), "writes/op")
+		})
+	}
+}
+
+func TestUnsafeWriteRaw(t *testing.T) {
+	t.Parallel()
+
+	ctx, client, server := newRawConnPair(t)
+
+	errs := xsync.Go(func() error {
+		// A text frame with a reserved bit set.
+		err := client.UnsafeWriteRaw(ctx, []byte{0xc1, 0x81, 0, 0, 0, 0, 'x'})
+		if err != nil {
+			return err
+		}
+		_, _, err = client.Reader(ctx)
+		if CloseStatus(err) != StatusProtocolError {
+			return err
+		}
+		return nil
+	})
+
+	_, _, err := server.Reader(ctx)
+	assert.Contains(t, err, "unexpected rsv bits")
+	assert.Success(t, <-errs)
+}
+
+func TestPendingWriteBytes(t *testing.T) {
+	t.Parallel()
+
+	ctx, client, server := newRawConnPair(t)
+	errs := xsync.Go(func() error {
+		_, _, err := server.Read(ctx)
+		return err
+	})
+
+	w, err := client.Writer(ctx, MessageText)
+	assert.Success(t, err)
+	_, err = w.Write([]byte("meow"))
+	assert.Success(t, err)
+	// The 2 byte header, the 4 byte mask key and the payload.
+	assert.Equal(t, "pending", 10, client.PendingWriteBytes())
+
+	assert.Success(t, w.Close())
+	assert.Equal(t, "pending", 0, client.PendingWriteBytes())
+	assert.Success(t, <-errs)
+}
+
+func TestWriteDeadline(t *testing.T) {
+	t.Parallel()
+
+	ctx, client, server := newRawConnPair(t)
+	errs := xsync.Go(func() error {
+		_, _, err := server.Read(ctx)
+		return err
+	})
+
+	err := client.WriteDeadline(MessageText, []byte("meow"), time.Second)
+	assert.Success(t, err)
+	assert.Success(t, <-errs)
+
+	// Nothing reads from the pipe anymore.
+	err = client.WriteDeadline(MessageText, []byte("meow"), time.Millisecond*10)
+	assert.ErrorIs(t, context.DeadlineExceeded, err)
+}
+
+func TestWriteAck(t *testing.T) {
+	t.Parallel()
+
+	ctx, client, server := newRawConnPair(t)
+	errs := xsync.Go(func() error {
+		_, p, err := server.Read(ctx)
+		if err != nil {
+			return err
+		}
+		err = server.Write(ctx, MessageText, []byte("unrelated"))
+		if err != nil {
+			return err
+		}
+		return server.Write(ctx, MessageText, append([]byte("ack "), p...))
+	})
+
+	err := client.WriteAck(ctx, MessageText, []byte("1"), func(typ MessageType, p []byte) bool {
+		return string(p) == "ack 1"
+	})
+	assert.Success(t, err)
+	assert.Success(t, <-errs)
+}
+
+func TestSetWriteBufferReuse(t *testing.T) {
+	t.Parallel()
+
+	ctx, client, server := newRawConnPair(t)
+	client.SetWriteBufferReuse(false)
+
+	p := xrand.Bytes(10000)
+	exp := append([]byte(nil), p...)
+	errs := xsync.Go(func() error {
+		return client.Write(ctx, MessageBinary, p)
+	})
+
+	_, b, err := server.Read(ctx)
+	assert.Success(t, err)
+	assert.Equal(t, "msg", exp, b)
+	assert.Success(t, <-errs)
+	assert.Equal(t, "caller's data", exp, p)
+}
+
+func TestSetSocketWriteObserver(t *testing.T) {
+	t.Parallel()
+
+	ctx, client, server := newRawConnPair(t)
+
+	var writes []int
+	client.SetSocketWriteObserver(func(n int) {
+		writes = append(writes, n)
+	})
+
+	errs := xsync.Go(func() error {
+		return client.Write(ctx, MessageText, []byte("hello"))
+	})
+	_, b, err := server.Read(ctx)
+	assert.Success(t, err)
+	assert.Equal(t, "msg", "hello", string(b))
+	assert.Success(t, <-errs)
+
+	// The 2 byte header, 4 byte mask key and payload are flushed at once.
+	assert.Equal(t, "writes", []int{11}, writes)
+}
+
+func TestSetOutgoingTextValidation(t *testing.T) {
+	t.Parallel()
+
+	ctx, client, server := newRawConnPair(t)
+
+	err := client.Write(ctx, MessageText, []byte("meow\xff"))
+	assert.ErrorIs(t, errInvalidOutgoingUTF8, err)
+	assert.Equal(t, "closed", false, client.IsClosed())
+
+	errs := xsync.Go(func() error {
+		// The rune is split across writes.
+		w, err := client.Writer(ctx, MessageText)
+		if err != nil {
+			return err
+		}
+		for _, p := range []string{"caf", "\xc3", "\xa9"} {
+			_, err = w.Write([]byte(p))
+			if err != nil {
+				return err
+			}
+		}
+		err = w.Close()
+		if err != nil {
+			return err
+		}
+
+		client.SetOutgoingTextValidation(false)
+		return client.Write(ctx, MessageText, []byte("meow\xff"))
+	})
+
+	_, b, err := server.Read(ctx)
+	assert.Success(t, err)
+	assert.Equal(t, "msg", "café", string(b))
+
+	server.SetTextValidation(false)
+	_, b, err = server.Read(ctx)
+	assert.Success(t, err)
+	assert.Equal(t, "msg", "meow\xff", string(b))
+	assert.Success(t, <-errs)
+}
@@ -233,6 +233,12 @@ func (c *Conn) Close(code StatusCode, reason string) error {
 	return nil
 }
 
+// CloseDefault closes the WebSocket with StatusNormalClosure and an empty reason.
+// It is intended for use in defer as in defer c.CloseDefault().
+func (c *Conn) CloseDefault() error {
+	return c.Close(StatusNormalClosure, "")
+}
+
 // CloseNow closes the WebSocket connection without attempting a close handshake.
 // Use when you do not want the overhead of the close handshake.
 //
@@ -340,6 +346,22 @@ func (c *Conn) Reader(ctx context.Context) (MessageType, io.Reader, error) {
 	return typ, bytes.NewReader(p), nil
 }
 
+// Echo reads every message from the connection and writes it back with
+// the same type until an error occurs or the context expires.
+func (c *Conn) Echo(ctx context.Context) error {
+	for {
+		typ, p, err := c.Read(ctx)
+		if err != nil {
+			return err
+		}
+
+		err = c.Write(ctx, typ, p)
+		if err != nil {
+			return err
+		}
+	}
+}
+
 // Writer returns a writer to write a WebSocket data message to the connection.
 // It buffers the entire message in memory and then sends it when the writer
 // is closed.
@@ -416,6 +438,14 @@ func (c *Conn) setCloseErr(err error) {
 	})
 }
 
+// IsClosed reports whether the connection has been closed.
+//
+// The connection may be closed right after IsClosed returns false so it is
+// only useful to skip work, not to guarantee that a subsequent call succeeds.
+func (c *Conn) IsClosed() bool {
+	return c.isClosed()
+}
+
 func (c *Conn) isClosed() bool {
 	select {
 	case <-c.closed:
@@ -484,6 +514,13 @@ const (
 	StatusTLSHandshake StatusCode = 1015
 )
 
+// ErrAbnormalClosure is wrapped by the errors returned when the connection
+// is closed without a close handshake in non Wasm Go.
+//
+// In Wasm, the browser reports abnormal closures as a CloseError with
+// StatusAbnormalClosure instead.
+var ErrAbnormalClosure = errors.New("WebSocket closed abnormally")
+
 // CloseError is returned when the connection is closed with a status and reason.
 //
 // Use Go 1.13's errors.As to check for this error.
@@ -2,9 +2,12 @@
 package wsjson // import "nhooyr.io/websocket/wsjson"
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 
 	"nhooyr.io/websocket"
 	"nhooyr.io/websocket/internal/bpool"
@@ -66,3 +69,53 @@ func write(ctx context.Context, c *websocket.Conn, v interface{}) (err error) {
 	}
 	return nil
 }
+
+// NDJSONReader starts reading the next message from c as newline delimited
+// JSON. Each call to Next on the returned iterator decodes the next line of
+// the message so that a long lived message of many values is never loaded
+// into memory whole. Empty lines are skipped.
+//
+// Lines are limited to bufio.MaxScanTokenSize bytes. The message is still
+// subject to the read limit of c so raise it with c.SetReadLimit as needed.
+// The message must be read to the end with Next before the next one can be read.
+func NDJSONReader(ctx context.Context, c *websocket.Conn) (*NDJSONIterator, error) {
+	_, r, err := c.Reader(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read NDJSON message: %w", err)
+	}
+	return &NDJSONIterator{
+		c: c,
+		s: bufio.NewScanner(r),
+	}, nil
+}
+
+// NDJSONIterator decodes the lines of a newline delimited JSON message.
+// See NDJSONReader.
+type NDJSONIterator struct {
+	c *websocket.Conn
+	s *bufio.Scanner
+}
+
+// Next decodes the next line of the message into v.
+// It returns io.EOF once the message has been read to the end.
+func (it *NDJSONIterator) Next(v interface{}) error {
+	for it.s.Scan() {
+		line := bytes.TrimSpace(it.s.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		err := json.Unmarshal(line, v)
+		if err != nil {
+			it.c.Close(websocket.StatusInvalidFramePayloadData, "failed to unmarshal JSON")
+			return fmt.Errorf("failed to unmarshal JSON line: %w", err)
+		}
+		return nil
+	}
+
+	err := it.s.Err()
+	if err != nil {
+		return fmt.Errorf("failed to read NDJSON line: %w", err)
+	}
+	return io.EOF
+}